@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// MinPasswordLength is the shortest password an account can have
+	MinPasswordLength = 8
+	// MaxPasswordLength is the longest password bcrypt can hash
+	MaxPasswordLength = 72
+	// GuestPrefix starts every guest's username, so guests can be told apart
+	// from accounts and no account can be registered under a guest's name
+	GuestPrefix = "Guest-"
+	// GuestIDBytes is how many random bytes follow the prefix in a guest's
+	// username. Games, the queue and sessions are all keyed by username, so
+	// two guests must never be given the same one.
+	GuestIDBytes = 16
+)
+
+// usernamePattern is what an account's username can look like
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,20}$`)
+
+// reservedUsernames cannot be registered, since the server already uses them
+var reservedUsernames = map[string]bool{"bot": true, "spectator": true}
+
+// Account is a registered player. Usernames are unique regardless of case;
+// the account keeps the case it was registered with.
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Identity is who a bearer token was issued to
+type Identity struct {
+	Username string `json:"sub"`
+	// Guest is set for a guest, who has no account and only plays casual games
+	Guest     bool  `json:"guest,omitempty"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Account and token errors sent back to the client
+var (
+	errAccountExists      = errors.New("that username is already taken")
+	errInvalidUsername    = errors.New("usernames are 3 to 20 letters, digits, '_' or '-'")
+	errReservedUsername   = errors.New("that username is reserved")
+	errInvalidPassword    = errors.New("passwords are 8 to 72 characters")
+	errInvalidCredentials = errors.New("wrong username or password")
+	errTokenRequired      = errors.New("a bearer token is required")
+	errTokenInvalid       = errors.New("that token is not valid")
+	errTokenExpired       = errors.New("that token has expired, please log in again")
+)
+
+// authSecret signs bearer tokens. It is set from the configuration at
+// startup, or made up if none is configured.
+var authSecret []byte
+
+// loadAuthSecret sets the secret bearer tokens are signed with. Without a
+// configured secret a random one is used, and tokens stop working when the
+// server restarts.
+func loadAuthSecret(secret string) error {
+	if secret != "" {
+		authSecret = []byte(secret)
+		return nil
+	}
+	authSecret = make([]byte, 32)
+	if _, err := rand.Read(authSecret); err != nil {
+		return err
+	}
+	log.Printf("No auth secret configured; tokens will not survive a restart")
+	return nil
+}
+
+// validateUsername checks a username an account is being registered under
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errInvalidUsername
+	}
+	lower := strings.ToLower(username)
+	if reservedUsernames[lower] || strings.HasPrefix(lower, strings.ToLower(GuestPrefix)) {
+		return errReservedUsername
+	}
+	return nil
+}
+
+// accountKey is how the game store looks up an account, so usernames that
+// differ only in case belong to the same account
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// Register creates an account with a hashed password
+func Register(username, password string, now time.Time) (Account, error) {
+	if err := validateUsername(username); err != nil {
+		return Account{}, err
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return Account{}, errInvalidPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+	account := Account{Username: username, PasswordHash: hash, CreatedAt: now}
+	if err := gameStore.CreateAccount(account); err != nil {
+		return Account{}, err
+	}
+	return account, nil
+}
+
+// Login checks a username and password, returning the account they belong to
+func Login(username, password string) (Account, error) {
+	account, found, err := gameStore.GetAccount(username)
+	if err != nil {
+		return Account{}, err
+	}
+	if !found || bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return Account{}, errInvalidCredentials
+	}
+	return account, nil
+}
+
+// newGuest makes up an identity for a guest
+func newGuest() (Identity, error) {
+	raw := make([]byte, GuestIDBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return Identity{}, err
+	}
+	return Identity{Username: GuestPrefix + hex.EncodeToString(raw), Guest: true}, nil
+}
+
+// signToken issues a bearer token for the identity, valid for the configured lifetime
+func signToken(identity Identity, now time.Time) (string, error) {
+	identity.ExpiresAt = now.Add(config.AuthTokenTTL).Unix()
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + tokenSignature(encoded), nil
+}
+
+// tokenSignature signs a token's encoded payload
+func tokenSignature(encoded string) string {
+	mac := hmac.New(sha256.New, authSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a bearer token's signature and expiry, returning who it was issued to
+func verifyToken(token string, now time.Time) (Identity, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(tokenSignature(encoded))) {
+		return Identity{}, errTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Identity{}, errTokenInvalid
+	}
+	var identity Identity
+	if err := json.Unmarshal(payload, &identity); err != nil || identity.Username == "" {
+		return Identity{}, errTokenInvalid
+	}
+	if now.Unix() >= identity.ExpiresAt {
+		return Identity{}, errTokenExpired
+	}
+	return identity, nil
+}
+
+// authenticate returns the identity of the bearer token sent with a request,
+// in the Authorization header or, for browsers opening a WebSocket, the token
+// query parameter
+func authenticate(r *http.Request) (Identity, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		bearer, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return Identity{}, errTokenInvalid
+		}
+		token = bearer
+	}
+	if token == "" {
+		return Identity{}, errTokenRequired
+	}
+	return verifyToken(token, time.Now())
+}
+
+// credentials is the body of a registration or login request
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// AuthResponse is the reply to a successful registration, login or guest request
+type AuthResponse struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+	Guest    bool   `json:"guest"`
+}
+
+// writeAuthResponse replies with a token for the identity
+func writeAuthResponse(w http.ResponseWriter, identity Identity, status int) {
+	token, err := signToken(identity, time.Now())
+	if err != nil {
+		http.Error(w, "could not issue a token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AuthResponse{Username: identity.Username, Token: token, Guest: identity.Guest})
+}
+
+// readCredentials decodes the body of a registration or login request,
+// replying with an error if it cannot
+func readCredentials(w http.ResponseWriter, r *http.Request) (credentials, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return credentials{}, false
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return credentials{}, false
+	}
+	return creds, true
+}
+
+// handleRegisterHTTP handles POST /register, creating an account and
+// replying with a token for it
+func handleRegisterHTTP(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := Register(creds.Username, creds.Password, time.Now())
+	switch {
+	case errors.Is(err, errAccountExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errInvalidUsername), errors.Is(err, errReservedUsername), errors.Is(err, errInvalidPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error registering %s: %v", creds.Username, err)
+		http.Error(w, "could not create the account", http.StatusInternalServerError)
+		return
+	}
+
+	writeAuthResponse(w, Identity{Username: account.Username}, http.StatusCreated)
+}
+
+// handleLoginHTTP handles POST /login, replying with a token for the account
+func handleLoginHTTP(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := Login(creds.Username, creds.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error logging in %s: %v", creds.Username, err)
+		http.Error(w, "could not log in", http.StatusInternalServerError)
+		return
+	}
+
+	writeAuthResponse(w, Identity{Username: account.Username}, http.StatusOK)
+}
+
+// handleGuestHTTP handles POST /guest, replying with a token for a new guest
+func handleGuestHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, err := newGuest()
+	if err != nil {
+		http.Error(w, "could not create a guest", http.StatusInternalServerError)
+		return
+	}
+	writeAuthResponse(w, identity, http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	useTestGlobals(t)
+	if err := loadAuthSecret("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token, err := signToken(Identity{Username: "alice"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := verifyToken(token, now); err != nil || identity.Username != "alice" || identity.Guest {
+		t.Fatalf("verifyToken = %+v, %v; want alice", identity, err)
+	}
+
+	// signed returns a token for an encoded payload with a valid signature
+	signed := func(encoded string) string {
+		return encoded + "." + tokenSignature(encoded)
+	}
+	encoded, signature, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","exp":9999999999}`))
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+		at    time.Time
+		want  error
+	}{
+		{"tampered signature", encoded + "." + string(flipped), now, errTokenInvalid},
+		{"tampered payload", forged + "." + signature, now, errTokenInvalid},
+		{"no signature", encoded, now, errTokenInvalid},
+		{"empty signature", encoded + ".", now, errTokenInvalid},
+		{"empty", "", now, errTokenInvalid},
+		{"payload not base64", signed("not base64!"), now, errTokenInvalid},
+		{"payload not JSON", signed(base64.RawURLEncoding.EncodeToString([]byte("alice"))), now, errTokenInvalid},
+		{"payload without a username", signed(base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999}`))), now, errTokenInvalid},
+		{"expired", token, now.Add(config.AuthTokenTTL), errTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if identity, err := verifyToken(tt.token, tt.at); !errors.Is(err, tt.want) {
+				t.Fatalf("verifyToken(%q) = %+v, %v; want %v", tt.token, identity, err, tt.want)
+			}
+		})
+	}
+
+	// A token signed with another secret is rejected
+	if err := loadAuthSecret("another-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyToken(token, now); !errors.Is(err, errTokenInvalid) {
+		t.Fatalf("token signed with another secret: %v, want %v", err, errTokenInvalid)
+	}
+}
+
+func TestUsernamesIgnoreCase(t *testing.T) {
+	useTestGlobals(t)
+	const password = "correct horse"
+	if _, err := Register("Alice", password, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Register("aLICE", "another password", time.Now()); !errors.Is(err, errAccountExists) {
+		t.Fatalf("registering aLICE after Alice: %v, want %v", err, errAccountExists)
+	}
+
+	for _, username := range []string{"Alice", "alice", "ALICE"} {
+		account, err := Login(username, password)
+		if err != nil || account.Username != "Alice" {
+			t.Fatalf("Login(%q) = %q, %v; want Alice as registered", username, account.Username, err)
+		}
+	}
+	if _, err := Login("alice", "wrong password"); !errors.Is(err, errInvalidCredentials) {
+		t.Fatalf("wrong password: %v, want %v", err, errInvalidCredentials)
+	}
+	if _, err := Login("bob", password); !errors.Is(err, errInvalidCredentials) {
+		t.Fatalf("unknown user: %v, want %v", err, errInvalidCredentials)
+	}
+
+	for _, username := range []string{"BOT", "Spectator", "guest-abc", "GUEST-123456"} {
+		if _, err := Register(username, password, time.Now()); !errors.Is(err, errReservedUsername) {
+			t.Fatalf("Register(%q): %v, want %v", username, err, errReservedUsername)
+		}
+	}
+}
+
+func TestGuestNamesAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		guest, err := newGuest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !guest.Guest || !strings.HasPrefix(guest.Username, GuestPrefix) || len(guest.Username) != len(GuestPrefix)+2*GuestIDBytes {
+			t.Fatalf("guest %+v, want a %s name of %d hex digits", guest, GuestPrefix, 2*GuestIDBytes)
+		}
+		if seen[guest.Username] {
+			t.Fatalf("guest name %s given twice", guest.Username)
+		}
+		seen[guest.Username] = true
+	}
+}
@@ -33,10 +33,23 @@ func startAnalyticsConsumer() {
 			analyticsData.GameCount++
 			gameStartTimes[event.GameID] = event.Timestamp
 			analyticsData.mu.Unlock()
-			log.Printf("Analytics: Game %s started between %s and %s", event.GameID, event.Player1, event.Player2)
+			if event.PreviousGameID != "" {
+				log.Printf("Analytics: Game %s started between %s and %s as a rematch of %s", event.GameID, event.Player1, event.Player2, event.PreviousGameID)
+			} else if event.Difficulty != "" {
+				log.Printf("Analytics: Game %s started between %s and %s (%s)", event.GameID, event.Player1, event.Player2, event.Difficulty)
+			} else {
+				log.Printf("Analytics: Game %s started between %s and %s", event.GameID, event.Player1, event.Player2)
+			}
 
 		case "MOVE_MADE":
-			log.Printf("Analytics: Move made in game %s by %s in column %d", event.GameID, event.Player, event.Column)
+			if event.MoveKind == string(MovePop) {
+				log.Printf("Analytics: Pop made in game %s by %s in column %d", event.GameID, event.Player, *event.Column)
+			} else {
+				log.Printf("Analytics: Move made in game %s by %s in column %d", event.GameID, event.Player, *event.Column)
+			}
+
+		case "CHAT":
+			log.Printf("Analytics: Chat in game %s from %s, %d characters, filtered: %v", event.GameID, event.Player, event.ChatLength, event.ChatFiltered)
 
 		case "GAME_ENDED":
 			analyticsData.mu.Lock()
@@ -51,7 +64,7 @@ func startAnalyticsConsumer() {
 			}
 			analyticsData.mu.Unlock()
 
-			log.Printf("Analytics: Game %s ended. Winner: %s, Draw: %v", event.GameID, event.Winner, event.IsDraw)
+			log.Printf("Analytics: Game %s ended by %s. Winner: %s, Draw: %v", event.GameID, event.Reason, event.Winner, event.IsDraw)
 		}
 	}
 }
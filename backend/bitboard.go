@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// bitset is a 128-bit set, wide enough for every board size a game may choose
+type bitset struct {
+	lo, hi uint64
+}
+
+// bitsetAt returns a set holding only bit i
+func bitsetAt(i int) bitset {
+	if i < 64 {
+		return bitset{lo: 1 << uint(i)}
+	}
+	return bitset{hi: 1 << uint(i-64)}
+}
+
+func (b bitset) and(o bitset) bitset    { return bitset{b.lo & o.lo, b.hi & o.hi} }
+func (b bitset) or(o bitset) bitset     { return bitset{b.lo | o.lo, b.hi | o.hi} }
+func (b bitset) andNot(o bitset) bitset { return bitset{b.lo &^ o.lo, b.hi &^ o.hi} }
+func (b bitset) isZero() bool           { return b.lo == 0 && b.hi == 0 }
+func (b bitset) count() int             { return bits.OnesCount64(b.lo) + bits.OnesCount64(b.hi) }
+
+// shl shifts the set left by n bits
+func (b bitset) shl(n uint) bitset {
+	switch {
+	case n == 0:
+		return b
+	case n >= 64:
+		return bitset{hi: b.lo << (n - 64)}
+	}
+	return bitset{lo: b.lo << n, hi: b.hi<<n | b.lo>>(64-n)}
+}
+
+// shr shifts the set right by n bits
+func (b bitset) shr(n uint) bitset {
+	switch {
+	case n == 0:
+		return b
+	case n >= 64:
+		return bitset{lo: b.hi >> (n - 64)}
+	}
+	return bitset{lo: b.lo>>n | b.hi<<(64-n), hi: b.hi >> n}
+}
+
+// geometry holds the precomputed masks for one board size and win length.
+// Geometries are shared between every board with the same dimensions.
+type geometry struct {
+	width      int
+	height     int
+	winLength  int
+	columnBits int
+	// shifts are the bit distances between neighbouring cells along a line:
+	// vertical, horizontal and the two diagonals
+	shifts [4]uint
+	// windows holds every line of winLength cells, used by the bot's evaluation
+	windows []bitset
+	// center covers the center column
+	center bitset
+	// columns holds the playable cells of each column
+	columns []bitset
+}
+
+var (
+	geometries   = make(map[[3]int]*geometry)
+	geometriesMu sync.Mutex
+)
+
+// geometryFor returns the shared geometry for a board size and win length
+func geometryFor(width, height, winLength int) *geometry {
+	key := [3]int{width, height, winLength}
+
+	geometriesMu.Lock()
+	defer geometriesMu.Unlock()
+
+	if g, ok := geometries[key]; ok {
+		return g
+	}
+
+	columnBits := height + 1
+	g := &geometry{
+		width:      width,
+		height:     height,
+		winLength:  winLength,
+		columnBits: columnBits,
+		shifts:     [4]uint{1, uint(columnBits), uint(columnBits - 1), uint(columnBits + 1)},
+	}
+	g.columns = make([]bitset, width)
+	for col := 0; col < width; col++ {
+		for row := 0; row < height; row++ {
+			g.columns[col] = g.columns[col].or(g.bitAt(row, col))
+		}
+	}
+	g.center = g.columns[width/2]
+
+	directions := [4][2]int{{1, 0}, {0, 1}, {1, 1}, {-1, 1}}
+	for col := 0; col < width; col++ {
+		for row := 0; row < height; row++ {
+			for _, d := range directions {
+				endRow, endCol := row+(winLength-1)*d[0], col+(winLength-1)*d[1]
+				if endRow < 0 || endRow >= height || endCol >= width {
+					continue
+				}
+				window := bitset{}
+				for i := 0; i < winLength; i++ {
+					window = window.or(g.bitAt(row+i*d[0], col+i*d[1]))
+				}
+				g.windows = append(g.windows, window)
+			}
+		}
+	}
+
+	geometries[key] = g
+	return g
+}
+
+// bitAt returns the bit for a cell, with row counted from the bottom
+func (g *geometry) bitAt(row, col int) bitset {
+	return bitsetAt(col*g.columnBits + row)
+}
+
+// Bitboard is a compact board representation used by Game and the bot search.
+//
+// Each column takes height+1 bits. Row 0 is the bottom of the column and the
+// extra top bit is always empty, so shifting a whole board never carries a disc
+// from one column into the next. Cell (row, col) counted from the bottom lives
+// at bit col*(height+1)+row.
+//
+// A Bitboard is a plain value: assigning it copies the position.
+type Bitboard struct {
+	geo     *geometry
+	pieces  [2]bitset
+	heights [MaxBoardWidth]int
+	moves   int
+}
+
+// NewBitboard creates an empty board. The dimensions must already be validated.
+func NewBitboard(width, height, winLength int) Bitboard {
+	return Bitboard{geo: geometryFor(width, height, winLength)}
+}
+
+// Width returns the number of columns
+func (b *Bitboard) Width() int {
+	return b.geo.width
+}
+
+// Height returns the number of rows
+func (b *Bitboard) Height() int {
+	return b.geo.height
+}
+
+// CanPlay reports whether a disc can be dropped in col
+func (b *Bitboard) CanPlay(col int) bool {
+	return col >= 0 && col < b.geo.width && b.heights[col] < b.geo.height
+}
+
+// Play drops a disc for player in col and returns the row it landed in,
+// counted from the top as in Game.Board. The caller must check CanPlay first.
+func (b *Bitboard) Play(col int, player Player) int {
+	row := b.heights[col]
+	b.pieces[player-1] = b.pieces[player-1].or(b.geo.bitAt(row, col))
+	b.heights[col]++
+	b.moves++
+	return b.geo.height - 1 - row
+}
+
+// Undo removes the top disc of col
+func (b *Bitboard) Undo(col int) {
+	b.heights[col]--
+	b.moves--
+	bit := b.geo.bitAt(b.heights[col], col)
+	b.pieces[0] = b.pieces[0].andNot(bit)
+	b.pieces[1] = b.pieces[1].andNot(bit)
+}
+
+// CanPop reports whether player owns the bottom disc of col
+func (b *Bitboard) CanPop(col int, player Player) bool {
+	if col < 0 || col >= b.geo.width || b.heights[col] == 0 {
+		return false
+	}
+	return !b.pieces[player-1].and(b.geo.bitAt(0, col)).isZero()
+}
+
+// Pop removes the bottom disc of col and lets the rest of the column fall
+// one row. The caller must check CanPop first.
+func (b *Bitboard) Pop(col int) {
+	column := b.geo.columns[col]
+	for i := range b.pieces {
+		fallen := b.pieces[i].and(column).shr(1).and(column)
+		b.pieces[i] = b.pieces[i].andNot(column).or(fallen)
+	}
+	b.heights[col]--
+	b.moves--
+}
+
+// Unpop reverses Pop, lifting the column one row and putting player's disc back at the bottom
+func (b *Bitboard) Unpop(col int, player Player) {
+	column := b.geo.columns[col]
+	for i := range b.pieces {
+		lifted := b.pieces[i].and(column).shl(1).and(column)
+		b.pieces[i] = b.pieces[i].andNot(column).or(lifted)
+	}
+	b.pieces[player-1] = b.pieces[player-1].or(b.geo.bitAt(0, col))
+	b.heights[col]++
+	b.moves++
+}
+
+// HasMove reports whether player can drop or, in PopOut, pop a disc anywhere
+func (b *Bitboard) HasMove(player Player, popOut bool) bool {
+	for col := 0; col < b.geo.width; col++ {
+		if b.CanPlay(col) || (popOut && b.CanPop(col, player)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key identifies the arrangement of discs, for spotting repeated positions
+func (b *Bitboard) Key() [2]bitset {
+	return b.pieces
+}
+
+// IsWin reports whether player has winLength in a row anywhere on the board
+func (b *Bitboard) IsWin(player Player) bool {
+	pieces := b.pieces[player-1]
+	for _, shift := range b.geo.shifts {
+		line := pieces
+		for i := 1; i < b.geo.winLength && !line.isZero(); i++ {
+			line = line.and(pieces.shr(uint(i) * shift))
+		}
+		if !line.isZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFull reports whether every cell is occupied
+func (b *Bitboard) IsFull() bool {
+	return b.moves == b.geo.width*b.geo.height
+}
+
+// Cell returns the disc at row, col with row counted from the top
+func (b *Bitboard) Cell(row, col int) Player {
+	bit := b.geo.bitAt(b.geo.height-1-row, col)
+	switch {
+	case !b.pieces[0].and(bit).isZero():
+		return Player1
+	case !b.pieces[1].and(bit).isZero():
+		return Player2
+	}
+	return Empty
+}
+
+// Array expands the bitboard into a row-major grid with row 0 at the top
+func (b *Bitboard) Array() [][]Player {
+	board := make([][]Player, b.geo.height)
+	for r := range board {
+		board[r] = make([]Player, b.geo.width)
+		for c := range board[r] {
+			board[r][c] = b.Cell(r, c)
+		}
+	}
+	return board
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// boardOptions returns options for a standard game on a board of the given size
+func boardOptions(width, height, winLength int) GameOptions {
+	opts := DefaultGameOptions()
+	opts.Width = width
+	opts.Height = height
+	opts.WinLength = winLength
+	return opts
+}
+
+// popOutWide returns PopOut options for a 12x9 board
+func popOutWide() GameOptions {
+	opts := boardOptions(12, 9, 4)
+	opts.Variant = VariantPopOut
+	return opts
+}
+
+// arrayWin is the array-based win check the bitboard replaced, made to work
+// for any board size and win length: it counts the player's discs in a row
+// from every cell of the grid in each of the four directions
+func arrayWin(board [][]Player, player Player, winLength int) bool {
+	directions := [4][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+	for r := range board {
+		for c := range board[r] {
+			for _, d := range directions {
+				count := 0
+				for row, col := r, c; row >= 0 && row < len(board) && col >= 0 && col < len(board[row]) && board[row][col] == player; row, col = row+d[0], col+d[1] {
+					count++
+				}
+				if count >= winLength {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkWinsMatch fails the test if IsWin disagrees with the array-based check for either player
+func checkWinsMatch(t *testing.T, board *Bitboard, winLength int, context string) {
+	t.Helper()
+	grid := board.Array()
+	for _, player := range []Player{Player1, Player2} {
+		if got, want := board.IsWin(player), arrayWin(grid, player, winLength); got != want {
+			t.Fatalf("%s: IsWin(%d) = %v, array check says %v\n%s", context, player, got, want, formatBoardString(board, Player1))
+		}
+	}
+}
+
+func TestBitsetShifts(t *testing.T) {
+	// The bits are chosen to sit on and around the boundary between the two words
+	positions := []int{0, 1, 62, 63, 64, 65, 126, 127}
+	set := bitset{}
+	for _, i := range positions {
+		set = set.or(bitsetAt(i))
+	}
+
+	for _, n := range []uint{0, 1, 2, 7, 10, 63, 64, 65, 100, 127, 128} {
+		wantLeft, wantRight := bitset{}, bitset{}
+		for _, i := range positions {
+			if i+int(n) < 128 {
+				wantLeft = wantLeft.or(bitsetAt(i + int(n)))
+			}
+			if i-int(n) >= 0 {
+				wantRight = wantRight.or(bitsetAt(i - int(n)))
+			}
+		}
+		if got := set.shl(n); got != wantLeft {
+			t.Errorf("shl(%d) = %x/%x, want %x/%x", n, got.hi, got.lo, wantLeft.hi, wantLeft.lo)
+		}
+		if got := set.shr(n); got != wantRight {
+			t.Errorf("shr(%d) = %x/%x, want %x/%x", n, got.hi, got.lo, wantRight.hi, wantRight.lo)
+		}
+	}
+}
+
+func TestIsWin(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  GameOptions
+		moves string
+		// winner is who the last move wins for
+		winner Player
+	}{
+		{"vertical", DefaultGameOptions(), "1212121", Player1},
+		{"horizontal", DefaultGameOptions(), "1122334", Player1},
+		{"diagonal", DefaultGameOptions(), "12234334544", Player1},
+		{"anti-diagonal", DefaultGameOptions(), "76654554344", Player1},
+		{"gap in the row", DefaultGameOptions(), "1122335", Empty},
+		{"second player", DefaultGameOptions(), "71212121", Player2},
+		{"no win on a full column", DefaultGameOptions(), "1111112", Empty},
+		// Column 7 of a 12x9 board takes bits 60 to 69, so lines through it
+		// cross from one word of the bitset into the other
+		{"wide vertical across words", boardOptions(12, 9, 4), "777878787", Player1},
+		{"wide horizontal across words", boardOptions(12, 9, 4), "5566778", Player1},
+		{"wide diagonal across words", boardOptions(12, 9, 4), "56678778988", Player1},
+		{"wide anti-diagonal across words", boardOptions(12, 9, 4), "98876776566", Player1},
+		{"wide five in a row", boardOptions(12, 9, 5), "556677889", Player1},
+		{"wide four is not five", boardOptions(12, 9, 5), "5566778", Empty},
+		{"rightmost columns", boardOptions(12, 9, 4), "cbcbcbc", Player1},
+		{"tall vertical across words", boardOptions(4, 20, 4), "4343434", Player1},
+		{"tall vertical at the top", boardOptions(4, 20, 4), "11111111111111111212121", Player1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A position already won cannot be parsed, so the last move is played on top
+			last := parseColumnSymbol(tt.moves[len(tt.moves)-1])
+			board, toMove, err := ParsePosition(tt.moves[:len(tt.moves)-1], tt.opts)
+			if err != nil {
+				t.Fatalf("ParsePosition(%q): %v", tt.moves[:len(tt.moves)-1], err)
+			}
+			checkWinsMatch(t, &board, tt.opts.WinLength, "before the last move")
+
+			board.Play(last, toMove)
+			checkWinsMatch(t, &board, tt.opts.WinLength, "after the last move")
+			for _, player := range []Player{Player1, Player2} {
+				if got, want := board.IsWin(player), player == tt.winner; got != want {
+					t.Fatalf("IsWin(%d) = %v, want %v", player, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPopUnpop(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     GameOptions
+		position string
+		column   int
+	}{
+		{"single disc", popOutOptions(), "7/7/7/7/7/3x3 o", 3},
+		{"full column", popOutOptions(), "3x3/3o3/3x3/3o3/3x3/o2o2x o", 3},
+		{"leftmost column", popOutOptions(), "7/7/7/o6/x6/x6 o", 0},
+		// Column 7 of a 12x9 board straddles the two words of the bitset
+		{"column across words", popOutWide(), "12/12/12/6x5/6o5/6x5/6o5/6x5/5ox5 x", 6},
+		{"full column across words", popOutWide(), "6o5/6x5/6o5/6x5/6o5/6x5/6o5/6x5/6o4x x", 6},
+		{"rightmost column", popOutWide(), "6o5/6x5/6o5/6x5/6o5/6x5/6o5/6x5/6o4x x", 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			board, toMove, err := ParsePosition(tt.position, tt.opts)
+			if err != nil {
+				t.Fatalf("ParsePosition(%q): %v", tt.position, err)
+			}
+			owner := board.Cell(board.Height()-1, tt.column)
+			if owner == Empty {
+				t.Fatalf("column %d has no disc to pop", tt.column)
+			}
+			if !board.CanPop(tt.column, owner) || board.CanPop(tt.column, opponent(owner)) {
+				t.Fatalf("CanPop(%d) does not match the bottom disc", tt.column)
+			}
+
+			before := board
+			grid := board.Array()
+			board.Pop(tt.column)
+
+			// Every disc above the popped one falls a row
+			for row := board.Height() - 1; row >= 0; row-- {
+				want := Empty
+				if row > 0 {
+					want = grid[row-1][tt.column]
+				}
+				if got := board.Cell(row, tt.column); got != want {
+					t.Fatalf("after popping, row %d of column %d = %d, want %d\n%s", row, tt.column, got, want, formatBoardString(&board, toMove))
+				}
+			}
+			checkWinsMatch(t, &board, tt.opts.WinLength, "after popping")
+
+			board.Unpop(tt.column, owner)
+			if board != before {
+				t.Fatalf("Unpop did not restore the position: got %s, want %s", formatBoardString(&board, toMove), formatBoardString(&before, toMove))
+			}
+		})
+	}
+}
+
+// TestIsWinRandomGames plays random games, with pops, on boards of many
+// shapes and checks IsWin against the array-based check after every move
+func TestIsWinRandomGames(t *testing.T) {
+	sizes := [][3]int{{7, 6, 4}, {4, 4, 3}, {12, 9, 4}, {12, 9, 6}, {8, 15, 5}, {4, 20, 4}, {5, 20, 5}}
+	r := rand.New(rand.NewSource(1))
+
+	for _, size := range sizes {
+		width, height, winLength := size[0], size[1], size[2]
+		t.Run(fmt.Sprintf("%dx%d win %d", width, height, winLength), func(t *testing.T) {
+			for game := 0; game < 50; game++ {
+				board := NewBitboard(width, height, winLength)
+				player := Player1
+				for ply := 0; ply < 4*width*height; ply++ {
+					var moves []searchMove
+					for col := 0; col < width; col++ {
+						if board.CanPlay(col) {
+							moves = append(moves, searchMove{col: col, kind: MoveDrop})
+						}
+						if board.CanPop(col, player) {
+							moves = append(moves, searchMove{col: col, kind: MovePop})
+						}
+					}
+					if len(moves) == 0 {
+						break
+					}
+
+					m := moves[r.Intn(len(moves))]
+					if m.kind == MovePop {
+						before := board
+						board.Pop(m.col)
+						checkWinsMatch(t, &board, winLength, fmt.Sprintf("game %d after popping column %d", game, m.col))
+						board.Unpop(m.col, player)
+						if board != before {
+							t.Fatalf("game %d: Unpop of column %d did not restore the position", game, m.col)
+						}
+						board.Pop(m.col)
+					} else {
+						board.Play(m.col, player)
+						checkWinsMatch(t, &board, winLength, fmt.Sprintf("game %d after dropping in column %d", game, m.col))
+					}
+
+					if board.IsWin(Player1) || board.IsWin(Player2) {
+						break
+					}
+					player = opponent(player)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestBoltStore opens the bolt store at path, closing it when the test ends
+func openTestBoltStore(t *testing.T, path string) *BoltGameStore {
+	t.Helper()
+	store, err := OpenBoltGameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// finishedRecord returns the record of a short finished game between the
+// players that ended at the given time
+func finishedRecord(player1, player2 string, ended time.Time) GameRecord {
+	game := NewGame(generateGameID(), player1, DefaultGameOptions())
+	game.StartGame(player2)
+	game.MakeMove(3, Player1)
+	game.MakeMove(4, Player2)
+	game.Forfeit(Player2, EndReasonResignation)
+	record := gameRecord(game)
+	record.EndedAt = &ended
+	return record
+}
+
+// sameRecord reports whether two records are stored the same
+func sameRecord(t *testing.T, got, want GameRecord) bool {
+	t.Helper()
+	a, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(a) == string(b)
+}
+
+func TestBoltStoreGames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.db")
+	store := openTestBoltStore(t, path)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := finishedRecord("alice", "bob", start)
+	latest := finishedRecord("carol", "alice", start.Add(time.Hour))
+	latest.Private = true
+	middle := finishedRecord("bob", "alice", start.Add(time.Minute))
+	for _, record := range []GameRecord{first, latest, middle} {
+		if err := store.SaveGame(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything survives closing and reopening the file
+	store.Close()
+	store = openTestBoltStore(t, path)
+
+	for _, want := range []GameRecord{first, latest, middle} {
+		got, found, err := store.GetGame(want.GameID)
+		if err != nil || !found || !sameRecord(t, got, want) {
+			t.Fatalf("GetGame(%s) = %+v, %v, %v; want %+v", want.GameID, got, found, err, want)
+		}
+	}
+	if _, found, err := store.GetGame("nope"); found || err != nil {
+		t.Fatalf("GetGame of an unknown game: found %v, %v", found, err)
+	}
+
+	// Each player's latest game is the one that ended last, whatever order
+	// they were saved in
+	tests := []struct {
+		username string
+		want     GameRecord
+	}{
+		{"alice", latest},
+		{"bob", middle},
+		{"carol", latest},
+	}
+	for _, tt := range tests {
+		got, found, err := store.LatestGame(tt.username)
+		if err != nil || !found || got.GameID != tt.want.GameID {
+			t.Fatalf("LatestGame(%s) = %s, %v, %v; want %s", tt.username, got.GameID, found, err, tt.want.GameID)
+		}
+	}
+	if _, found, err := store.LatestGame("dave"); found || err != nil {
+		t.Fatalf("LatestGame of a player without games: found %v, %v", found, err)
+	}
+}
+
+func TestBoltStoreRatedGames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.db")
+	store := openTestBoltStore(t, path)
+
+	record := finishedRecord("alice", "bob", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	record.RatingsRecorded = true
+	ratings := map[string]PlayerRating{
+		"alice": {Rating: 1662.3, Deviation: 290.3, Volatility: 0.06, Wins: 1},
+		"bob":   {Rating: 1337.7, Deviation: 290.3, Volatility: 0.06, Losses: 1},
+	}
+	if err := store.SaveRatedGame(record, ratings); err != nil {
+		t.Fatal(err)
+	}
+	// A later game replaces the ratings of the players in it only
+	later := finishedRecord("alice", "carol", time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC))
+	later.RatingsRecorded = true
+	laterRatings := map[string]PlayerRating{
+		"alice": {Rating: 1700, Deviation: 250, Volatility: 0.06, Wins: 2},
+		"carol": {Rating: 1450, Deviation: 300, Volatility: 0.06, Losses: 1},
+	}
+	if err := store.SaveRatedGame(later, laterRatings); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+	store = openTestBoltStore(t, path)
+
+	want := map[string]PlayerRating{"alice": laterRatings["alice"], "bob": ratings["bob"], "carol": laterRatings["carol"]}
+	players, err := store.Players()
+	if err != nil || len(players) != len(want) {
+		t.Fatalf("Players() = %v, %v; want %v", players, err, want)
+	}
+	for username, rating := range want {
+		if players[username] != rating {
+			t.Fatalf("Players()[%s] = %+v, want %+v", username, players[username], rating)
+		}
+		if got, found, err := store.GetPlayer(username); err != nil || !found || got != rating {
+			t.Fatalf("GetPlayer(%s) = %+v, %v, %v; want %+v", username, got, found, err, rating)
+		}
+	}
+
+	// The games were saved with the ratings and indexed under their players
+	for _, want := range []GameRecord{record, later} {
+		got, found, err := store.GetGame(want.GameID)
+		if err != nil || !found || !got.RatingsRecorded || !sameRecord(t, got, want) {
+			t.Fatalf("GetGame(%s) = %+v, %v, %v; want %+v", want.GameID, got, found, err, want)
+		}
+	}
+	if got, _, _ := store.LatestGame("bob"); got.GameID != record.GameID {
+		t.Fatalf("bob's latest game is %q, want %s", got.GameID, record.GameID)
+	}
+}
+
+func TestBoltStoreAccounts(t *testing.T) {
+	store := openTestBoltStore(t, filepath.Join(t.TempDir(), "games.db"))
+	account := Account{Username: "Alice", PasswordHash: []byte("hash"), CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateAccount(Account{Username: "ALICE"}); !errors.Is(err, errAccountExists) {
+		t.Fatalf("creating ALICE after Alice: %v, want %v", err, errAccountExists)
+	}
+	got, found, err := store.GetAccount("aLiCe")
+	if err != nil || !found || got.Username != "Alice" || string(got.PasswordHash) != "hash" || !got.CreatedAt.Equal(account.CreatedAt) {
+		t.Fatalf("GetAccount(aLiCe) = %+v, %v, %v; want %+v", got, found, err, account)
+	}
+}
+
+func TestBoltStoreLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.db")
+	store := openTestBoltStore(t, path)
+
+	game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	game.StartGame("bob")
+	active := gameRecord(game)
+	for i := 0; i < 3; i++ {
+		if err := store.AppendLog(LogEntry{GameID: active.GameID, Kind: LogMove, Ply: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seq, err := store.LastLogSeq(); seq != 3 || err != nil {
+		t.Fatalf("LastLogSeq() = %d, %v; want 3", seq, err)
+	}
+	if err := store.Checkpoint([]GameRecord{active}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+	store = openTestBoltStore(t, path)
+
+	snapshot, entries, err := store.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 1 || !sameRecord(t, snapshot[0], active) {
+		t.Fatalf("snapshot %+v, want %+v", snapshot, active)
+	}
+	if len(entries) != 1 || entries[0].Seq != 3 || entries[0].Ply != 3 {
+		t.Fatalf("log after the checkpoint %+v, want only entry 3", entries)
+	}
+
+	// Sequence numbers carry on after a checkpoint and a restart
+	if err := store.AppendLog(LogEntry{GameID: active.GameID, Kind: LogMove, Ply: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := store.LastLogSeq(); seq != 4 || err != nil {
+		t.Fatalf("LastLogSeq() = %d, %v; want 4", seq, err)
+	}
+}
+
+func TestBoltStoreLogsConcurrently(t *testing.T) {
+	store := openTestBoltStore(t, filepath.Join(t.TempDir(), "games.db"))
+
+	// Games logging at once each get their entries in order under their own
+	// sequence numbers
+	const games, moves = 20, 10
+	var wg sync.WaitGroup
+	for g := 0; g < games; g++ {
+		wg.Add(1)
+		go func(gameID string) {
+			defer wg.Done()
+			for ply := 1; ply <= moves; ply++ {
+				if err := store.AppendLog(LogEntry{GameID: gameID, Kind: LogMove, Ply: ply}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(string(rune('a' + g)))
+	}
+	wg.Wait()
+
+	_, entries, err := store.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != games*moves {
+		t.Fatalf("%d entries logged, want %d", len(entries), games*moves)
+	}
+	plies := make(map[string]int)
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) {
+			t.Fatalf("entry %d has sequence number %d", i+1, entry.Seq)
+		}
+		if entry.Ply != plies[entry.GameID]+1 {
+			t.Fatalf("game %s logged ply %d after %d", entry.GameID, entry.Ply, plies[entry.GameID])
+		}
+		plies[entry.GameID] = entry.Ply
+	}
+
+	// Once the store is closed nothing more is logged
+	store.Close()
+	if err := store.AppendLog(LogEntry{GameID: "a", Kind: LogMove, Ply: moves + 1}); err == nil {
+		t.Fatal("logged to a closed store")
+	}
+}
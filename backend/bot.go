@@ -1,84 +1,320 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
+// Difficulty is a named bot strength level
+type Difficulty string
+
+const (
+	DifficultyEasy    Difficulty = "easy"
+	DifficultyMedium  Difficulty = "medium"
+	DifficultyHard    Difficulty = "hard"
+	// DifficultyPerfect searches towards the end of the game, but is still
+	// stopped by its time budget. It only plays perfectly once the board is
+	// small or full enough for the whole search to finish in time; until then,
+	// which on the default board is most of the game, it plays the deepest
+	// result it reached.
+	DifficultyPerfect Difficulty = "perfect"
+)
+
+// DefaultDifficulty is used when a player does not pick a level
+const DefaultDifficulty = DifficultyMedium
+
+// searchLimits bounds the bot's search at a difficulty level. A maxDepth of
+// zero searches to the end of the game if the time budget allows, and to the
+// deepest depth finished within it otherwise.
+type searchLimits struct {
+	maxDepth   int
+	timeBudget time.Duration
+}
+
+var difficultyLimits = map[Difficulty]searchLimits{
+	DifficultyEasy:    {maxDepth: 2, timeBudget: 50 * time.Millisecond},
+	DifficultyMedium:  {maxDepth: 5, timeBudget: 250 * time.Millisecond},
+	DifficultyHard:    {maxDepth: 10, timeBudget: time.Second},
+	DifficultyPerfect: {maxDepth: 0, timeBudget: 3 * time.Second},
+}
+
+// ParseDifficulty validates a difficulty name, returning the default for an empty name
+func ParseDifficulty(name string) (Difficulty, error) {
+	if name == "" {
+		return DefaultDifficulty, nil
+	}
+	difficulty := Difficulty(name)
+	if _, ok := difficultyLimits[difficulty]; !ok {
+		return "", fmt.Errorf("unknown difficulty %q", name)
+	}
+	return difficulty, nil
+}
+
+// Search scores. A win is worth winScore minus the ply it happens at, so
+// faster wins and slower losses are preferred. threeScore and twoScore are
+// for windows one and two discs short of a win, whatever the win length.
+const (
+	winScore    = 1000000
+	threeScore  = 50
+	twoScore    = 5
+	centerScore = 3
+	infinity    = winScore + 1
+)
+
+// botClockShare limits the bot to this fraction of its remaining clock per move in timed games
+const botClockShare = 20
+
 // BotPlayer represents a bot player
 type BotPlayer struct {
-	name string
+	name       string
+	difficulty Difficulty
+	limits     searchLimits
 }
 
-// NewBotPlayer creates a new bot player
+// NewBotPlayer creates a new bot player at the default difficulty
 func NewBotPlayer() *BotPlayer {
+	return NewBotPlayerWithDifficulty(DefaultDifficulty)
+}
+
+// NewBotPlayerWithDifficulty creates a new bot player at the given difficulty
+func NewBotPlayerWithDifficulty(difficulty Difficulty) *BotPlayer {
+	limits, ok := difficultyLimits[difficulty]
+	if !ok {
+		difficulty = DefaultDifficulty
+		limits = difficultyLimits[difficulty]
+	}
 	return &BotPlayer{
-		name: "Bot",
+		name:       "Bot",
+		difficulty: difficulty,
+		limits:     limits,
 	}
 }
 
-// GetMove returns the bot's move based on deterministic logic
-func (b *BotPlayer) GetMove(game *Game) int {
-	// Priority 1: Play winning move if available
-	if move := b.findWinningMove(game, Player2); move != -1 {
-		return move
+// GetMove returns the bot's move for the player whose turn it is, or -1 if
+// there is none. It runs an iterative-deepening alpha-beta search and keeps
+// the result of the deepest search that finished inside the time budget.
+func (b *BotPlayer) GetMove(game *Game) (int, MoveKind) {
+	// Copy what the search needs, so the game is not locked while the bot thinks
+	game.mu.Lock()
+	budget := b.limits.timeBudget
+	if game.TimeControl.IsTimed() {
+		if share := game.RemainingTime(game.CurrentTurn) / botClockShare; share < budget {
+			budget = share
+		}
+	}
+
+	s := &search{
+		board:    game.board,
+		popOut:   game.Variant == VariantPopOut,
+		order:    centerFirstOrder(game.Width),
+		deadline: time.Now().Add(budget),
 	}
+	turn := game.CurrentTurn
+	cells := game.Width * game.Height
+	game.mu.Unlock()
 
-	// Priority 2: Block opponent's immediate winning move
-	if move := b.findWinningMove(game, Player1); move != -1 {
-		return move
+	var buf [2 * MaxBoardWidth]searchMove
+	moves := s.moves(turn, buf[:0])
+	if len(moves) == 0 {
+		return -1, MoveDrop
 	}
 
-	// Priority 3: Choose the first valid column
-	validMoves := game.GetValidMoves()
-	if len(validMoves) > 0 {
-		return validMoves[0]
+	maxDepth := b.limits.maxDepth
+	if maxDepth == 0 || maxDepth > cells {
+		maxDepth = cells
 	}
 
-	return -1
+	best := moves[0]
+	for depth := 1; depth <= maxDepth; depth++ {
+		move, score := s.root(turn, depth)
+		if s.aborted {
+			break
+		}
+		best = move
+		// A forced result has been found; searching deeper cannot change it
+		if score > winScore-cells || score < -winScore+cells {
+			break
+		}
+	}
+
+	return best.col, best.kind
 }
 
-// findWinningMove checks if there's a winning move for the given player
-func (b *BotPlayer) findWinningMove(game *Game, player Player) int {
-	validMoves := game.GetValidMoves()
+// searchMove is a move considered by the search
+type searchMove struct {
+	col  int
+	kind MoveKind
+}
 
-	for _, col := range validMoves {
-		// Create a temporary game state to test the move
-		testGame := game.clone()
-		row := -1
-		for r := BoardHeight - 1; r >= 0; r-- {
-			if testGame.Board[r][col] == Empty {
-				row = r
-				break
-			}
+// search holds the state of a single bot move search
+type search struct {
+	board    Bitboard
+	popOut   bool
+	order    []int
+	deadline time.Time
+	nodes    int
+	aborted  bool
+}
+
+// centerFirstOrder returns the columns ordered from the center outwards,
+// which makes alpha-beta cut-offs happen much earlier
+func centerFirstOrder(width int) []int {
+	order := make([]int, 0, width)
+	center := width / 2
+	order = append(order, center)
+	for offset := 1; offset <= center; offset++ {
+		if center-offset >= 0 {
+			order = append(order, center-offset)
 		}
+		if center+offset < width {
+			order = append(order, center+offset)
+		}
+	}
+	return order
+}
 
-		if row == -1 {
-			continue
+// moves appends player's legal moves to buf in search order: drops first, then pops
+func (s *search) moves(player Player, buf []searchMove) []searchMove {
+	for _, col := range s.order {
+		if s.board.CanPlay(col) {
+			buf = append(buf, searchMove{col: col, kind: MoveDrop})
+		}
+	}
+	if s.popOut {
+		for _, col := range s.order {
+			if s.board.CanPop(col, player) {
+				buf = append(buf, searchMove{col: col, kind: MovePop})
+			}
 		}
+	}
+	return buf
+}
+
+// play makes a move for player on the search board
+func (s *search) play(m searchMove, player Player) {
+	if m.kind == MovePop {
+		s.board.Pop(m.col)
+	} else {
+		s.board.Play(m.col, player)
+	}
+}
+
+// undo takes back a move made by play
+func (s *search) undo(m searchMove, player Player) {
+	if m.kind == MovePop {
+		s.board.Unpop(m.col, player)
+	} else {
+		s.board.Undo(m.col)
+	}
+}
+
+// score plays m for player and returns its score from player's point of view
+func (s *search) score(m searchMove, player Player, depth, alpha, beta, ply int) int {
+	s.play(m, player)
+	defer s.undo(m, player)
 
-		// Test the move
-		testGame.Board[row][col] = player
-		if testGame.checkWin(row, col, player) {
-			return col
+	if s.board.IsWin(player) {
+		return winScore - ply
+	}
+	// A pop can complete a line for the opponent alone
+	if m.kind == MovePop && s.board.IsWin(opponent(player)) {
+		return -(winScore - ply)
+	}
+	return -s.negamax(opponent(player), depth-1, -beta, -alpha, ply+1)
+}
+
+// root searches every move for player to the given depth and returns the best one
+func (s *search) root(player Player, depth int) (searchMove, int) {
+	var buf [2 * MaxBoardWidth]searchMove
+	var bestMove searchMove
+	bestScore := -infinity
+	alpha, beta := -infinity, infinity
+
+	for _, m := range s.moves(player, buf[:0]) {
+		score := s.score(m, player, depth, alpha, beta, 1)
+		if s.aborted {
+			return bestMove, bestScore
+		}
+		if score > bestScore {
+			bestScore = score
+			bestMove = m
+		}
+		if score > alpha {
+			alpha = score
 		}
 	}
 
-	return -1
+	return bestMove, bestScore
 }
 
-// clone creates a deep copy of the game for testing moves
-func (g *Game) clone() *Game {
-	clone := &Game{
-		ID:          g.ID,
-		Player1:     g.Player1,
-		Player2:     g.Player2,
-		CurrentTurn: g.CurrentTurn,
-		State:       g.State,
-		Winner:      g.Winner,
-		IsDraw:      g.IsDraw,
-		IsBotGame:   g.IsBotGame,
+// negamax returns the score of the position for player, who is to move
+func (s *search) negamax(player Player, depth, alpha, beta, ply int) int {
+	s.nodes++
+	if s.nodes&1023 == 0 && time.Now().After(s.deadline) {
+		s.aborted = true
+	}
+	if s.aborted {
+		return 0
+	}
+
+	var buf [2 * MaxBoardWidth]searchMove
+	moves := s.moves(player, buf[:0])
+	// No legal move means the game is drawn
+	if len(moves) == 0 {
+		return 0
 	}
-	// Deep copy the board
-	for r := 0; r < BoardHeight; r++ {
-		for c := 0; c < BoardWidth; c++ {
-			clone.Board[r][c] = g.Board[r][c]
+
+	if depth == 0 {
+		return s.evaluate(player)
+	}
+
+	best := -infinity
+	for _, m := range moves {
+		score := s.score(m, player, depth, alpha, beta, ply)
+		if score > best {
+			best = score
 		}
+		if best > alpha {
+			alpha = best
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+
+	return best
+}
+
+// evaluate scores a non-terminal position heuristically from player's point of view.
+// Every winning window that only one side occupies counts towards that side,
+// open threes far more than twos, and discs in the center column add a small bonus.
+func (s *search) evaluate(player Player) int {
+	geo := s.board.geo
+	mine := s.board.pieces[player-1]
+	theirs := s.board.pieces[opponent(player)-1]
+
+	score := centerScore * (mine.and(geo.center).count() - theirs.and(geo.center).count())
+	for _, window := range geo.windows {
+		score += windowScore(mine.and(window).count(), theirs.and(window).count(), geo.winLength)
+	}
+
+	return score
+}
+
+// windowScore scores a single window of winLength cells
+func windowScore(mine, theirs, winLength int) int {
+	if mine > 0 && theirs > 0 {
+		return 0
+	}
+	switch {
+	case mine == winLength-1:
+		return threeScore
+	case mine == winLength-2:
+		return twoScore
+	case theirs == winLength-1:
+		return -threeScore
+	case theirs == winLength-2:
+		return -twoScore
 	}
-	return clone
+	return 0
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// gameAt returns a game in progress from a position in either notation
+func gameAt(t *testing.T, position string, opts GameOptions) *Game {
+	t.Helper()
+	opts.Position = position
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("position %q: %v", position, err)
+	}
+	game := NewGame("bot", "alice", opts)
+	game.StartGame("Bot")
+	return game
+}
+
+func TestBotTakesImmediateWin(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     GameOptions
+		position string
+		want     int
+	}{
+		{"vertical", DefaultGameOptions(), "121212", 0},
+		{"horizontal", DefaultGameOptions(), "112233", 3},
+		{"diagonal", DefaultGameOptions(), "1223433454", 3},
+		{"second player", DefaultGameOptions(), "7121212", 0},
+		{"board string", DefaultGameOptions(), "7/7/7/7/7/oxx1xoo x", 3},
+		{"wide board", boardOptions(12, 9, 4), "77787878", 6},
+		{"tall board", boardOptions(4, 20, 4), "434343", 3},
+	}
+
+	for _, tt := range tests {
+		for _, difficulty := range []Difficulty{DifficultyEasy, DifficultyMedium, DifficultyHard} {
+			t.Run(tt.name+" "+string(difficulty), func(t *testing.T) {
+				game := gameAt(t, tt.position, tt.opts)
+				col, kind := NewBotPlayerWithDifficulty(difficulty).GetMove(game)
+				if col != tt.want || kind != MoveDrop {
+					t.Fatalf("bot played %s in column %d, want the win in column %d", kind, col, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestBotBlocksImmediateLoss(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     GameOptions
+		position string
+		want     int
+	}{
+		{"vertical", DefaultGameOptions(), "12121", 0},
+		{"horizontal", DefaultGameOptions(), "7/7/7/7/7/xxx1oo1 o", 3},
+		{"blocked end", DefaultGameOptions(), "7/7/7/7/7/oxxx2o o", 4},
+		{"wide board", boardOptions(12, 9, 4), "a1b1c", 8},
+		{"popout drop", popOutOptions(), "12121", 0},
+	}
+
+	for _, tt := range tests {
+		for _, difficulty := range []Difficulty{DifficultyEasy, DifficultyMedium, DifficultyHard} {
+			t.Run(tt.name+" "+string(difficulty), func(t *testing.T) {
+				game := gameAt(t, tt.position, tt.opts)
+				col, kind := NewBotPlayerWithDifficulty(difficulty).GetMove(game)
+				if col != tt.want || kind != MoveDrop {
+					t.Fatalf("bot played %s in column %d, want the block in column %d", kind, col, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestBotRespectsTimeBudget(t *testing.T) {
+	// Neither search can reach the end of the game on these boards in time,
+	// so each runs until its budget is spent
+	tests := []struct {
+		name   string
+		opts   GameOptions
+		clock  time.Duration
+		budget time.Duration
+	}{
+		{"difficulty budget", boardOptions(12, 9, 4), 0, difficultyLimits[DifficultyPerfect].timeBudget},
+		{"share of the clock", boardOptions(12, 9, 4), 2 * time.Second, 2 * time.Second / botClockShare},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if testing.Short() && tt.budget > time.Second {
+				t.Skip("skipping a long search in short mode")
+			}
+			if tt.clock > 0 {
+				tt.opts.TimeControl = TimeControl{Base: time.Minute}
+			}
+			game := gameAt(t, "", tt.opts)
+			if tt.clock > 0 {
+				game.Clocks = [2]time.Duration{tt.clock, tt.clock}
+			}
+
+			start := time.Now()
+			col, _ := NewBotPlayerWithDifficulty(DifficultyPerfect).GetMove(game)
+			elapsed := time.Since(start)
+			if !game.board.CanPlay(col) {
+				t.Fatalf("bot played column %d, which is not a legal move", col)
+			}
+			// The search checks the clock every thousand positions or so, so
+			// it may run a little over
+			if elapsed > tt.budget+tt.budget/2+50*time.Millisecond {
+				t.Fatalf("bot took %v, want at most about %v", elapsed, tt.budget)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Chat limits. Each connection may send ChatBurst lines at once and then one
+// more every ChatRefillInterval.
+const (
+	MaxChatLength      = 200
+	ChatBurst          = 5
+	ChatRefillInterval = 2 * time.Second
+)
+
+// ChatMessage is one line of a game's chat
+type ChatMessage struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+	// Spectator is set for lines sent by someone watching the game
+	Spectator bool      `json:"spectator,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ChatFilter checks a chat line before it is delivered. It returns the text
+// to deliver, which may be altered, or an error to reject the line.
+type ChatFilter interface {
+	Filter(text string) (string, error)
+}
+
+// WordListFilter masks every word found in its list with asterisks. Words
+// are matched whole and without regard to case.
+type WordListFilter struct {
+	words map[string]bool
+}
+
+// NewWordListFilter creates a filter for the given words
+func NewWordListFilter(words []string) *WordListFilter {
+	f := &WordListFilter{words: make(map[string]bool)}
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			f.words[word] = true
+		}
+	}
+	return f
+}
+
+// LoadWordListFilter reads a word list file with one word per line. Blank
+// lines and lines starting with # are ignored.
+func LoadWordListFilter(path string) (*WordListFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewWordListFilter(words), nil
+}
+
+// Filter masks the listed words in text
+func (f *WordListFilter) Filter(text string) (string, error) {
+	if len(f.words) == 0 {
+		return text, nil
+	}
+
+	runes := []rune(text)
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		if f.words[strings.ToLower(string(runes[start:end]))] {
+			for i := start; i < end; i++ {
+				runes[i] = '*'
+			}
+		}
+		start = end
+	}
+	return string(runes), nil
+}
+
+// chatFilter checks every chat line; main replaces it with the configured word list
+var chatFilter ChatFilter = NewWordListFilter(nil)
+
+// allowChat takes one chat token from the connection, reporting false if it
+// has sent too many lines too quickly
+func (c *Connection) allowChat(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.chatRefilledAt.IsZero() {
+		c.chatTokens = ChatBurst
+	} else {
+		c.chatTokens += float64(now.Sub(c.chatRefilledAt)) / float64(ChatRefillInterval)
+		if c.chatTokens > ChatBurst {
+			c.chatTokens = ChatBurst
+		}
+	}
+	c.chatRefilledAt = now
+
+	if c.chatTokens < 1 {
+		return false
+	}
+	c.chatTokens--
+	return true
+}
+
+// SetMuted mutes or unmutes player's opponent in the chat, for player only
+func (g *Game) SetMuted(player Player, muted bool) {
+	g.mutedOpponent[player-1] = muted
+}
+
+// hasMuted reports whether player has muted the sender of a chat line
+func (g *Game) hasMuted(player Player, from string) bool {
+	return g.mutedOpponent[player-1] && from == g.playerName(opponent(player))
+}
+
+// handleChat handles a chat line from a player or spectator, delivering it to
+// everyone attached to the game except players who have muted the sender
+func handleChat(conn *Connection, p *ChatPayload) {
+	gameID := p.GameID
+	if gameID == "" {
+		gameID = conn.GameID()
+		if spectating := conn.Spectating(); spectating != "" {
+			gameID = spectating
+		}
+	}
+
+	game, exists := gameManager.GetGame(gameID)
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return
+	}
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	spectator := game.IsSpectator(conn)
+	isPlayer := game.seatOf(conn) != Empty
+	if !isPlayer && !spectator {
+		sendError(conn, ErrNotAPlayer, "you are not in this game")
+		return
+	}
+
+	text, err := cleanChatText(p.Text)
+	if err != nil {
+		sendError(conn, ErrInvalidChat, err.Error())
+		return
+	}
+
+	now := time.Now()
+	if !conn.allowChat(now) {
+		sendError(conn, ErrRateLimited, "you are sending messages too quickly")
+		return
+	}
+
+	from := conn.username
+	if from == "" {
+		from = "Spectator"
+	}
+
+	line := ChatMessage{From: from, Text: text, Spectator: spectator && !isPlayer, Timestamp: now}
+	game.Chat = append(game.Chat, line)
+	appendLog(game, LogChat)
+
+	eventProducer.PublishEvent(Event{
+		Type:         "CHAT",
+		GameID:       game.ID,
+		Player:       from,
+		ChatLength:   len([]rune(text)),
+		ChatFiltered: text != strings.TrimSpace(p.Text),
+		Timestamp:    now,
+	})
+
+	audience := ToSpectators
+	for _, player := range []Player{Player1, Player2} {
+		if !game.hasMuted(player, from) {
+			audience |= toPlayer(player)
+		}
+	}
+	publishGameEvent(game, audience, "CHAT", ChatLinePayload{GameID: game.ID, ChatMessage: line})
+}
+
+// cleanChatText trims a chat line, checks its length and runs the chat filter
+func cleanChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("message is empty")
+	}
+	if len([]rune(text)) > MaxChatLength {
+		return "", errors.New("message is too long")
+	}
+	return chatFilter.Filter(text)
+}
+
+// handleMute handles a player muting or unmuting their opponent's chat
+func handleMute(conn *Connection, gameID string, muted bool) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	game.SetMuted(player, muted)
+	appendLog(game, LogMute)
+
+	notice := PlayerNotice{GameID: game.ID, Username: game.playerName(opponent(player))}
+	if muted {
+		sendMessage(conn, "MUTED", MutedPayload{notice})
+	} else {
+		sendMessage(conn, "UNMUTED", UnmutedPayload{notice})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChatEventCarriesNoText(t *testing.T) {
+	useTestGlobals(t)
+	eventProducer = NewEventProducer(10)
+	chatFilter = NewWordListFilter([]string{"darn"})
+
+	alice := newTestConnection("alice")
+	game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	game.Player1Conn = alice
+	game.Player2Conn = newTestConnection("bob")
+	game.StartGame("bob")
+	gameManager.AddGame(game)
+
+	tests := []struct {
+		text     string
+		length   int
+		filtered bool
+	}{
+		{"  good luck  ", 9, false},
+		{"darn it", 7, true},
+		{"ça va", 5, false},
+	}
+
+	for _, tt := range tests {
+		handleChat(alice, &ChatPayload{GameRef: GameRef{GameID: game.ID}, Text: tt.text})
+		event := <-eventProducer.GetEventChannel()
+		if event.Type != "CHAT" || event.Player != "alice" || event.ChatLength != tt.length || event.ChatFiltered != tt.filtered {
+			t.Fatalf("chat %q published %+v, want %d characters, filtered %v", tt.text, event, tt.length, tt.filtered)
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, word := range strings.Fields(tt.text) {
+			if strings.Contains(string(data), word) {
+				t.Fatalf("chat event %s carries the text %q", data, word)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Allowed time control ranges
+const (
+	MaxBaseMinutes      = 180
+	MaxIncrementSeconds = 60
+)
+
+// TimeControl is a base time per player plus an increment added after each
+// of their moves. The zero value means the game is untimed.
+type TimeControl struct {
+	Base      time.Duration
+	Increment time.Duration
+}
+
+// ParseTimeControl reads a time control written as "minutes+seconds", such
+// as "3+2" or "1+0". An empty string means untimed.
+func ParseTimeControl(s string) (TimeControl, error) {
+	if s == "" {
+		return TimeControl{}, nil
+	}
+
+	parts := strings.Split(s, "+")
+	if len(parts) != 2 {
+		return TimeControl{}, fmt.Errorf("time control %q must look like 3+2", s)
+	}
+
+	minutes, err := strconv.Atoi(parts[0])
+	if err != nil || minutes < 1 || minutes > MaxBaseMinutes {
+		return TimeControl{}, fmt.Errorf("base time must be between 1 and %d minutes", MaxBaseMinutes)
+	}
+
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds < 0 || seconds > MaxIncrementSeconds {
+		return TimeControl{}, fmt.Errorf("increment must be between 0 and %d seconds", MaxIncrementSeconds)
+	}
+
+	return TimeControl{
+		Base:      time.Duration(minutes) * time.Minute,
+		Increment: time.Duration(seconds) * time.Second,
+	}, nil
+}
+
+// IsTimed reports whether the time control limits the game
+func (tc TimeControl) IsTimed() bool {
+	return tc.Base > 0
+}
+
+// String writes the time control as "minutes+seconds", or "" if untimed
+func (tc TimeControl) String() string {
+	if !tc.IsTimed() {
+		return ""
+	}
+	return fmt.Sprintf("%d+%d", int(tc.Base/time.Minute), int(tc.Increment/time.Second))
+}
+
+// startClock gives both players the base time and starts Player1's clock
+func (g *Game) startClock(now time.Time) {
+	if !g.TimeControl.IsTimed() {
+		return
+	}
+	g.Clocks = [2]time.Duration{g.TimeControl.Base, g.TimeControl.Base}
+	g.turnStartedAt = now
+}
+
+// chargeClock deducts the time used since the turn started from the player to
+// move and restarts the turn at now
+func (g *Game) chargeClock(now time.Time) {
+	if !g.TimeControl.IsTimed() || g.Paused {
+		return
+	}
+	g.Clocks[g.CurrentTurn-1] -= now.Sub(g.turnStartedAt)
+	g.turnStartedAt = now
+}
+
+// pressClock ends the mover's turn at now, charging the time used and adding the increment
+func (g *Game) pressClock(now time.Time) {
+	if !g.TimeControl.IsTimed() {
+		return
+	}
+	g.chargeClock(now)
+	g.Clocks[g.CurrentTurn-1] += g.TimeControl.Increment
+}
+
+// restoreClocks sets each player's clock back to what it was after their last
+// move still in the history, or to the base time if they have none, and
+// starts the turn of the player to move at now
+func (g *Game) restoreClocks(now time.Time) {
+	if !g.TimeControl.IsTimed() {
+		return
+	}
+	g.Clocks = [2]time.Duration{g.TimeControl.Base, g.TimeControl.Base}
+	for _, move := range g.Moves {
+		g.Clocks[move.Player-1] = time.Duration(move.ClockMs) * time.Millisecond
+	}
+	g.turnStartedAt = now
+}
+
+// RemainingTime returns how much time player has left, counting the running turn
+func (g *Game) RemainingTime(player Player) time.Duration {
+	remaining := g.Clocks[player-1]
+	if g.State == InProgress && !g.Paused && player == g.CurrentTurn {
+		remaining -= time.Since(g.turnStartedAt)
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// errTimeUp is returned for a move made after the mover's clock ran out
+var errTimeUp = errors.New("your time is up")
+
+// CheckFlag ends the game as a loss on time if the player to move has run out
+// of time, and reports whether it did
+func (g *Game) CheckFlag() bool {
+	if !g.TimeControl.IsTimed() || g.State != InProgress {
+		return false
+	}
+	if g.RemainingTime(g.CurrentTurn) > 0 {
+		return false
+	}
+	loser := g.CurrentTurn
+	g.finish(opponent(loser), EndReasonTime)
+	g.Clocks[loser-1] = 0
+	return true
+}
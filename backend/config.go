@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the server settings. Each one can be set with a command-line
+// flag or, failing that, an environment variable.
+type Config struct {
+	// RoomIdleTimeout is how long a private room waits for a guest before it expires
+	RoomIdleTimeout time.Duration
+	// ChatWordList is a file of words to mask in chat, one per line, or empty for no filtering
+	ChatWordList string
+	// StorePath is the database file finished games and ratings are kept in, or
+	// empty to keep them in memory only
+	StorePath string
+	// SnapshotInterval is how often the games in progress are checkpointed to the store
+	SnapshotInterval time.Duration
+	// CompletedGameLimit is how many completed games are kept in memory, or 0 for no limit
+	CompletedGameLimit int
+	// CompletedGameMaxAge is how long a completed game is kept in memory, or 0 for no limit
+	CompletedGameMaxAge time.Duration
+	// SessionTTL is how long a session token can be used to reconnect to a game
+	SessionTTL time.Duration
+	// ReconnectTimeout is how long a player can be away from a game in
+	// progress before they forfeit it, or a game recovered after a restart
+	// waits for its players before it is abandoned
+	ReconnectTimeout time.Duration
+	// AuthSecret signs the bearer tokens players log in with, or is empty to
+	// use a random secret that changes on every restart
+	AuthSecret string
+	// AuthTokenTTL is how long a bearer token stays valid
+	AuthTokenTTL time.Duration
+	// EventHistorySize is how many outgoing events each game keeps for
+	// clients resuming after missing some
+	EventHistorySize int
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		RoomIdleTimeout:     15 * time.Minute,
+		StorePath:           "connect-four.db",
+		SnapshotInterval:    30 * time.Second,
+		CompletedGameLimit:  1000,
+		CompletedGameMaxAge: time.Hour,
+		SessionTTL:          24 * time.Hour,
+		ReconnectTimeout:    30 * time.Second,
+		AuthTokenTTL:        7 * 24 * time.Hour,
+		EventHistorySize:    128,
+	}
+}
+
+// LoadConfig reads the settings from the command line and environment
+func LoadConfig() Config {
+	cfg := DefaultConfig()
+
+	flag.DurationVar(&cfg.RoomIdleTimeout, "room-idle-timeout",
+		envDuration("ROOM_IDLE_TIMEOUT", cfg.RoomIdleTimeout),
+		"how long a private room waits for a guest before it expires (env ROOM_IDLE_TIMEOUT)")
+	flag.StringVar(&cfg.ChatWordList, "chat-word-list", os.Getenv("CHAT_WORD_LIST"),
+		"file of words to mask in chat, one per line (env CHAT_WORD_LIST)")
+	flag.StringVar(&cfg.StorePath, "store-path", envString("STORE_PATH", cfg.StorePath),
+		"database file for finished games and ratings, or empty to keep them in memory (env STORE_PATH)")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval",
+		envDuration("SNAPSHOT_INTERVAL", cfg.SnapshotInterval),
+		"how often games in progress are checkpointed to the store (env SNAPSHOT_INTERVAL)")
+	flag.IntVar(&cfg.CompletedGameLimit, "completed-game-limit",
+		envInt("COMPLETED_GAME_LIMIT", cfg.CompletedGameLimit),
+		"how many completed games are kept in memory, or 0 for no limit (env COMPLETED_GAME_LIMIT)")
+	flag.DurationVar(&cfg.CompletedGameMaxAge, "completed-game-max-age",
+		envDuration("COMPLETED_GAME_MAX_AGE", cfg.CompletedGameMaxAge),
+		"how long a completed game is kept in memory (env COMPLETED_GAME_MAX_AGE)")
+	flag.DurationVar(&cfg.SessionTTL, "session-ttl", envDuration("SESSION_TTL", cfg.SessionTTL),
+		"how long a session token can be used to reconnect to a game (env SESSION_TTL)")
+	flag.DurationVar(&cfg.ReconnectTimeout, "reconnect-timeout",
+		envDuration("RECONNECT_TIMEOUT", cfg.ReconnectTimeout),
+		"how long a player can be away from a game before they forfeit it (env RECONNECT_TIMEOUT)")
+	flag.StringVar(&cfg.AuthSecret, "auth-secret", os.Getenv("AUTH_SECRET"),
+		"secret that signs bearer tokens, or empty for a random one per run (env AUTH_SECRET)")
+	flag.DurationVar(&cfg.AuthTokenTTL, "auth-token-ttl", envDuration("AUTH_TOKEN_TTL", cfg.AuthTokenTTL),
+		"how long a bearer token stays valid (env AUTH_TOKEN_TTL)")
+	flag.IntVar(&cfg.EventHistorySize, "event-history", envInt("EVENT_HISTORY", cfg.EventHistorySize),
+		"how many outgoing events each game keeps for clients resuming after missing some (env EVENT_HISTORY)")
+	flag.Parse()
+
+	return cfg
+}
+
+// envString reads a string from an environment variable, falling back to def
+// if it is unset. A variable set to the empty string is used as is.
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// envInt reads a non-negative integer from an environment variable, falling
+// back to def if it is unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("ignoring invalid %s %q", name, value)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration such as "10m" from an environment variable,
+// falling back to def if it is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("ignoring invalid %s %q", name, value)
+		return def
+	}
+	return d
+}
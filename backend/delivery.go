@@ -0,0 +1,147 @@
+package main
+
+// Audience is who a game event is delivered to
+type Audience uint8
+
+const (
+	ToPlayer1 Audience = 1 << iota
+	ToPlayer2
+	ToSpectators
+	// ToEveryone is both players and every spectator
+	ToEveryone = ToPlayer1 | ToPlayer2 | ToSpectators
+)
+
+// toPlayer returns the audience of one player
+func toPlayer(player Player) Audience {
+	if player == Player1 {
+		return ToPlayer1
+	}
+	return ToPlayer2
+}
+
+// GameEvent is an outgoing message about a game. Each game numbers its events
+// in the order they happen and keeps the latest of them, so a client that
+// missed some can have them sent again. The payload is kept as a value and
+// encoded for each connection in its own encoding.
+type GameEvent struct {
+	Seq      uint64
+	Type     string
+	Payload  interface{}
+	Audience Audience
+}
+
+// audienceOf returns which part of the game's audience a connection belongs
+// to, if any. The caller must hold the game's lock.
+func (g *Game) audienceOf(conn *Connection) (Audience, bool) {
+	if player := g.seatOf(conn); player != Empty {
+		return toPlayer(player), true
+	}
+	if g.IsSpectator(conn) {
+		return ToSpectators, true
+	}
+	return 0, false
+}
+
+// audienceConns returns the connections an audience reaches. The caller must
+// hold the game's lock.
+func (g *Game) audienceConns(audience Audience) []*Connection {
+	var conns []*Connection
+	if audience&ToPlayer1 != 0 && g.Player1Conn != nil {
+		conns = append(conns, g.Player1Conn)
+	}
+	if audience&ToPlayer2 != 0 && g.Player2Conn != nil {
+		conns = append(conns, g.Player2Conn)
+	}
+	if audience&ToSpectators != 0 {
+		conns = append(conns, g.spectatorConns()...)
+	}
+	return conns
+}
+
+// publishGameEvent gives a message about the game the next sequence number,
+// keeps it in the game's history and sends it to its audience. The history
+// holds the configured number of events, dropping the oldest first. The
+// payload is kept as it is, so it must not share memory the game changes
+// later. The caller must hold the game's lock.
+func publishGameEvent(game *Game, audience Audience, msgType string, payload interface{}) {
+	game.seq++
+	event := GameEvent{Seq: game.seq, Type: msgType, Payload: payload, Audience: audience}
+	game.history = append(game.history, event)
+	if excess := len(game.history) - config.EventHistorySize; excess > 0 {
+		n := copy(game.history, game.history[excess:])
+		game.history = game.history[:n]
+	}
+
+	for _, conn := range game.audienceConns(audience) {
+		sendEvent(conn, event)
+	}
+}
+
+// sendEvent sends a game event to a connection with its sequence number
+func sendEvent(conn *Connection, event GameEvent) {
+	sendEnvelope(conn, outgoingEnvelope{Seq: event.Seq, Type: event.Type, Payload: event.Payload})
+}
+
+// missedEvents returns the events after lastSeq meant for the audience, in
+// order. It reports false if some of them are no longer kept, or if lastSeq
+// is ahead of the game, as it is for a client that saw the game before a
+// server restart. The caller must hold the game's lock.
+func (g *Game) missedEvents(audience Audience, lastSeq uint64) ([]GameEvent, bool) {
+	if lastSeq > g.seq {
+		return nil, false
+	}
+	if lastSeq < g.seq && (len(g.history) == 0 || g.history[0].Seq > lastSeq+1) {
+		return nil, false
+	}
+
+	var missed []GameEvent
+	for _, event := range g.history {
+		if event.Seq > lastSeq && event.Audience&audience != 0 {
+			missed = append(missed, event)
+		}
+	}
+	return missed, true
+}
+
+// handleResume handles a client asking for the game events it missed after
+// the last sequence number it saw. They are sent again in order, followed by
+// RESUMED. If they cannot all be sent, a GAME_STATE snapshot is sent instead.
+func handleResume(conn *Connection, p *ResumePayload) {
+	gameID := p.GameID
+	if gameID == "" {
+		gameID = conn.GameID()
+		if spectating := conn.Spectating(); spectating != "" {
+			gameID = spectating
+		}
+	}
+
+	game, exists := gameManager.GetGame(gameID)
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return
+	}
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	audience, ok := game.audienceOf(conn)
+	if !ok {
+		sendError(conn, ErrNotAPlayer, "you are not in this game")
+		return
+	}
+
+	missed, complete := game.missedEvents(audience, p.LastSeq)
+	if !complete {
+		sendGameState(game, conn)
+	}
+	for _, event := range missed {
+		sendEvent(conn, event)
+	}
+
+	sendMessage(conn, "RESUMED", ResumedPayload{
+		GameID:   game.ID,
+		Seq:      game.seq,
+		Replayed: len(missed),
+		Snapshot: !complete,
+	})
+}
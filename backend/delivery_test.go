@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// newDeliveryGame starts a game between alice and bob watched by carol
+func newDeliveryGame(t *testing.T) (game *Game, alice, bob, carol *Connection) {
+	useTestGlobals(t)
+	game, alice, bob = startTestGame(t, DefaultGameOptions())
+	carol = newTestConnection("carol")
+	game.AddSpectator(carol)
+	carol.SetSpectating(game.ID)
+	return game, alice, bob, carol
+}
+
+// publish publishes one event for each audience in turn
+func publish(game *Game, audiences ...Audience) {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	for _, audience := range audiences {
+		publishGameEvent(game, audience, "GAME_UPDATED", GameUpdatedPayload{GameID: game.ID})
+	}
+}
+
+// resume has the connection resume from lastSeq and returns the sequence
+// numbers of the events sent again, whether a snapshot came first, and RESUMED
+func resume(t *testing.T, conn *Connection, game *Game, lastSeq uint64) ([]uint64, bool, ResumedPayload) {
+	t.Helper()
+	sent(t, conn)
+	handleResume(conn, &ResumePayload{GameRef: GameRef{GameID: game.ID}, LastSeq: lastSeq})
+
+	var replayed []uint64
+	var snapshot bool
+	var resumed ResumedPayload
+	for i, m := range sent(t, conn) {
+		switch m.Type {
+		case "GAME_STATE":
+			if i != 0 {
+				t.Fatalf("snapshot sent after %d events", i)
+			}
+			snapshot = true
+		case "GAME_UPDATED":
+			replayed = append(replayed, m.Seq)
+		case "RESUMED":
+			json.Unmarshal(m.Payload, &resumed)
+		default:
+			t.Fatalf("unexpected %s while resuming", m.Type)
+		}
+	}
+	if resumed.GameID != game.ID {
+		t.Fatal("no RESUMED after resuming")
+	}
+	if resumed.Replayed != len(replayed) || resumed.Snapshot != snapshot {
+		t.Fatalf("RESUMED %+v after %d events and snapshot %v", resumed, len(replayed), snapshot)
+	}
+	return replayed, snapshot, resumed
+}
+
+func TestResumeReplaysOwnEvents(t *testing.T) {
+	game, alice, bob, carol := newDeliveryGame(t)
+	publish(game, ToEveryone, ToPlayer2, ToEveryone, ToPlayer1, ToEveryone)
+
+	tests := []struct {
+		name    string
+		conn    *Connection
+		lastSeq uint64
+		want    []uint64
+	}{
+		{"first player", alice, 0, []uint64{1, 3, 4, 5}},
+		{"second player", bob, 0, []uint64{1, 2, 3, 5}},
+		{"spectator", carol, 0, []uint64{1, 3, 5}},
+		{"spectator partway", carol, 2, []uint64{3, 5}},
+		{"spectator after player-only events", carol, 4, []uint64{5}},
+		{"up to date", alice, 5, nil},
+	}
+	for _, tt := range tests {
+		replayed, snapshot, resumed := resume(t, tt.conn, game, tt.lastSeq)
+		if snapshot || !slices.Equal(replayed, tt.want) || resumed.Seq != 5 {
+			t.Fatalf("%s from %d: replayed %v, snapshot %v, seq %d; want %v", tt.name, tt.lastSeq, replayed, snapshot, resumed.Seq, tt.want)
+		}
+	}
+
+	// Someone neither playing nor watching gets nothing
+	stranger := newTestConnection("dave")
+	handleResume(stranger, &ResumePayload{GameRef: GameRef{GameID: game.ID}})
+	if code := lastError(t, stranger); code != ErrNotAPlayer {
+		t.Fatalf("stranger got %q, want %s", code, ErrNotAPlayer)
+	}
+}
+
+func TestResumeFallsBackToSnapshot(t *testing.T) {
+	game, alice, _, carol := newDeliveryGame(t)
+	config.EventHistorySize = 3
+	publish(game, ToEveryone, ToEveryone, ToEveryone, ToPlayer1, ToEveryone, ToEveryone)
+
+	tests := []struct {
+		name     string
+		conn     *Connection
+		lastSeq  uint64
+		snapshot bool
+		want     []uint64
+	}{
+		{"events trimmed", alice, 2, true, nil},
+		{"spectator with events trimmed", carol, 0, true, nil},
+		{"oldest kept event is next", alice, 3, false, []uint64{4, 5, 6}},
+		{"spectator from the oldest kept event", carol, 3, false, []uint64{5, 6}},
+		{"ahead of the game", alice, 7, true, nil},
+		{"far ahead of the game", carol, 1000, true, nil},
+	}
+	for _, tt := range tests {
+		replayed, snapshot, resumed := resume(t, tt.conn, game, tt.lastSeq)
+		if snapshot != tt.snapshot || !slices.Equal(replayed, tt.want) || resumed.Seq != 6 {
+			t.Fatalf("%s from %d: replayed %v, snapshot %v, seq %d; want %v, snapshot %v", tt.name, tt.lastSeq, replayed, snapshot, resumed.Seq, tt.want, tt.snapshot)
+		}
+	}
+
+	// The snapshot carries the game's latest sequence number
+	sent(t, alice)
+	handleResume(alice, &ResumePayload{GameRef: GameRef{GameID: game.ID}, LastSeq: 7})
+	if messages := sent(t, alice); messages[0].Type != "GAME_STATE" || messages[0].Seq != 6 {
+		t.Fatalf("snapshot %s with seq %d, want GAME_STATE with seq 6", messages[0].Type, messages[0].Seq)
+	}
+}
@@ -2,14 +2,100 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
+// Default and allowed board dimensions. A board must fit in the 128-bit
+// bitboard, which needs width*(height+1) bits.
 const (
-	BoardWidth  = 7
-	BoardHeight = 6
+	DefaultBoardWidth  = 7
+	DefaultBoardHeight = 6
+	DefaultWinLength   = 4
+
+	MinBoardSize  = 4
+	MaxBoardWidth = 12
+	MaxBoardBits  = 128
+	MinWinLength  = 3
+)
+
+// Variant selects the rule set a game is played with
+type Variant string
+
+const (
+	VariantStandard Variant = "standard"
+	// VariantPopOut lets a player pop one of their own discs out of the
+	// bottom row instead of dropping one
+	VariantPopOut Variant = "popout"
 )
 
+// RepetitionLimit is how many times a PopOut position may occur before the game is drawn
+const RepetitionLimit = 3
+
+// GameOptions are the rules a player chooses at JOIN. Players are only
+// matched with opponents who chose the same options.
+type GameOptions struct {
+	Width     int
+	Height    int
+	WinLength int
+	Variant   Variant
+	// Rated games count towards a player's record and do not allow takebacks
+	Rated bool
+	// Position is the starting position in board string notation, or empty
+	// for the empty board
+	Position string
+	// TimeControl is each player's clock, or the zero value for an untimed game
+	TimeControl TimeControl
+}
+
+// DefaultGameOptions returns standard 7x6 connect four
+func DefaultGameOptions() GameOptions {
+	return GameOptions{
+		Width:     DefaultBoardWidth,
+		Height:    DefaultBoardHeight,
+		WinLength: DefaultWinLength,
+		Variant:   VariantStandard,
+		Rated:     true,
+	}
+}
+
+// Validate checks that the options describe a playable board and starting position
+func (o GameOptions) Validate() error {
+	if err := o.validateRules(); err != nil {
+		return err
+	}
+	if o.Position == "" {
+		return nil
+	}
+
+	board, _, err := ParsePosition(o.Position, o)
+	if err != nil {
+		return err
+	}
+	if board.Width() != o.Width || board.Height() != o.Height {
+		return errors.New("starting position does not match the board size")
+	}
+	return nil
+}
+
+// validateRules checks the options other than the starting position
+func (o GameOptions) validateRules() error {
+	if o.Width < MinBoardSize || o.Width > MaxBoardWidth {
+		return fmt.Errorf("board width must be between %d and %d", MinBoardSize, MaxBoardWidth)
+	}
+	if o.Height < MinBoardSize || o.Width*(o.Height+1) > MaxBoardBits {
+		return fmt.Errorf("board height must be at least %d and fit a %d-column board", MinBoardSize, o.Width)
+	}
+	if o.WinLength < MinWinLength || o.WinLength > o.Width || o.WinLength > o.Height {
+		return fmt.Errorf("win length must be between %d and the smaller board dimension", MinWinLength)
+	}
+	if o.Variant != VariantStandard && o.Variant != VariantPopOut {
+		return fmt.Errorf("unknown variant %q", o.Variant)
+	}
+	return nil
+}
+
 type Player int
 
 const (
@@ -26,38 +112,220 @@ const (
 	Finished
 )
 
+// MoveKind distinguishes dropping a disc from popping one out
+type MoveKind string
+
+const (
+	MoveDrop MoveKind = "drop"
+	MovePop  MoveKind = "pop"
+)
+
+// Move is one entry in a game's move history
+type Move struct {
+	Player Player   `json:"player"`
+	Column int      `json:"column"`
+	Kind   MoveKind `json:"kind"`
+	// Row is where the dropped disc landed, counted from the top. For a pop
+	// it is the bottom row the disc was removed from.
+	Row       int       `json:"row"`
+	Timestamp time.Time `json:"timestamp"`
+	// ClockMs is the time the mover had left after the move, including the
+	// increment, in milliseconds. It is only set in timed games.
+	ClockMs int64 `json:"clockMs,omitempty"`
+}
+
+// EndReason records how a finished game ended
+type EndReason string
+
+const (
+	EndReasonConnect     EndReason = "connect"
+	EndReasonBoardFull   EndReason = "boardFull"
+	EndReasonRepetition  EndReason = "repetition"
+	EndReasonResignation EndReason = "resignation"
+	EndReasonAgreedDraw  EndReason = "agreedDraw"
+	EndReasonTimeout     EndReason = "timeout"
+	// EndReasonTime is a loss by running out of time on the clock
+	EndReasonTime EndReason = "time"
+	// EndReasonAbandoned ends a game with no result when neither player came
+	// back to it after a restart
+	EndReasonAbandoned EndReason = "abandoned"
+)
+
+// positionKey identifies a position for the PopOut repetition rule
+type positionKey struct {
+	pieces [2]bitset
+	turn   Player
+}
+
 type Game struct {
-	ID           string
-	Player1      string
-	Player2      string
-	Board        [BoardHeight][BoardWidth]Player
-	CurrentTurn  Player
-	State        GameState
-	Winner       Player
-	IsDraw       bool
-	CreatedAt    time.Time
-	StartedAt    *time.Time
-	EndedAt      *time.Time
-	LastMoveAt   time.Time
-	IsBotGame    bool
-	Player1Conn  *Connection
-	Player2Conn  *Connection
-}
-
-// NewGame creates a new game instance
-func NewGame(id, player1 string) *Game {
-	return &Game{
+	ID        string
+	Player1   string
+	Player2   string
+	Width     int
+	Height    int
+	WinLength int
+	Variant   Variant
+	Rated     bool
+	Moves     []Move
+	// StartPosition is the board string the game started from, or empty for the empty board
+	StartPosition string
+	// TakebackRequestedBy is the player waiting for their opponent to accept a takeback
+	TakebackRequestedBy Player
+	// DrawOfferedBy is the player waiting for their opponent to answer a draw offer
+	DrawOfferedBy Player
+	EndReason     EndReason
+	TimeControl   TimeControl
+	// Clocks is the time each player had left when their last turn ended
+	Clocks        [2]time.Duration
+	turnStartedAt time.Time
+	// flagTimer ends the game when the player to move runs out of time
+	flagTimer *time.Timer
+	// Paused is set on a game recovered after a restart until its players
+	// reconnect. No moves can be made and the clocks stand still.
+	Paused        bool
+	board         Bitboard
+	positions     map[positionKey]int
+	CurrentTurn   Player
+	State         GameState
+	Winner        Player
+	IsDraw        bool
+	CreatedAt     time.Time
+	StartedAt     *time.Time
+	EndedAt       *time.Time
+	LastMoveAt    time.Time
+	IsBotGame     bool
+	BotDifficulty Difficulty
+	// BotSeat is the side the bot plays in a bot game
+	BotSeat Player
+	// Private is set on a private room's game, and its rematches, which are
+	// left out of the live games list
+	Private bool
+	// RatingsRecorded is set once the players' ratings have been updated for
+	// the finished game, so it is never rated twice
+	RatingsRecorded bool
+	// PreviousGameID links a rematch to the game before it in the series
+	PreviousGameID string
+	// RematchGameID is the rematch started from this game, once accepted
+	RematchGameID string
+	// RematchRequestedBy is the player waiting for a rematch to be accepted
+	RematchRequestedBy Player
+	// seriesBefore is the head-to-head score from the earlier games of the series
+	seriesBefore SeriesScore
+	// mu serializes everything done to the game. Handlers, timers and the bot
+	// hold it while they read or change the game.
+	mu sync.Mutex
+	// spectators are the connections watching the game
+	spectators   map[*Connection]bool
+	spectatorsMu sync.Mutex
+	// Chat is every chat line sent during the game
+	Chat []ChatMessage
+	// mutedOpponent records which players have muted their opponent's chat
+	mutedOpponent [2]bool
+	// sessions let each seat's player reconnect to the game
+	sessions [2]Session
+	// seq is the sequence number of the game's latest event, and history
+	// the latest events, kept for clients resuming after missing some
+	seq         uint64
+	history     []GameEvent
+	Player1Conn *Connection
+	Player2Conn *Connection
+}
+
+// NewGame creates a new game instance. The options must already be validated.
+func NewGame(id, player1 string, opts GameOptions) *Game {
+	game := &Game{
 		ID:          id,
 		Player1:     player1,
-		Board:       [BoardHeight][BoardWidth]Player{},
+		Width:       opts.Width,
+		Height:      opts.Height,
+		WinLength:   opts.WinLength,
+		Variant:     opts.Variant,
+		Rated:       opts.Rated,
+		TimeControl: opts.TimeControl,
+		board:       NewBitboard(opts.Width, opts.Height, opts.WinLength),
 		CurrentTurn: Player1,
 		State:       Waiting,
 		CreatedAt:   time.Now(),
 	}
+
+	if opts.Position != "" {
+		game.board, game.CurrentTurn, _ = ParsePosition(opts.Position, opts)
+		game.StartPosition = opts.Position
+	}
+
+	return game
 }
 
-// MakeMove attempts to make a move in the specified column
+// MakeMove attempts to drop a disc in the specified column
 func (g *Game) MakeMove(column int, player Player) error {
+	if err := g.checkMove(column, player); err != nil {
+		return err
+	}
+
+	if !g.board.CanPlay(column) {
+		return errors.New("column is full")
+	}
+
+	// Place the disc
+	row := g.board.Play(column, player)
+	g.recordMove(player, column, MoveDrop, row)
+
+	// Check for win
+	if g.board.IsWin(player) {
+		g.finish(player, EndReasonConnect)
+		return nil
+	}
+
+	g.endTurn()
+	return nil
+}
+
+// Pop removes one of the player's own discs from the bottom of the specified
+// column, letting the rest of the column fall. Only allowed in PopOut games.
+func (g *Game) Pop(column int, player Player) error {
+	if g.Variant != VariantPopOut {
+		return errors.New("popping is only allowed in PopOut games")
+	}
+
+	if err := g.checkMove(column, player); err != nil {
+		return err
+	}
+
+	if !g.board.CanPop(column, player) {
+		return errors.New("you can only pop your own disc from the bottom row")
+	}
+
+	g.board.Pop(column)
+	g.recordMove(player, column, MovePop, g.Height-1)
+
+	// A pop can complete lines for both players at once. The player who
+	// popped wins if any of the lines is theirs.
+	if g.board.IsWin(player) {
+		g.finish(player, EndReasonConnect)
+		return nil
+	}
+	if g.board.IsWin(opponent(player)) {
+		g.finish(opponent(player), EndReasonConnect)
+		return nil
+	}
+
+	g.endTurn()
+	return nil
+}
+
+// PlayMove makes a move of the given kind
+func (g *Game) PlayMove(kind MoveKind, column int, player Player) error {
+	switch kind {
+	case MoveDrop:
+		return g.MakeMove(column, player)
+	case MovePop:
+		return g.Pop(column, player)
+	}
+	return fmt.Errorf("unknown move kind %q", kind)
+}
+
+// checkMove validates the parts of a move that do not depend on its kind
+func (g *Game) checkMove(column int, player Player) error {
 	if g.State != InProgress {
 		return errors.New("game is not in progress")
 	}
@@ -66,141 +334,283 @@ func (g *Game) MakeMove(column int, player Player) error {
 		return errors.New("not your turn")
 	}
 
-	if column < 0 || column >= BoardWidth {
-		return errors.New("invalid column")
+	if g.Paused {
+		return errors.New("the game is paused until both players reconnect")
 	}
 
-	// Find the lowest empty row in the column
-	row := -1
-	for r := BoardHeight - 1; r >= 0; r-- {
-		if g.Board[r][column] == Empty {
-			row = r
-			break
-		}
+	// A move made after the clock ran out loses on time
+	if g.CheckFlag() {
+		return errTimeUp
 	}
 
-	if row == -1 {
-		return errors.New("column is full")
+	if column < 0 || column >= g.Width {
+		return errors.New("invalid column")
 	}
 
-	// Place the disc
-	g.Board[row][column] = player
-	g.LastMoveAt = time.Now()
+	return nil
+}
 
-	// Check for win
-	if g.checkWin(row, column, player) {
-		g.State = Finished
-		g.Winner = player
-		now := time.Now()
-		g.EndedAt = &now
-		return nil
+// recordMove appends a move to the history. Making a move also declines
+// any takeback the opponent asked for and ends any draw offer.
+func (g *Game) recordMove(player Player, column int, kind MoveKind, row int) {
+	now := time.Now()
+	g.pressClock(now)
+	g.Moves = append(g.Moves, Move{
+		Player:    player,
+		Column:    column,
+		Kind:      kind,
+		Row:       row,
+		Timestamp: now,
+	})
+	if g.TimeControl.IsTimed() {
+		g.Moves[len(g.Moves)-1].ClockMs = g.Clocks[player-1].Milliseconds()
 	}
+	g.LastMoveAt = now
+	g.TakebackRequestedBy = Empty
+	// Moving instead of answering declines the opponent's draw offer, and
+	// the offerer moving withdraws their own
+	g.DrawOfferedBy = Empty
+}
 
-	// Check for draw
-	if g.isBoardFull() {
-		g.State = Finished
-		g.IsDraw = true
-		now := time.Now()
-		g.EndedAt = &now
-		return nil
+// Forfeit ends the game as a loss for loser
+func (g *Game) Forfeit(loser Player, reason EndReason) error {
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
 	}
 
-	// Switch turn
-	if g.CurrentTurn == Player1 {
-		g.CurrentTurn = Player2
-	} else {
-		g.CurrentTurn = Player1
+	g.finish(opponent(loser), reason)
+	return nil
+}
+
+// Abandon ends the game with no winner and no draw
+func (g *Game) Abandon() error {
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
 	}
 
+	g.finish(Empty, EndReasonAbandoned)
+	g.IsDraw = false
 	return nil
 }
 
-// checkWin checks if the last move resulted in a win
-func (g *Game) checkWin(row, col int, player Player) bool {
-	// Check horizontal
-	count := 1
-	for c := col - 1; c >= 0 && g.Board[row][c] == player; c-- {
-		count++
+// OfferDraw offers the opponent a draw. The offer stands until the opponent
+// answers it or either player makes a move.
+func (g *Game) OfferDraw(player Player) error {
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
+	}
+
+	if g.DrawOfferedBy == player {
+		return errors.New("you have already offered a draw")
 	}
-	for c := col + 1; c < BoardWidth && g.Board[row][c] == player; c++ {
-		count++
+
+	if g.DrawOfferedBy == opponent(player) {
+		return errors.New("your opponent has already offered a draw")
 	}
-	if count >= 4 {
-		return true
+
+	g.DrawOfferedBy = player
+	return nil
+}
+
+// AcceptDraw accepts the opponent's draw offer, ending the game
+func (g *Game) AcceptDraw(player Player) error {
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
 	}
 
-	// Check vertical
-	count = 1
-	for r := row - 1; r >= 0 && g.Board[r][col] == player; r-- {
-		count++
+	if g.DrawOfferedBy != opponent(player) {
+		return errors.New("there is no draw offer to accept")
 	}
-	for r := row + 1; r < BoardHeight && g.Board[r][col] == player; r++ {
-		count++
+
+	g.finish(Empty, EndReasonAgreedDraw)
+	return nil
+}
+
+// DeclineDraw declines the opponent's draw offer
+func (g *Game) DeclineDraw(player Player) error {
+	if g.DrawOfferedBy != opponent(player) {
+		return errors.New("there is no draw offer to decline")
 	}
-	if count >= 4 {
-		return true
+
+	g.DrawOfferedBy = Empty
+	return nil
+}
+
+// WinnerName returns the username of the winner, or "" for a draw or unfinished game
+func (g *Game) WinnerName() string {
+	return g.playerName(g.Winner)
+}
+
+// playerName returns the username playing as player, or "" for Empty
+func (g *Game) playerName(player Player) string {
+	switch player {
+	case Player1:
+		return g.Player1
+	case Player2:
+		return g.Player2
 	}
+	return ""
+}
 
-	// Check diagonal (top-left to bottom-right)
-	count = 1
-	r, c := row-1, col-1
-	for r >= 0 && c >= 0 && g.Board[r][c] == player {
-		count++
-		r--
-		c--
+// RequestTakeback asks to take back player's most recent move. Takebacks are
+// only allowed in unrated games.
+func (g *Game) RequestTakeback(player Player) error {
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
 	}
-	r, c = row+1, col+1
-	for r < BoardHeight && c < BoardWidth && g.Board[r][c] == player {
-		count++
-		r++
-		c++
+
+	if g.Rated {
+		return errors.New("takebacks are only allowed in unrated or bot games")
 	}
-	if count >= 4 {
-		return true
+
+	if g.lastMoveBy(player) == -1 {
+		return errors.New("you have no move to take back")
 	}
 
-	// Check diagonal (top-right to bottom-left)
-	count = 1
-	r, c = row-1, col+1
-	for r >= 0 && c < BoardWidth && g.Board[r][c] == player {
-		count++
-		r--
-		c++
+	g.TakebackRequestedBy = player
+	return nil
+}
+
+// AcceptTakeback accepts the opponent's pending takeback request. Moves are
+// undone until the requester's most recent move is gone, so it is their turn
+// again, and both clocks go back to what they were before that move.
+func (g *Game) AcceptTakeback(player Player) error {
+	requester := opponent(player)
+	if g.TakebackRequestedBy != requester {
+		return errors.New("there is no takeback request to accept")
 	}
-	r, c = row+1, col-1
-	for r < BoardHeight && c >= 0 && g.Board[r][c] == player {
-		count++
-		r++
-		c--
+
+	if g.State != InProgress {
+		return errors.New("game is not in progress")
 	}
-	if count >= 4 {
-		return true
+
+	last := g.lastMoveBy(requester)
+	for len(g.Moves) > last {
+		g.undoMove()
 	}
+	g.TakebackRequestedBy = Empty
+	g.LastMoveAt = time.Now()
+	g.restoreClocks(g.LastMoveAt)
 
-	return false
+	return nil
 }
 
-// isBoardFull checks if the board is completely filled
-func (g *Game) isBoardFull() bool {
-	for c := 0; c < BoardWidth; c++ {
-		if g.Board[0][c] == Empty {
-			return false
+// lastMoveBy returns the history index of player's most recent move, or -1
+func (g *Game) lastMoveBy(player Player) int {
+	for i := len(g.Moves) - 1; i >= 0; i-- {
+		if g.Moves[i].Player == player {
+			return i
 		}
 	}
-	return true
+	return -1
+}
+
+// undoMove takes back the last move in the history
+func (g *Game) undoMove() {
+	last := g.Moves[len(g.Moves)-1]
+
+	if g.Variant == VariantPopOut {
+		g.positions[positionKey{pieces: g.board.Key(), turn: g.CurrentTurn}]--
+	}
+
+	if last.Kind == MovePop {
+		g.board.Unpop(last.Column, last.Player)
+	} else {
+		g.board.Undo(last.Column)
+	}
+
+	g.Moves = g.Moves[:len(g.Moves)-1]
+	g.CurrentTurn = last.Player
+}
+
+// endTurn passes the turn to the other player. The game is drawn if that
+// player has no move left, or in PopOut if the position has now been
+// reached RepetitionLimit times.
+func (g *Game) endTurn() {
+	g.CurrentTurn = opponent(g.CurrentTurn)
+
+	if !g.board.HasMove(g.CurrentTurn, g.Variant == VariantPopOut) {
+		g.finish(Empty, EndReasonBoardFull)
+		return
+	}
+
+	if g.Variant == VariantPopOut && g.recordPosition() >= RepetitionLimit {
+		g.finish(Empty, EndReasonRepetition)
+	}
+}
+
+// recordPosition counts the current position and returns how often it has occurred
+func (g *Game) recordPosition() int {
+	if g.positions == nil {
+		g.positions = make(map[positionKey]int)
+	}
+	key := positionKey{pieces: g.board.Key(), turn: g.CurrentTurn}
+	g.positions[key]++
+	return g.positions[key]
+}
+
+// finish ends the game, won by winner or drawn if winner is Empty
+func (g *Game) finish(winner Player, reason EndReason) {
+	now := time.Now()
+	g.chargeClock(now)
+	g.Paused = false
+	g.State = Finished
+	g.EndReason = reason
+	g.TakebackRequestedBy = Empty
+	g.DrawOfferedBy = Empty
+	if winner == Empty {
+		g.IsDraw = true
+	} else {
+		g.Winner = winner
+	}
+	g.EndedAt = &now
+}
+
+// connFor returns the connection of the given player, which may be nil
+func (g *Game) connFor(player Player) *Connection {
+	if player == Player1 {
+		return g.Player1Conn
+	}
+	return g.Player2Conn
+}
+
+// opponent returns the other player
+func opponent(player Player) Player {
+	if player == Player1 {
+		return Player2
+	}
+	return Player1
+}
+
+// Board returns the board as a row-major grid with row 0 at the top
+func (g *Game) Board() [][]Player {
+	return g.board.Array()
 }
 
 // GetValidMoves returns a list of columns that have available spaces
 func (g *Game) GetValidMoves() []int {
 	valid := []int{}
-	for c := 0; c < BoardWidth; c++ {
-		if g.Board[0][c] == Empty {
+	for c := 0; c < g.Width; c++ {
+		if g.board.CanPlay(c) {
 			valid = append(valid, c)
 		}
 	}
 	return valid
 }
 
+// Options returns the rules this game is played with
+func (g *Game) Options() GameOptions {
+	return GameOptions{
+		Width:       g.Width,
+		Height:      g.Height,
+		WinLength:   g.WinLength,
+		Variant:     g.Variant,
+		Rated:       g.Rated,
+		Position:    g.StartPosition,
+		TimeControl: g.TimeControl,
+	}
+}
+
 // StartGame starts the game
 func (g *Game) StartGame(player2 string) {
 	g.Player2 = player2
@@ -208,4 +618,8 @@ func (g *Game) StartGame(player2 string) {
 	now := time.Now()
 	g.StartedAt = &now
 	g.LastMoveAt = now
+	g.startClock(now)
+	if g.Variant == VariantPopOut {
+		g.recordPosition()
+	}
 }
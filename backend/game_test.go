@@ -0,0 +1,220 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGame starts a game between alice and bob with the given rules
+func newTestGame(t *testing.T, opts GameOptions) *Game {
+	t.Helper()
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	game := NewGame(generateGameID(), "alice", opts)
+	game.StartGame("bob")
+	return game
+}
+
+// play makes the moves in turn, failing the test if any is refused
+func play(t *testing.T, game *Game, moves ...Move) {
+	t.Helper()
+	for _, move := range moves {
+		if err := game.PlayMove(move.Kind, move.Column, move.Player); err != nil {
+			t.Fatalf("player %d %s in column %d: %v", move.Player, move.Kind, move.Column, err)
+		}
+	}
+}
+
+func drop(player Player, column int) Move {
+	return Move{Player: player, Column: column, Kind: MoveDrop}
+}
+
+func pop(player Player, column int) Move {
+	return Move{Player: player, Column: column, Kind: MovePop}
+}
+
+// takeback has requester ask to take back their last move and the opponent accept
+func takeback(t *testing.T, game *Game, requester Player) {
+	t.Helper()
+	if err := game.RequestTakeback(requester); err != nil {
+		t.Fatal(err)
+	}
+	if err := game.AcceptTakeback(opponent(requester)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// repetitions returns how often each position has occurred
+func repetitions(game *Game) map[positionKey]int {
+	counts := make(map[positionKey]int)
+	for key, n := range game.positions {
+		if n > 0 {
+			counts[key] = n
+		}
+	}
+	return counts
+}
+
+func TestTakebackRestoresRepetitions(t *testing.T) {
+	opts := DefaultGameOptions()
+	opts.Variant = VariantPopOut
+	opts.Rated = false
+	game := newTestGame(t, opts)
+
+	// Popping both discs brings back the empty board, so every position
+	// after this occurs for the second time
+	play(t, game, drop(Player1, 0), drop(Player2, 1), pop(Player1, 0), pop(Player2, 1))
+	play(t, game, drop(Player1, 0), drop(Player2, 1))
+	before := repetitions(game)
+
+	// Taking back a pop
+	play(t, game, pop(Player1, 0))
+	takeback(t, game, Player1)
+	if after := repetitions(game); !maps.Equal(after, before) {
+		t.Fatalf("after taking back a pop: positions %v, want %v", after, before)
+	}
+
+	// Taking back a pop and the opponent's move after it
+	play(t, game, pop(Player1, 0), drop(Player2, 2))
+	takeback(t, game, Player1)
+	if after := repetitions(game); !maps.Equal(after, before) {
+		t.Fatalf("after taking back two moves: positions %v, want %v", after, before)
+	}
+
+	// The pop has been taken back twice, so playing it reaches its position
+	// for only the second time
+	play(t, game, pop(Player1, 0))
+	if n := game.positions[positionKey{pieces: game.board.Key(), turn: Player2}]; n != 2 || game.State != InProgress {
+		t.Fatalf("position after the pop occurred %d times with the game %v, want 2 in progress", n, game.State)
+	}
+
+	// while the empty board now occurs for the third time
+	play(t, game, pop(Player2, 1))
+	if game.State != Finished || game.EndReason != EndReasonRepetition {
+		t.Fatalf("game %v by %q, want drawn by repetition", game.State, game.EndReason)
+	}
+}
+
+func TestTakebackRestoresClocks(t *testing.T) {
+	opts := DefaultGameOptions()
+	opts.Rated = false
+	opts.TimeControl = TimeControl{Base: time.Minute, Increment: 2 * time.Second}
+	game := newTestGame(t, opts)
+
+	// spend makes the player to move take d over their move
+	spend := func(d time.Duration, move Move) {
+		game.turnStartedAt = game.turnStartedAt.Add(-d)
+		play(t, game, move)
+	}
+	spend(5*time.Second, drop(Player1, 3))
+	spend(10*time.Second, drop(Player2, 3))
+	// Moves keep the clocks to the millisecond
+	clocks := [2]time.Duration{game.Clocks[0].Truncate(time.Millisecond), game.Clocks[1].Truncate(time.Millisecond)}
+	if clocks[0].Round(time.Second) != 57*time.Second || clocks[1].Round(time.Second) != 52*time.Second {
+		t.Fatalf("clocks %v after two moves, want 57s and 52s", clocks)
+	}
+	spend(3*time.Second, drop(Player1, 4))
+	spend(7*time.Second, drop(Player2, 4))
+
+	// Player 1 thinks for a while, then takes back their move, which also
+	// takes back player 2's move after it
+	game.turnStartedAt = game.turnStartedAt.Add(-20 * time.Second)
+	takeback(t, game, Player1)
+	if len(game.Moves) != 2 || game.CurrentTurn != Player1 {
+		t.Fatalf("%d moves with player %d to move, want 2 moves with player 1 to move", len(game.Moves), game.CurrentTurn)
+	}
+	if game.Clocks != clocks {
+		t.Fatalf("clocks %v after the takeback, want %v", game.Clocks, clocks)
+	}
+	if remaining := game.RemainingTime(Player1); remaining > clocks[0] || remaining < clocks[0]-time.Second {
+		t.Fatalf("player 1 has %v left, want their clock to restart at %v", remaining, clocks[0])
+	}
+
+	// Taking back every move gives both players the base time
+	takeback(t, game, Player1)
+	if len(game.Moves) != 0 || game.CurrentTurn != Player1 || game.Clocks != [2]time.Duration{time.Minute, time.Minute} {
+		t.Fatalf("%d moves, player %d to move, clocks %v; want the start of the game", len(game.Moves), game.CurrentTurn, game.Clocks)
+	}
+}
+
+func TestWinOnOtherBoards(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  GameOptions
+		moves string
+		// winner is who the last move wins for
+		winner Player
+	}{
+		// Column 7 of a 12x9 board takes bits 60 to 69, so lines through it
+		// cross from one word of the bitset into the other
+		{"largest board diagonal", boardOptions(12, 9, 4), "56678778988", Player1},
+		{"largest board anti-diagonal", boardOptions(12, 9, 4), "98876776566", Player1},
+		{"largest board five on a diagonal", boardOptions(12, 9, 5), "56678778988919199", Player1},
+		{"largest board four is not five", boardOptions(12, 9, 5), "56678778988", Empty},
+		{"largest board horizontal", boardOptions(12, 9, 4), "5566778", Player1},
+		{"largest board rightmost columns", boardOptions(12, 9, 4), "cbcbcbc", Player1},
+		// Column 9 of a 9x7 board starts at bit 64
+		{"connect five diagonal into the high word", boardOptions(9, 7, 5), "56678778988919199", Player1},
+		{"connect three", boardOptions(4, 4, 3), "12121", Player1},
+		{"connect three diagonal", boardOptions(4, 4, 3), "1223433", Player1},
+		{"tallest board vertical at the top", boardOptions(4, 31, 4), "3" + strings.Repeat("1", 27) + "1212121", Player1},
+		{"popout on the largest board", popOutWide(), "777878787", Player1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := newTestGame(t, tt.opts)
+			for i := 0; i < len(tt.moves); i++ {
+				mover := game.CurrentTurn
+				play(t, game, drop(mover, parseColumnSymbol(tt.moves[i])))
+
+				// Every move agrees with the array-based check
+				won := arrayWin(game.Board(), mover, tt.opts.WinLength)
+				if over := game.State == Finished; over != won || (won && game.Winner != mover) {
+					t.Fatalf("after move %d: game %v won by %d, array check says won %v by %d", i+1, game.State, game.Winner, won, mover)
+				}
+				if won && i < len(tt.moves)-1 {
+					t.Fatalf("won at move %d of %d", i+1, len(tt.moves))
+				}
+			}
+			if game.Winner != tt.winner {
+				t.Fatalf("won by %d, want %d", game.Winner, tt.winner)
+			}
+			if tt.winner != Empty && game.EndReason != EndReasonConnect {
+				t.Fatalf("ended by %q, want %q", game.EndReason, EndReasonConnect)
+			}
+		})
+	}
+}
+
+func TestValidateBoardLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  GameOptions
+		valid bool
+	}{
+		{"standard", DefaultGameOptions(), true},
+		{"widest and tallest for its width", boardOptions(MaxBoardWidth, 9, 4), true},
+		{"widest and too tall", boardOptions(MaxBoardWidth, 10, 4), false},
+		{"too wide", boardOptions(MaxBoardWidth+1, 6, 4), false},
+		{"narrowest and tallest", boardOptions(MinBoardSize, 31, 4), true},
+		{"narrowest and too tall", boardOptions(MinBoardSize, 32, 4), false},
+		{"too narrow", boardOptions(MinBoardSize-1, 6, 3), false},
+		{"too short", boardOptions(7, MinBoardSize-1, 3), false},
+		{"popout on the largest board", popOutWide(), true},
+		{"shortest win", boardOptions(4, 4, MinWinLength), true},
+		{"win too short", boardOptions(7, 6, MinWinLength-1), false},
+		{"win as long as the board is high", boardOptions(12, 9, 9), true},
+		{"win longer than the board is high", boardOptions(12, 9, 10), false},
+		{"win longer than the board is wide", boardOptions(4, 31, 5), false},
+		{"connect five", boardOptions(9, 7, 5), true},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
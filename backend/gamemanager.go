@@ -1,21 +1,63 @@
 package main
 
 import (
+	"log"
 	"sync"
 	"time"
 )
 
-// GameManager manages all active and completed games
+// GameManager manages all active and completed games. Completed games are
+// written to the game store and stay in memory until the retention policy
+// evicts them, as do finished games loaded back from the store.
 type GameManager struct {
 	games          map[string]*Game
 	completedGames map[string]*Game
-	mu             sync.RWMutex
+	// completedOrder lists the completed games in memory, oldest first
+	completedOrder []completedGame
+	// activeByPlayer and completedByPlayer index each player's active game and
+	// most recently completed game in memory by ID
+	activeByPlayer    map[string]string
+	completedByPlayer map[string]string
+	// evict asks the retention loop to sweep now rather than at its next tick
+	evict chan struct{}
+	mu    sync.RWMutex
+}
+
+// completedGame is when a game in memory was completed
+type completedGame struct {
+	gameID      string
+	completedAt time.Time
 }
 
 func NewGameManager() *GameManager {
 	return &GameManager{
-		games:          make(map[string]*Game),
-		completedGames: make(map[string]*Game),
+		games:             make(map[string]*Game),
+		completedGames:    make(map[string]*Game),
+		activeByPlayer:    make(map[string]string),
+		completedByPlayer: make(map[string]string),
+		evict:             make(chan struct{}, 1),
+	}
+}
+
+// humanPlayers returns the usernames of the game's players, leaving out the bot
+func humanPlayers(game *Game) []string {
+	players := make([]string, 0, 2)
+	for _, player := range []Player{Player1, Player2} {
+		name := game.playerName(player)
+		if name == "" || (game.IsBotGame && game.BotSeat == player) {
+			continue
+		}
+		players = append(players, name)
+	}
+	return players
+}
+
+// unindex removes the game from a player index
+func unindex(index map[string]string, game *Game) {
+	for _, username := range humanPlayers(game) {
+		if index[username] == game.ID {
+			delete(index, username)
+		}
 	}
 }
 
@@ -24,46 +66,144 @@ func (gm *GameManager) AddGame(game *Game) {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 	gm.games[game.ID] = game
+	for _, username := range humanPlayers(game) {
+		gm.activeByPlayer[username] = game.ID
+	}
+}
+
+// IndexPlayers indexes an active game's players again, for a game whose
+// second player joined after it was added
+func (gm *GameManager) IndexPlayers(game *Game) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if _, exists := gm.games[game.ID]; !exists {
+		return
+	}
+	for _, username := range humanPlayers(game) {
+		gm.activeByPlayer[username] = game.ID
+	}
 }
 
 // GetGame retrieves a game by ID
 func (gm *GameManager) GetGame(gameID string) (*Game, bool) {
 	gm.mu.RLock()
-	defer gm.mu.RUnlock()
 	game, exists := gm.games[gameID]
 	if !exists {
 		game, exists = gm.completedGames[gameID]
 	}
-	return game, exists
+	gm.mu.RUnlock()
+
+	if exists {
+		return game, true
+	}
+	return gm.loadGame(gameStore.GetGame(gameID))
 }
 
-// GetGameByUsername retrieves a game by username
-func (gm *GameManager) GetGameByUsername(username string) (*Game, bool) {
+// activeGames returns the active games. The manager's lock is released before
+// it returns, so the caller can lock each game in turn.
+func (gm *GameManager) activeGames() []*Game {
 	gm.mu.RLock()
 	defer gm.mu.RUnlock()
-
+	games := make([]*Game, 0, len(gm.games))
 	for _, game := range gm.games {
-		if game.Player1 == username || game.Player2 == username {
-			return game, true
-		}
+		games = append(games, game)
 	}
+	return games
+}
 
-	for _, game := range gm.completedGames {
-		if game.Player1 == username || game.Player2 == username {
-			return game, true
+// loadGame rebuilds a finished game read from the game store and keeps it in
+// memory with the completed games, so every lookup shares one game and its
+// lock until the retention policy evicts it again
+func (gm *GameManager) loadGame(record GameRecord, found bool, err error) (*Game, bool) {
+	if err == nil && found {
+		var game *Game
+		if game, err = record.Game(); err == nil {
+			return gm.keepLoaded(game), true
 		}
 	}
-
+	if err != nil {
+		log.Printf("Error loading game %s: %v", record.GameID, err)
+	}
 	return nil, false
 }
 
-// CompleteGame moves a game from active to completed
-func (gm *GameManager) CompleteGame(gameID string) {
+// keepLoaded adds a game loaded from the game store to the completed games,
+// returning the game already there instead if another lookup loaded it first
+func (gm *GameManager) keepLoaded(game *Game) *Game {
+	gm.mu.Lock()
+	if loaded, exists := gm.completedGames[game.ID]; exists {
+		gm.mu.Unlock()
+		return loaded
+	}
+	gm.completedGames[game.ID] = game
+	gm.completedOrder = append(gm.completedOrder, completedGame{gameID: game.ID, completedAt: time.Now()})
+	gm.mu.Unlock()
+
+	select {
+	case gm.evict <- struct{}{}:
+	default:
+		// A sweep is already due
+	}
+	return game
+}
+
+// GetGameByUsername retrieves a player's game, preferring the game they are
+// playing over the one they last finished
+func (gm *GameManager) GetGameByUsername(username string) (*Game, bool) {
+	gm.mu.RLock()
+	game, exists := gm.games[gm.activeByPlayer[username]]
+	if !exists {
+		game, exists = gm.completedGames[gm.completedByPlayer[username]]
+	}
+	gm.mu.RUnlock()
+
+	if exists {
+		return game, true
+	}
+	return gm.loadGame(gameStore.LatestGame(username))
+}
+
+// RemoveGame forgets an active game that never started
+func (gm *GameManager) RemoveGame(gameID string) {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 	if game, exists := gm.games[gameID]; exists {
-		gm.completedGames[gameID] = game
+		unindex(gm.activeByPlayer, game)
+		delete(gm.games, gameID)
+	}
+}
+
+// CompleteGame moves a game from active to completed and saves it to the game
+// store. The retention loop evicts games it pushes over the limit, since the
+// caller holds the game's lock and eviction locks the evicted games.
+func (gm *GameManager) CompleteGame(gameID string) {
+	gm.mu.Lock()
+	game, exists := gm.games[gameID]
+	if exists {
+		unindex(gm.activeByPlayer, game)
 		delete(gm.games, gameID)
+		gm.completedGames[gameID] = game
+		gm.completedOrder = append(gm.completedOrder, completedGame{gameID: gameID, completedAt: time.Now()})
+		for _, username := range humanPlayers(game) {
+			gm.completedByPlayer[username] = gameID
+		}
+	}
+	gm.mu.Unlock()
+
+	if exists {
+		saveGame(game)
+		select {
+		case gm.evict <- struct{}{}:
+		default:
+			// A sweep is already due
+		}
+	}
+}
+
+// saveGame writes a finished game to the game store
+func saveGame(game *Game) {
+	if err := gameStore.SaveGame(gameRecord(game)); err != nil {
+		log.Printf("Error saving game %s: %v", game.ID, err)
 	}
 }
 
@@ -72,85 +212,69 @@ func (gm *GameManager) CheckDisconnections() {
 	ticker := time.NewTicker(5 * time.Second)
 	go func() {
 		for range ticker.C {
-			gm.mu.RLock()
-			gamesToCheck := make([]*Game, 0, len(gm.games))
-			for _, game := range gm.games {
-				if game.State == InProgress {
-					gamesToCheck = append(gamesToCheck, game)
-				}
-			}
-			gm.mu.RUnlock()
-
-			for _, game := range gamesToCheck {
-				// Check if player disconnected (no activity for 30 seconds)
-				if game.Player1Conn != nil {
-					lastActivity := game.Player1Conn.GetLastActivity()
-					if time.Since(lastActivity) > 30*time.Second && time.Since(game.LastMoveAt) > 30*time.Second {
-						// Player 1 disconnected, player 2 wins
-						game.State = Finished
-						game.Winner = Player2
-						now := time.Now()
-						game.EndedAt = &now
-						gm.CompleteGame(game.ID)
-
-						// Notify player 2 if connected
-						if game.Player2Conn != nil {
-							sendGameState(game, game.Player2Conn)
-						}
-
-						// Emit game ended event
-						eventProducer.PublishEvent(Event{
-							Type:      "GAME_ENDED",
-							GameID:    game.ID,
-							Winner:    game.Player2,
-							Timestamp: time.Now(),
-						})
-						continue
-					}
-				}
-
-				if game.Player2Conn != nil && !game.IsBotGame {
-					lastActivity := game.Player2Conn.GetLastActivity()
-					if time.Since(lastActivity) > 30*time.Second && time.Since(game.LastMoveAt) > 30*time.Second {
-						// Player 2 disconnected, player 1 wins
-						game.State = Finished
-						game.Winner = Player1
-						now := time.Now()
-						game.EndedAt = &now
-						gm.CompleteGame(game.ID)
-
-						// Notify player 1 if connected
-						if game.Player1Conn != nil {
-							sendGameState(game, game.Player1Conn)
-						}
-
-						// Emit game ended event
-						eventProducer.PublishEvent(Event{
-							Type:      "GAME_ENDED",
-							GameID:    game.ID,
-							Winner:    game.Player1,
-							Timestamp: time.Now(),
-						})
-					}
-				}
+			for _, game := range gm.activeGames() {
+				gm.checkDisconnection(game)
 			}
 		}
 	}()
 }
 
-// GetLeaderboard returns the leaderboard data
-func (gm *GameManager) GetLeaderboard() map[string]int {
-	gm.mu.RLock()
-	defer gm.mu.RUnlock()
+// checkDisconnection forfeits the game of a player who has gone quiet
+func (gm *GameManager) checkDisconnection(game *Game) {
+	game.mu.Lock()
+	defer game.mu.Unlock()
 
-	wins := make(map[string]int)
-	for _, game := range gm.completedGames {
-		if game.Winner == Player1 {
-			wins[game.Player1]++
-		} else if game.Winner == Player2 {
-			wins[game.Player2]++
+	// Timed games are ended by the clock instead, unless they are paused
+	if game.State != InProgress || (!game.Paused && game.TimeControl.IsTimed()) {
+		return
+	}
+	// A player who has not come back to a recovered game in time forfeits
+	// it if their opponent has, and it is abandoned if neither has
+	if game.Paused {
+		if time.Since(game.LastMoveAt) <= config.ReconnectTimeout {
+			return
 		}
+		ready1, ready2 := game.seatReady(Player1), game.seatReady(Player2)
+		switch {
+		case ready1 && ready2:
+			return
+		case ready1:
+			game.Forfeit(Player2, EndReasonTimeout)
+		case ready2:
+			game.Forfeit(Player1, EndReasonTimeout)
+		default:
+			game.Abandon()
+		}
+		broadcastGameUpdate(game)
+		completeGame(game)
+		return
 	}
 
-	return wins
+	// Check if player disconnected
+	if game.Player1Conn != nil {
+		lastActivity := game.Player1Conn.GetLastActivity()
+		if time.Since(lastActivity) > config.ReconnectTimeout && time.Since(game.LastMoveAt) > config.ReconnectTimeout {
+			// Player 1 disconnected, player 2 wins
+			game.Forfeit(Player1, EndReasonTimeout)
+
+			// Notify player 2 and any spectators
+			broadcastGameUpdate(game)
+
+			completeGame(game)
+			return
+		}
+	}
+
+	if game.Player2Conn != nil {
+		lastActivity := game.Player2Conn.GetLastActivity()
+		if time.Since(lastActivity) > config.ReconnectTimeout && time.Since(game.LastMoveAt) > config.ReconnectTimeout {
+			// Player 2 disconnected, player 1 wins
+			game.Forfeit(Player2, EndReasonTimeout)
+
+			// Notify player 1 and any spectators
+			broadcastGameUpdate(game)
+
+			completeGame(game)
+		}
+	}
 }
@@ -1,248 +1,609 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
-	"math/rand"
 	"time"
 )
 
 var (
 	gameManager      = NewGameManager()
 	matchmakingQueue = NewMatchmakingQueue()
+	ratingSystem     = NewRatingSystem()
+	roomManager      = NewRoomManager()
+	// gameStore keeps finished games and ratings; main replaces it with the configured store
+	gameStore GameStore = NewMemoryGameStore()
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-	gameManager.CheckDisconnections()
-}
+// GameIDBytes is how many random bytes make up a game ID
+const GameIDBytes = 8
 
-// generateGameID generates a unique game ID
+// generateGameID generates a unique game ID of hex digits, so it can be used
+// in a URL path as it is
 func generateGameID() string {
-	return time.Now().Format("20060102150405") + string(rune(rand.Intn(1000)))
+	raw := make([]byte, GameIDBytes)
+	if _, err := rand.Read(raw); err != nil {
+		// crypto/rand only fails when the system has no randomness to give
+		panic(err)
+	}
+	return hex.EncodeToString(raw)
 }
 
-// handleMessage processes incoming WebSocket messages
-func handleMessage(conn *Connection, msg *Message) {
-	switch msg.Type {
-	case "JOIN":
-		handleJoin(conn, msg)
-	case "MOVE":
-		handleMove(conn, msg)
-	case "RECONNECT":
-		handleReconnect(conn, msg)
-	case "GET_LEADERBOARD":
+// handleMessage dispatches a decoded client message to its handler by the
+// type of its payload
+func handleMessage(conn *Connection, payload interface{}) {
+	switch p := payload.(type) {
+	case *JoinPayload:
+		handleJoin(conn, p)
+	case *CreateRoomPayload:
+		handleCreateRoom(conn, p)
+	case *JoinRoomPayload:
+		handleJoinRoom(conn, p)
+	case *MovePayload:
+		handleMove(conn, p.GameID, p.Column, MoveDrop)
+	case *PopPayload:
+		handleMove(conn, p.GameID, p.Column, MovePop)
+	case *TakebackRequestPayload:
+		handleTakebackRequest(conn, p.GameID)
+	case *TakebackAcceptPayload:
+		handleTakebackAccept(conn, p.GameID)
+	case *ResignPayload:
+		handleResign(conn, p.GameID)
+	case *OfferDrawPayload:
+		handleOfferDraw(conn, p.GameID)
+	case *AcceptDrawPayload:
+		handleAcceptDraw(conn, p.GameID)
+	case *DeclineDrawPayload:
+		handleDeclineDraw(conn, p.GameID)
+	case *RematchRequestPayload:
+		handleRematchRequest(conn, p.GameID)
+	case *RematchAcceptPayload:
+		handleRematchAccept(conn, p.GameID)
+	case *ReconnectPayload:
+		handleReconnect(conn, p)
+	case *ResumePayload:
+		handleResume(conn, p)
+	case *GetStatePayload:
+		handleGetState(conn, p.GameID)
+	case *ReplayPayload:
+		handleReplay(conn, p)
+	case *SpectatePayload:
+		handleSpectate(conn, p)
+	case *StopSpectatingPayload:
+		stopSpectating(conn)
+	case *ListGamesPayload:
+		handleListGames(conn)
+	case *ChatPayload:
+		handleChat(conn, p)
+	case *MutePayload:
+		handleMute(conn, p.GameID, true)
+	case *UnmutePayload:
+		handleMute(conn, p.GameID, false)
+	case *GetLeaderboardPayload:
 		handleGetLeaderboard(conn)
 	default:
-		sendError(conn, "unknown message type")
+		sendError(conn, ErrUnknownType, "unknown message type")
 	}
 }
 
-// handleJoin handles a player joining the game
-func handleJoin(conn *Connection, msg *Message) {
-	if msg.Username == "" {
-		sendError(conn, "username is required")
+// handleJoin handles a player joining the game under the username they logged in with
+func handleJoin(conn *Connection, p *JoinPayload) {
+	difficulty, err := ParseDifficulty(p.Difficulty)
+	if err != nil {
+		sendError(conn, ErrInvalidOptions, err.Error())
 		return
 	}
 
-	conn.username = msg.Username
-	gameID := matchmakingQueue.AddPlayer(msg.Username, conn)
-	conn.gameID = gameID
+	opts, err := gameOptionsFromRules(conn, p.GameRules)
+	if err != nil {
+		sendError(conn, ErrInvalidOptions, err.Error())
+		return
+	}
 
-	response := Message{
-		Type:     "JOINED",
-		GameID:   gameID,
-		Username: msg.Username,
+	token, session, err := newSession(time.Now())
+	if err != nil {
+		sendError(conn, ErrInternal, "could not start a session")
+		return
 	}
-	sendMessage(conn, &response)
+
+	gameID := matchmakingQueue.AddPlayer(conn.username, conn, session, opts, difficulty)
+	conn.SetGameID(gameID)
+
+	sendMessage(conn, "JOINED", JoinedPayload{
+		GameID:   gameID,
+		Username: conn.username,
+		Token:    token,
+	})
 }
 
-// handleMove handles a player making a move
-func handleMove(conn *Connection, msg *Message) {
-	// 🔒 Fallback: use connection gameID if client didn't send it yet
-	if msg.GameID == "" {
-		msg.GameID = conn.gameID
+// gameOptionsFromRules reads and validates the rules chosen in a JOIN or
+// CREATE_ROOM message, using the defaults for anything left unset. A starting position in
+// either notation is normalized to a board string, and such games are unrated,
+// as are the games of guests.
+func gameOptionsFromRules(conn *Connection, rules GameRules) (GameOptions, error) {
+	opts := DefaultGameOptions()
+	if rules.Width != 0 {
+		opts.Width = rules.Width
+	}
+	if rules.Height != 0 {
+		opts.Height = rules.Height
+	}
+	if rules.WinLength != 0 {
+		opts.WinLength = rules.WinLength
+	}
+	if rules.Variant != "" {
+		opts.Variant = Variant(rules.Variant)
+	}
+	if rules.Casual || conn.guest {
+		opts.Rated = false
 	}
 
-	if msg.GameID == "" {
-		sendError(conn, "game ID is required")
-		return
+	timeControl, err := ParseTimeControl(rules.TimeControl)
+	if err != nil {
+		return GameOptions{}, err
 	}
+	opts.TimeControl = timeControl
 
-	game, exists := gameManager.GetGame(msg.GameID)
+	if rules.Position != "" {
+		board, toMove, err := ParsePosition(rules.Position, opts)
+		if err != nil {
+			return GameOptions{}, err
+		}
+		opts.Width = board.Width()
+		opts.Height = board.Height()
+		opts.Position = formatBoardString(&board, toMove)
+		opts.Rated = false
+	}
 
-	if !exists {
-		sendError(conn, "game not found")
-		return
+	if err := opts.Validate(); err != nil {
+		return GameOptions{}, err
 	}
+	return opts, nil
+}
 
-	// Determine which player is making the move
-	var player Player
-	if game.Player1 == conn.username {
-		player = Player1
-	} else if game.Player2 == conn.username {
-		player = Player2
-	} else {
-		sendError(conn, "you are not a player in this game")
+// handleMove handles a player dropping a disc or, in PopOut, popping one out
+func handleMove(conn *Connection, gameID string, column int, kind MoveKind) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
 		return
 	}
+	defer game.mu.Unlock()
 
 	// Make the move
-	if err := game.MakeMove(msg.Column, player); err != nil {
-		sendError(conn, err.Error())
+	if err := game.PlayMove(kind, column, player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		if err == errTimeUp {
+			broadcastGameUpdate(game)
+			completeGame(game)
+		}
 		return
 	}
+	appendLog(game, LogMove)
 
 	// Emit move made event
 	eventProducer.PublishEvent(Event{
 		Type:      "MOVE_MADE",
-		GameID:    msg.GameID,
+		GameID:    game.ID,
 		Player:    conn.username,
-		Column:    msg.Column,
+		Column:    &column,
+		MoveKind:  string(kind),
 		Timestamp: time.Now(),
 	})
 
-	// Send updated game state to both players
-	if game.Player1Conn != nil {
-		sendGameState(game, game.Player1Conn)
-	}
-	if game.Player2Conn != nil {
-		sendGameState(game, game.Player2Conn)
-	}
+	// Send the move to both players
+	broadcastMove(game)
 
 	// If game is finished, move to completed games
 	if game.State == Finished {
-		gameManager.CompleteGame(game.ID)
-
-		// Emit game ended event
-		winner := ""
-		if game.Winner == Player1 {
-			winner = game.Player1
-		} else if game.Winner == Player2 {
-			winner = game.Player2
-		}
+		completeGame(game)
+	} else {
+		scheduleFlagCheck(game)
+		scheduleBotMove(game)
+	}
+}
 
-		eventProducer.PublishEvent(Event{
-			Type:      "GAME_ENDED",
-			GameID:    game.ID,
-			Winner:    winner,
-			IsDraw:    game.IsDraw,
-			Timestamp: time.Now(),
-		})
-	} else if game.IsBotGame && game.CurrentTurn == Player2 {
-		// Bot's turn - make bot move after a short delay
-		go func() {
-			time.Sleep(500 * time.Millisecond)
-			bot := NewBotPlayer()
-			botMove := bot.GetMove(game)
-			if botMove != -1 {
-				game.MakeMove(botMove, Player2)
-
-				// Emit move made event
-				eventProducer.PublishEvent(Event{
-					Type:      "MOVE_MADE",
-					GameID:    game.ID,
-					Player:    "Bot",
-					Column:    botMove,
-					Timestamp: time.Now(),
-				})
-
-				// Send updated game state
-				if game.Player1Conn != nil {
-					sendGameState(game, game.Player1Conn)
-				}
+// scheduleBotMove makes the bot's move after a short delay if it is the bot's
+// turn. The caller must hold the game's lock.
+func scheduleBotMove(game *Game) {
+	if !game.IsBotGame || game.CurrentTurn != game.BotSeat || game.State != InProgress {
+		return
+	}
 
-				// If game is finished
-				if game.State == Finished {
-					gameManager.CompleteGame(game.ID)
-
-					winner := ""
-					if game.Winner == Player1 {
-						winner = game.Player1
-					} else if game.Winner == Player2 {
-						winner = game.Player2
-					}
-
-					eventProducer.PublishEvent(Event{
-						Type:      "GAME_ENDED",
-						GameID:    game.ID,
-						Winner:    winner,
-						IsDraw:    game.IsDraw,
-						Timestamp: time.Now(),
-					})
+	bot := NewBotPlayerWithDifficulty(game.BotDifficulty)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		botMove, botKind := bot.GetMove(game)
+		if botMove != -1 {
+			game.mu.Lock()
+			defer game.mu.Unlock()
+
+			// The game may have ended while the bot was thinking
+			if err := game.PlayMove(botKind, botMove, game.BotSeat); err != nil {
+				if err == errTimeUp {
+					broadcastGameUpdate(game)
+					completeGame(game)
 				}
+				return
+			}
+			appendLog(game, LogMove)
+
+			// Emit move made event
+			eventProducer.PublishEvent(Event{
+				Type:      "MOVE_MADE",
+				GameID:    game.ID,
+				Player:    "Bot",
+				Column:    &botMove,
+				MoveKind:  string(botKind),
+				Timestamp: time.Now(),
+			})
+
+			// Send the move
+			broadcastMove(game)
+
+			// If game is finished
+			if game.State == Finished {
+				completeGame(game)
+			} else {
+				scheduleFlagCheck(game)
 			}
-		}()
+		}
+	}()
+}
+
+// scheduleFlagCheck arms the game's timer to end it on time if the player to
+// move lets their clock run out. It is called whenever the turn changes, with
+// the game's lock held.
+func scheduleFlagCheck(game *Game) {
+	if game.flagTimer != nil {
+		game.flagTimer.Stop()
+	}
+	if !game.TimeControl.IsTimed() || game.State != InProgress || game.Paused {
+		return
+	}
+
+	game.flagTimer = time.AfterFunc(game.RemainingTime(game.CurrentTurn), func() {
+		game.mu.Lock()
+		defer game.mu.Unlock()
+
+		// A move made since the timer was armed leaves time on the clock
+		if !game.CheckFlag() {
+			return
+		}
+		broadcastGameUpdate(game)
+		completeGame(game)
+	})
+}
+
+// completeGame moves a finished game to the completed games and emits
+// GAME_ENDED. The caller must hold the game's lock.
+func completeGame(game *Game) {
+	gameManager.CompleteGame(game.ID)
+	ratingSystem.RecordGame(game)
+
+	eventProducer.PublishEvent(Event{
+		Type:      "GAME_ENDED",
+		GameID:    game.ID,
+		Winner:    game.WinnerName(),
+		IsDraw:    game.IsDraw,
+		Reason:    string(game.EndReason),
+		Timestamp: time.Now(),
+	})
+}
+
+// handleResign handles a player resigning the game
+func handleResign(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	if err := game.Forfeit(player, EndReasonResignation); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+
+	broadcastGameUpdate(game)
+	completeGame(game)
+}
+
+// handleOfferDraw handles a player offering a draw. The bot always declines.
+func handleOfferDraw(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	if err := game.OfferDraw(player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+
+	if game.IsBotGame {
+		game.DeclineDraw(game.BotSeat)
+		publishGameEvent(game, toPlayer(player), "DRAW_DECLINED",
+			DrawDeclinedPayload{PlayerNotice{GameID: game.ID, Username: game.playerName(game.BotSeat)}})
+		return
+	}
+	appendLog(game, LogDrawOffer)
+
+	publishGameEvent(game, toPlayer(opponent(player)), "DRAW_OFFERED",
+		DrawOfferedPayload{PlayerNotice{GameID: game.ID, Username: conn.username}})
+	broadcastGameUpdate(game)
+}
+
+// handleAcceptDraw handles a player accepting their opponent's draw offer
+func handleAcceptDraw(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	if err := game.AcceptDraw(player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+
+	broadcastGameUpdate(game)
+	completeGame(game)
+}
+
+// handleDeclineDraw handles a player declining their opponent's draw offer
+func handleDeclineDraw(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
 	}
+	defer game.mu.Unlock()
+
+	if err := game.DeclineDraw(player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+	appendLog(game, LogDrawOffer)
+
+	publishGameEvent(game, toPlayer(opponent(player)), "DRAW_DECLINED",
+		DrawDeclinedPayload{PlayerNotice{GameID: game.ID, Username: conn.username}})
+	broadcastGameUpdate(game)
+}
+
+// handleTakebackRequest handles a player asking to take back their last move.
+// The bot accepts at once; a human opponent is asked to accept.
+func handleTakebackRequest(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	if game.IsBotGame && game.CurrentTurn == game.BotSeat {
+		sendError(conn, ErrIllegalAction, "wait for the bot to move")
+		return
+	}
+
+	if err := game.RequestTakeback(player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+
+	if game.IsBotGame {
+		applyTakeback(game, game.BotSeat)
+		return
+	}
+	appendLog(game, LogTakebackRequest)
+
+	publishGameEvent(game, toPlayer(opponent(player)), "TAKEBACK_REQUEST", TakebackRequestedPayload{PlayerNotice{
+		GameID:   game.ID,
+		Username: conn.username,
+	}})
+	broadcastGameUpdate(game)
+}
+
+// handleTakebackAccept handles a player accepting their opponent's takeback request
+func handleTakebackAccept(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	applyTakeback(game, player)
 }
 
-// handleReconnect handles a player reconnecting
-func handleReconnect(conn *Connection, msg *Message) {
+// applyTakeback accepts a pending takeback on behalf of player and updates both sides
+func applyTakeback(game *Game, player Player) {
+	requester := game.Player1
+	if player == Player1 {
+		requester = game.Player2
+	}
+
+	moves := game.Moves
+	if err := game.AcceptTakeback(player); err != nil {
+		if conn := game.connFor(player); conn != nil {
+			sendError(conn, ErrIllegalAction, err.Error())
+		}
+		return
+	}
+	appendLog(game, LogTakeback)
+
+	undone := make([]Move, 0, len(moves)-len(game.Moves))
+	for i := len(moves) - 1; i >= len(game.Moves); i-- {
+		undone = append(undone, moves[i])
+	}
+
+	eventProducer.PublishEvent(Event{
+		Type:      "TAKEBACK",
+		GameID:    game.ID,
+		Player:    requester,
+		Timestamp: time.Now(),
+	})
+
+	scheduleFlagCheck(game)
+	broadcastTakeback(game, undone)
+}
+
+// findPlayerGame looks up the game a message refers to and the seat the
+// connection holds in it, sending an error to the connection if either is
+// missing. The game is returned locked; the caller must unlock it.
+func findPlayerGame(conn *Connection, gameID string) (*Game, Player, bool) {
+	// 🔒 Fallback: use connection gameID if client didn't send it yet
+	if gameID == "" {
+		gameID = conn.GameID()
+	}
+
+	if gameID == "" {
+		sendError(conn, ErrInvalidPayload, "game ID is required")
+		return nil, Empty, false
+	}
+
+	game, exists := gameManager.GetGame(gameID)
+
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return nil, Empty, false
+	}
+
+	if game.IsSpectator(conn) {
+		sendError(conn, ErrNotAPlayer, "spectators cannot play in this game")
+		return nil, Empty, false
+	}
+
+	game.mu.Lock()
+
+	// Determine which player the connection is
+	if player := game.seatOf(conn); player != Empty {
+		return game, player, true
+	}
+
+	// The players' names are only read under the lock, as a guest joining a
+	// room sets them
+	superseded := conn.username != "" && (game.Player1 == conn.username || game.Player2 == conn.username)
+	game.mu.Unlock()
+	if superseded {
+		sendError(conn, ErrSeatTaken, "another connection has taken over your seat in this game")
+	} else {
+		sendError(conn, ErrNotAPlayer, "you are not a player in this game")
+	}
+	return nil, Empty, false
+}
+
+// handleReconnect handles a player reconnecting with the session token they
+// were given when they joined. The token is replaced with a new one, and the
+// connection that held the seat before, if any, is told it has been superseded.
+func handleReconnect(conn *Connection, p *ReconnectPayload) {
 	var game *Game
 	var exists bool
 
-	if msg.GameID != "" {
-		game, exists = gameManager.GetGame(msg.GameID)
-	} else if msg.Username != "" {
-		game, exists = gameManager.GetGameByUsername(msg.Username)
+	if p.GameID != "" {
+		game, exists = gameManager.GetGame(p.GameID)
 	} else {
-		sendError(conn, "game ID or username is required")
-		return
+		game, exists = gameManager.GetGameByUsername(conn.username)
 	}
 
 	if !exists {
-		sendError(conn, "game not found")
+		sendError(conn, ErrGameNotFound, "game not found")
 		return
 	}
 
-	// Update connection
-	if game.Player1 == msg.Username {
-		game.Player1Conn = conn
-	} else if game.Player2 == msg.Username {
-		game.Player2Conn = conn
-	} else {
-		sendError(conn, "you are not a player in this game")
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	now := time.Now()
+	player, err := game.seatForToken(p.Token, now)
+	if err == nil && game.playerName(player) != conn.username {
+		err = errSessionInvalid
+	}
+	if err != nil {
+		sendError(conn, sessionErrorCode(err), err.Error())
 		return
 	}
 
-	conn.username = msg.Username
-	conn.gameID = game.ID
+	token, err := game.renewSession(player, now)
+	if err != nil {
+		sendError(conn, ErrInternal, "could not start a session")
+		return
+	}
+	appendLog(game, LogSession)
+
+	// Update connection
+	if previous := game.connFor(player); previous != nil && previous != conn {
+		previous.SetGameID("")
+		sendMessage(previous, "SESSION_SUPERSEDED", SessionSupersededPayload{GameID: game.ID})
+	}
+	game.setConn(player, conn)
+	conn.SetGameID(game.ID)
 
 	// Send current game state
 	sendGameState(game, conn)
 
-	response := Message{
-		Type:   "RECONNECTED",
-		GameID: game.ID,
+	sendMessage(conn, "RECONNECTED", ReconnectedPayload{GameID: game.ID, Token: token})
+
+	// A game recovered after a restart carries on once both players are back
+	if game.Resume(time.Now()) {
+		broadcastGameUpdate(game)
+		scheduleFlagCheck(game)
+		scheduleBotMove(game)
 	}
-	sendMessage(conn, &response)
 }
 
 // handleGetLeaderboard handles leaderboard requests
 func handleGetLeaderboard(conn *Connection) {
-	leaderboard := gameManager.GetLeaderboard()
-	response := Message{
-		Type: "LEADERBOARD",
-		Data: leaderboard,
-	}
-	sendMessage(conn, &response)
+	sendMessage(conn, "LEADERBOARD", ratingSystem.GetLeaderboard())
+}
+
+// broadcastGameUpdate sends the game's status to both players and every
+// spectator as a game event, after a change that leaves the board as it is.
+// The caller must hold the game's lock.
+func broadcastGameUpdate(game *Game) {
+	publishGameEvent(game, ToEveryone, "GAME_UPDATED", GameUpdatedPayload{GameID: game.ID, GameStatus: gameStatus(game)})
 }
 
-// sendGameState sends the current game state to a connection
+// sendGameState sends a snapshot of the current game state to a connection,
+// numbered with the game's latest event. The caller must hold the game's lock.
 func sendGameState(game *Game, conn *Connection) {
 	if conn == nil {
 		return
 	}
+	sendEnvelope(conn, outgoingEnvelope{Seq: game.seq, Type: "GAME_STATE", Payload: gameResponse(game)})
+}
 
-	// Convert board to int array for JSON
-	board := make([][]int, BoardHeight)
-	for r := 0; r < BoardHeight; r++ {
-		board[r] = make([]int, BoardWidth)
-		for c := 0; c < BoardWidth; c++ {
-			board[r][c] = int(game.Board[r][c])
-		}
+// gameResponse returns the full game state sent to clients. The caller must
+// hold the game's lock.
+func gameResponse(game *Game) GameResponse {
+	board := game.Board()
+	moves := game.Moves
+	if moves == nil {
+		moves = []Move{}
 	}
+	return GameResponse{
+		GameID:         game.ID,
+		Player1:        game.Player1,
+		Player2:        game.Player2,
+		Width:          game.Width,
+		Height:         game.Height,
+		WinLength:      game.WinLength,
+		Variant:        string(game.Variant),
+		Board:          boardToInts(board),
+		BoardHash:      boardHash(board),
+		IsBotGame:      game.IsBotGame,
+		BotDifficulty:  string(game.BotDifficulty),
+		Rated:          game.Rated,
+		Moves:          moves,
+		MoveString:     game.MoveString(),
+		Position:       game.PositionString(),
+		StartPosition:  game.StartPosition,
+		TimeControl:    game.TimeControl.String(),
+		PreviousGameID: game.PreviousGameID,
+		GameStatus:     gameStatus(game),
+	}
+}
 
+// gameStatus returns the part of the game state that changes besides the
+// board. The caller must hold the game's lock.
+func gameStatus(game *Game) GameStatus {
 	stateStr := "waiting"
 	if game.State == InProgress {
 		stateStr = "inProgress"
@@ -250,36 +611,34 @@ func sendGameState(game *Game, conn *Connection) {
 		stateStr = "finished"
 	}
 
-	gameResp := GameResponse{
-		GameID:      game.ID,
-		Player1:     game.Player1,
-		Player2:     game.Player2,
-		Board:       [BoardHeight][BoardWidth]int{},
-		CurrentTurn: int(game.CurrentTurn),
-		State:       stateStr,
-		Winner:      int(game.Winner),
-		IsDraw:      game.IsDraw,
-		IsBotGame:   game.IsBotGame,
-	}
-
-	// Copy board
-	for r := 0; r < BoardHeight; r++ {
-		for c := 0; c < BoardWidth; c++ {
-			gameResp.Board[r][c] = int(game.Board[r][c])
-		}
-	}
-
-	response := Message{
-		Type:   "GAME_STATE",
-		Data:   gameResp,
-		GameID: game.ID,
+	return GameStatus{
+		CurrentTurn:         int(game.CurrentTurn),
+		State:               stateStr,
+		Winner:              int(game.Winner),
+		IsDraw:              game.IsDraw,
+		TakebackRequestedBy: int(game.TakebackRequestedBy),
+		DrawOfferedBy:       int(game.DrawOfferedBy),
+		EndReason:           string(game.EndReason),
+		Player1TimeMs:       game.RemainingTime(Player1).Milliseconds(),
+		Player2TimeMs:       game.RemainingTime(Player2).Milliseconds(),
+		RematchGameID:       game.RematchGameID,
+		RematchRequestedBy:  int(game.RematchRequestedBy),
+		Series:              game.Series(),
+		Spectators:          game.SpectatorCount(),
+		Paused:              game.Paused,
 	}
-	sendMessage(conn, &response)
 }
 
 // sendMessage sends a message to a connection
-func sendMessage(conn *Connection, msg *Message) {
-	data, err := json.Marshal(msg)
+func sendMessage(conn *Connection, msgType string, payload interface{}) {
+	sendEnvelope(conn, outgoingEnvelope{Type: msgType, Payload: payload})
+}
+
+// sendEnvelope sends an envelope to a connection in the connection's protocol
+// version and encoding
+func sendEnvelope(conn *Connection, env outgoingEnvelope) {
+	env.V = conn.version
+	data, err := conn.encoding.marshal(env)
 	if err != nil {
 		log.Printf("error marshaling message: %v", err)
 		return
@@ -288,15 +647,11 @@ func sendMessage(conn *Connection, msg *Message) {
 	select {
 	case conn.send <- data:
 	default:
-		log.Printf("connection send buffer full")
+		log.Printf("connection send buffer full, dropping %s", env.Type)
 	}
 }
 
 // sendError sends an error message to a connection
-func sendError(conn *Connection, errorMsg string) {
-	response := Message{
-		Type:  "ERROR",
-		Error: errorMsg,
-	}
-	sendMessage(conn, &response)
+func sendError(conn *Connection, code ErrorCode, message string) {
+	sendMessage(conn, "ERROR", ErrorPayload{Code: code, Message: message})
 }
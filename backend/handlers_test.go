@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// startTestGame starts a game between alice and bob on the given connections
+// with the given rules
+func startTestGame(t *testing.T, opts GameOptions) (game *Game, alice, bob *Connection) {
+	t.Helper()
+	game = newTestGame(t, opts)
+	alice, bob = newTestConnection("alice"), newTestConnection("bob")
+	game.Player1Conn, game.Player2Conn = alice, bob
+	gameManager.AddGame(game)
+	return game, alice, bob
+}
+
+func TestFindPlayerGameErrors(t *testing.T) {
+	useTestGlobals(t)
+	alice, bob, carol := newTestConnection("alice"), newTestConnection("bob"), newTestConnection("carol")
+
+	created := createTestRoom(t, alice, &CreateRoomPayload{})
+
+	// Someone outside the game is turned away while the guest is seated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleJoinRoom(bob, &JoinRoomPayload{Code: created.Code})
+	}()
+	for i := 0; i < 100; i++ {
+		handleMove(carol, created.GameID, 0, MoveDrop)
+	}
+	<-done
+	if code := lastError(t, carol); code != ErrNotAPlayer {
+		t.Fatalf("stranger got %q, want %s", code, ErrNotAPlayer)
+	}
+
+	// A second connection for a seated player has lost the seat to the first
+	handleMove(newTestConnection("alice"), created.GameID, 0, MoveDrop)
+	superseded := newTestConnection("bob")
+	handleResign(superseded, created.GameID)
+	if code := lastError(t, superseded); code != ErrSeatTaken {
+		t.Fatalf("superseded connection got %q, want %s", code, ErrSeatTaken)
+	}
+
+	// The connections holding the seats still play
+	handleMove(alice, created.GameID, 0, MoveDrop)
+	if code := lastError(t, alice); code != "" {
+		t.Fatalf("seated player got %s", code)
+	}
+}
+
+// lastStatus returns the status in the last GAME_UPDATED sent to the connection
+func lastStatus(t *testing.T, conn *Connection) GameStatus {
+	t.Helper()
+	var update GameUpdatedPayload
+	for _, m := range sent(t, conn) {
+		if m.Type == "GAME_UPDATED" {
+			json.Unmarshal(m.Payload, &update)
+		}
+	}
+	if update.GameID == "" {
+		t.Fatalf("%s got no GAME_UPDATED", conn.username)
+	}
+	return update.GameStatus
+}
+
+func TestResign(t *testing.T) {
+	useTestGlobals(t)
+	game, alice, bob := startTestGame(t, DefaultGameOptions())
+	handleMove(alice, game.ID, 3, MoveDrop)
+
+	// A player can resign while it is their opponent's turn
+	handleResign(alice, game.ID)
+	if game.State != Finished || game.Winner != Player2 || game.IsDraw || game.EndReason != EndReasonResignation || game.WinnerName() != "bob" {
+		t.Fatalf("game %v won by %d (%q), draw %v, by %q; want won by bob by resignation", game.State, game.Winner, game.WinnerName(), game.IsDraw, game.EndReason)
+	}
+	if status := lastStatus(t, bob); status.Winner != int(Player2) || status.EndReason != string(EndReasonResignation) {
+		t.Fatalf("opponent told the game was won by %d by %q", status.Winner, status.EndReason)
+	}
+	aliceRating, _, _ := gameStore.GetPlayer("alice")
+	bobRating, _, _ := gameStore.GetPlayer("bob")
+	if aliceRating.Losses != 1 || bobRating.Wins != 1 {
+		t.Fatalf("alice %+v, bob %+v; want a rated loss and win", aliceRating, bobRating)
+	}
+
+	handleResign(bob, game.ID)
+	if code := lastError(t, bob); code != ErrIllegalAction {
+		t.Fatalf("resigning a finished game got %q, want %s", code, ErrIllegalAction)
+	}
+}
+
+func TestDrawOffers(t *testing.T) {
+	useTestGlobals(t)
+	game, alice, bob := startTestGame(t, DefaultGameOptions())
+
+	// The offerer cannot accept their own offer
+	handleOfferDraw(alice, game.ID)
+	if messages := sent(t, bob); len(messages) == 0 || messages[0].Type != "DRAW_OFFERED" {
+		t.Fatalf("opponent got %v, want DRAW_OFFERED", messages)
+	}
+	handleAcceptDraw(alice, game.ID)
+	if code := lastError(t, alice); code != ErrIllegalAction || game.State != InProgress {
+		t.Fatalf("accepting own offer got %q with the game %v, want %s", code, game.State, ErrIllegalAction)
+	}
+
+	// The offer is gone once the offerer moves
+	handleMove(alice, game.ID, 3, MoveDrop)
+	if game.DrawOfferedBy != Empty {
+		t.Fatalf("offer by %d stands after the offerer moved", game.DrawOfferedBy)
+	}
+	handleAcceptDraw(bob, game.ID)
+	if code := lastError(t, bob); code != ErrIllegalAction || game.State != InProgress {
+		t.Fatalf("accepting a withdrawn offer got %q with the game %v, want %s", code, game.State, ErrIllegalAction)
+	}
+
+	// and once the opponent moves instead of answering
+	handleOfferDraw(alice, game.ID)
+	handleMove(bob, game.ID, 3, MoveDrop)
+	if game.DrawOfferedBy != Empty {
+		t.Fatalf("offer by %d stands after the opponent moved", game.DrawOfferedBy)
+	}
+
+	// An accepted offer draws the game, which counts as a rated draw
+	handleOfferDraw(bob, game.ID)
+	handleAcceptDraw(alice, game.ID)
+	if game.State != Finished || !game.IsDraw || game.Winner != Empty || game.EndReason != EndReasonAgreedDraw {
+		t.Fatalf("game %v, draw %v, winner %d, by %q; want an agreed draw", game.State, game.IsDraw, game.Winner, game.EndReason)
+	}
+	if status := lastStatus(t, bob); !status.IsDraw || status.EndReason != string(EndReasonAgreedDraw) {
+		t.Fatalf("offerer told the game was drawn %v by %q", status.IsDraw, status.EndReason)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		rating, _, _ := gameStore.GetPlayer(username)
+		if rating.Draws != 1 || rating.GamesPlayed() != 1 || rating.Deviation >= DefaultDeviation {
+			t.Fatalf("%s %+v, want one rated draw", username, rating)
+		}
+	}
+	if record, found, _ := gameStore.GetGame(game.ID); !found || !record.IsDraw || !record.RatingsRecorded {
+		t.Fatalf("stored game found %v, draw %v, rated %v; want a rated draw", found, record.IsDraw, record.RatingsRecorded)
+	}
+}
@@ -6,15 +6,25 @@ import (
 
 // Event represents a game event
 type Event struct {
-	Type      string    `json:"type"`
-	GameID    string    `json:"gameId,omitempty"`
-	Player1   string    `json:"player1,omitempty"`
-	Player2   string    `json:"player2,omitempty"`
-	Player    string    `json:"player,omitempty"`
-	Column    int       `json:"column,omitempty"`
-	Winner    string    `json:"winner,omitempty"`
-	IsDraw    bool      `json:"isDraw,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
+	Type       string `json:"type"`
+	GameID     string `json:"gameId,omitempty"`
+	Player1    string `json:"player1,omitempty"`
+	Player2    string `json:"player2,omitempty"`
+	Player     string `json:"player,omitempty"`
+	Column     *int   `json:"column,omitempty"`
+	MoveKind   string `json:"moveKind,omitempty"`
+	Winner     string `json:"winner,omitempty"`
+	IsDraw     bool   `json:"isDraw,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Difficulty string `json:"difficulty,omitempty"`
+	// PreviousGameID is set on GAME_STARTED for a rematch
+	PreviousGameID string `json:"previousGameId,omitempty"`
+	// ChatLength is how many characters the line sent in a CHAT event has,
+	// and ChatFiltered whether the chat filter masked any of them. The text
+	// itself is never published.
+	ChatLength   int       `json:"chatLength,omitempty"`
+	ChatFiltered bool      `json:"chatFiltered,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
 }
 
 // EventProducer simulates a Kafka producer using Go channels
@@ -1,23 +1,65 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
 var (
 	eventProducer *EventProducer
+	config        = DefaultConfig()
 )
 
 func main() {
+	config = LoadConfig()
+
+	if config.ChatWordList != "" {
+		filter, err := LoadWordListFilter(config.ChatWordList)
+		if err != nil {
+			log.Fatalf("loading chat word list: %v", err)
+		}
+		chatFilter = filter
+	}
+
+	if err := loadAuthSecret(config.AuthSecret); err != nil {
+		log.Fatalf("creating auth secret: %v", err)
+	}
+
+	if config.StorePath != "" {
+		store, err := OpenBoltGameStore(config.StorePath)
+		if err != nil {
+			log.Fatalf("opening game store: %v", err)
+		}
+		gameStore = store
+		log.Printf("Keeping finished games in %s", config.StorePath)
+	}
+
 	// Initialize event producer (simulated Kafka)
 	eventProducer = NewEventProducer(1000)
 
 	// Start analytics consumer
 	go startAnalyticsConsumer()
 
+	// Pick up the games that were in progress when the server last stopped
+	gameManager.RecoverGames()
+	gameManager.RunCheckpoints(config.SnapshotInterval)
+
+	// Start the background sweeps only now, as they read the config and the
+	// game store
+	gameManager.CheckDisconnections()
+	matchmakingQueue.RunMatchmaking()
+	roomManager.ExpireIdleRooms()
+	gameManager.RunRetention()
+
 	// Initialize connection manager
 	connManager := NewConnectionManager()
 	go connManager.run()
@@ -25,6 +67,13 @@ func main() {
 	// HTTP routes
 	http.HandleFunc("/ws", serveWS(connManager))
 	http.HandleFunc("/leaderboard", handleLeaderboardHTTP)
+	http.HandleFunc("/games", handleLiveGamesHTTP)
+	http.HandleFunc("/games/", handleGamesHTTP)
+	http.HandleFunc("/rooms/", handleRoomHTTP)
+	http.HandleFunc("/register", handleRegisterHTTP)
+	http.HandleFunc("/login", handleLoginHTTP)
+	http.HandleFunc("/guest", handleGuestHTTP)
+	http.HandleFunc("/protocol/schema", handleSchemaHTTP)
 	http.HandleFunc("/health", handleHealth)
 
 	// Serve frontend
@@ -33,8 +82,36 @@ func main() {
 	fs := http.FileServer(http.Dir(frontendPath))
 	http.Handle("/", fs)
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Println("Server starting on :8080")
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	shutdown(server)
+}
+
+// shutdown stops taking requests, checkpoints the games in progress and
+// closes the game store, so the database file is left closed cleanly
+func shutdown(server *http.Server) {
+	log.Println("Server shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping the server: %v", err)
+	}
+
+	gameManager.checkpoint()
+	if closer, ok := gameStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing game store: %v", err)
+		}
+	}
 }
 
 // handleLeaderboardHTTP handles HTTP requests for leaderboard
@@ -42,7 +119,7 @@ func handleLeaderboardHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	leaderboard := gameManager.GetLeaderboard()
+	leaderboard := ratingSystem.GetLeaderboard()
 	json.NewEncoder(w).Encode(leaderboard)
 }
 
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// useTestGlobals gives the test fresh games, rooms, queue, ratings, game store
+// and event producer and the default config. Everything it replaces, and the
+// archive, chat filter and auth secret tests may also change, is put back
+// when the test ends.
+func useTestGlobals(t *testing.T) {
+	savedGames, savedRooms, savedQueue, savedRatings := gameManager, roomManager, matchmakingQueue, ratingSystem
+	savedStore, savedProducer, savedConfig := gameStore, eventProducer, config
+	savedSink, savedFilter, savedSecret := archiveSink, chatFilter, authSecret
+	t.Cleanup(func() {
+		gameManager, roomManager, matchmakingQueue, ratingSystem = savedGames, savedRooms, savedQueue, savedRatings
+		gameStore, eventProducer, config = savedStore, savedProducer, savedConfig
+		archiveSink, chatFilter, authSecret = savedSink, savedFilter, savedSecret
+	})
+
+	gameManager = NewGameManager()
+	roomManager = NewRoomManager()
+	matchmakingQueue = NewMatchmakingQueue()
+	ratingSystem = NewRatingSystem()
+	gameStore = NewMemoryGameStore()
+	eventProducer = NewEventProducer(1000)
+	config = DefaultConfig()
+}
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Matchmaking pairs players with the closest rating. Two waiting players can
+// be paired when their rating gap is within the window of whichever has
+// waited longer; the window starts at RatingWindowBase and grows by
+// RatingWindowGrowth for every second spent waiting. A player still waiting
+// after MatchmakingTimeout plays the bot.
+const (
+	RatingWindowBase   = 100.0
+	RatingWindowGrowth = 25.0
+	MatchSweepInterval = time.Second
+	MatchmakingTimeout = 10 * time.Second
+)
+
 // MatchmakingQueue manages the queue of waiting players
 type MatchmakingQueue struct {
 	waitingPlayers map[string]*WaitingPlayer
@@ -15,7 +29,13 @@ type MatchmakingQueue struct {
 type WaitingPlayer struct {
 	Username string
 	Conn     *Connection
-	GameID   string
+	// Session is the session the player will reconnect to the game with
+	Session    Session
+	GameID     string
+	Options    GameOptions
+	Difficulty Difficulty
+	// Rating is the player's rating when they joined the queue
+	Rating   float64
 	JoinedAt time.Time
 }
 
@@ -25,104 +45,235 @@ func NewMatchmakingQueue() *MatchmakingQueue {
 	}
 }
 
-// AddPlayer adds a player to the matchmaking queue
-func (mq *MatchmakingQueue) AddPlayer(username string, conn *Connection) string {
+// ratingWindow returns the rating gap a player accepts after waiting since joinedAt
+func ratingWindow(joinedAt, now time.Time) float64 {
+	return RatingWindowBase + RatingWindowGrowth*now.Sub(joinedAt).Seconds()
+}
+
+// AddPlayer adds a player to the matchmaking queue. The player is paired at
+// once with the closest-rated opponent in range who chose the same options,
+// or waits for the periodic sweep to find one. The difficulty is used for the
+// bot if no opponent is found before the timeout.
+func (mq *MatchmakingQueue) AddPlayer(username string, conn *Connection, session Session, opts GameOptions, difficulty Difficulty) string {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
 
-	// Check if player is already waiting
+	now := time.Now()
+
+	// Check if player is already waiting. The latest connection to join
+	// takes their place in the queue with the options it chose, which may
+	// match someone new.
 	if wp, exists := mq.waitingPlayers[username]; exists {
+		wp.Conn = conn
+		wp.Session = session
+		wp.Options = opts
+		wp.Difficulty = difficulty
+		if opponent := mq.findOpponent(wp, now); opponent != nil {
+			if wp.JoinedAt.Before(opponent.JoinedAt) {
+				return mq.startGame(wp, opponent)
+			}
+			return mq.startGame(opponent, wp)
+		}
 		return wp.GameID
 	}
 
+	wp := &WaitingPlayer{
+		Username:   username,
+		Conn:       conn,
+		Session:    session,
+		Options:    opts,
+		Difficulty: difficulty,
+		Rating:     ratingSystem.Rating(username),
+		JoinedAt:   now,
+	}
+
 	// Try to find an opponent
-	for otherUsername, otherPlayer := range mq.waitingPlayers {
-		if otherUsername != username {
-
-			// ✅ USE THE SAME GAME ID (KEY FIX)
-			gameID := otherPlayer.GameID
-
-			game := NewGame(gameID, otherPlayer.Username)
-			game.Player1Conn = otherPlayer.Conn
-			game.Player2Conn = conn
-			game.StartGame(username)
-			game.State = InProgress
-
-			// Remove waiting player
-			delete(mq.waitingPlayers, otherUsername)
-
-			// Add game to game manager
-			gameManager.AddGame(game)
-
-			// Notify both players
-			sendGameState(game, game.Player1Conn)
-			sendGameState(game, game.Player2Conn)
-
-			// Emit game started event
-			eventProducer.PublishEvent(Event{
-				Type:      "GAME_STARTED",
-				GameID:    gameID,
-				Player1:   otherPlayer.Username,
-				Player2:   username,
-				Timestamp: time.Now(),
-			})
-
-			return gameID
-		}
+	if opponent := mq.findOpponent(wp, now); opponent != nil {
+		return mq.startGame(opponent, wp)
 	}
 
 	// No opponent found, add to queue
-	gameID := generateGameID()
-	mq.waitingPlayers[username] = &WaitingPlayer{
-		Username: username,
-		Conn:     conn,
-		GameID:   gameID,
-		JoinedAt: time.Now(),
-	}
+	wp.GameID = generateGameID()
+	mq.waitingPlayers[username] = wp
 
 	// Start timeout goroutine
-	go mq.startMatchmakingTimeout(username, gameID)
+	go mq.startMatchmakingTimeout(username, wp.GameID)
+
+	return wp.GameID
+}
+
+// findOpponent returns the best opponent for wp among the waiting players, or
+// nil if none is in range. The caller must hold the lock.
+func (mq *MatchmakingQueue) findOpponent(wp *WaitingPlayer, now time.Time) *WaitingPlayer {
+	var best *WaitingPlayer
+	for _, other := range mq.waitingPlayers {
+		if other.Username == wp.Username || other.Options != wp.Options {
+			continue
+		}
+
+		gap := math.Abs(other.Rating - wp.Rating)
+		window := math.Max(ratingWindow(wp.JoinedAt, now), ratingWindow(other.JoinedAt, now))
+		if gap > window {
+			continue
+		}
+
+		if best == nil || betterOpponent(wp, other, best) {
+			best = other
+		}
+	}
+	return best
+}
+
+// betterOpponent reports whether a is a better opponent for wp than b: a
+// smaller rating gap first, then the longer wait, then the username, so the
+// choice never depends on map iteration order
+func betterOpponent(wp, a, b *WaitingPlayer) bool {
+	gapA := math.Abs(a.Rating - wp.Rating)
+	gapB := math.Abs(b.Rating - wp.Rating)
+	if gapA != gapB {
+		return gapA < gapB
+	}
+	if !a.JoinedAt.Equal(b.JoinedAt) {
+		return a.JoinedAt.Before(b.JoinedAt)
+	}
+	return a.Username < b.Username
+}
+
+// RunMatchmaking periodically pairs waiting players whose windows have
+// widened enough for them to match
+func (mq *MatchmakingQueue) RunMatchmaking() {
+	ticker := time.NewTicker(MatchSweepInterval)
+	go func() {
+		for range ticker.C {
+			mq.matchWaitingPlayers(time.Now())
+		}
+	}()
+}
+
+// matchWaitingPlayers pairs every waiting player it can, longest-waiting first
+func (mq *MatchmakingQueue) matchWaitingPlayers(now time.Time) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	queue := make([]*WaitingPlayer, 0, len(mq.waitingPlayers))
+	for _, wp := range mq.waitingPlayers {
+		queue = append(queue, wp)
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		if !queue[i].JoinedAt.Equal(queue[j].JoinedAt) {
+			return queue[i].JoinedAt.Before(queue[j].JoinedAt)
+		}
+		return queue[i].Username < queue[j].Username
+	})
+
+	for _, wp := range queue {
+		// Already paired earlier in this sweep
+		if _, waiting := mq.waitingPlayers[wp.Username]; !waiting {
+			continue
+		}
+		if opponent := mq.findOpponent(wp, now); opponent != nil {
+			mq.startGame(wp, opponent)
+		}
+	}
+}
+
+// startGame starts a game between two matched players and removes them from
+// the queue. The host has waited longer; they play first and the game keeps
+// their game ID. The caller must hold the lock.
+func (mq *MatchmakingQueue) startGame(host, guest *WaitingPlayer) string {
+	// Keep the game ID the host was given at JOIN
+	gameID := host.GameID
+
+	game := NewGame(gameID, host.Username, host.Options)
+	game.Player1Conn = host.Conn
+	game.Player2Conn = guest.Conn
+	game.sessions = [2]Session{host.Session, guest.Session}
+	game.StartGame(guest.Username)
+	game.State = InProgress
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	// Remove both players from the queue
+	delete(mq.waitingPlayers, host.Username)
+	delete(mq.waitingPlayers, guest.Username)
+	guest.Conn.SetGameID(gameID)
+
+	// Add game to game manager
+	gameManager.AddGame(game)
+	appendLog(game, LogGameStarted)
+
+	// Notify both players
+	sendGameState(game, game.Player1Conn)
+	sendGameState(game, game.Player2Conn)
+	scheduleFlagCheck(game)
+
+	// Emit game started event
+	eventProducer.PublishEvent(Event{
+		Type:      "GAME_STARTED",
+		GameID:    gameID,
+		Player1:   host.Username,
+		Player2:   guest.Username,
+		Timestamp: time.Now(),
+	})
 
 	return gameID
 }
 
-// startMatchmakingTimeout starts a bot game after 10 seconds if no opponent joins
+// startMatchmakingTimeout starts a bot game if no opponent joins before MatchmakingTimeout
 func (mq *MatchmakingQueue) startMatchmakingTimeout(username, gameID string) {
-	time.Sleep(10 * time.Second)
+	time.Sleep(MatchmakingTimeout)
+	mq.startBotGame(username, gameID)
+}
 
+// startBotGame starts a bot game for a player still waiting for the game with
+// the given ID
+func (mq *MatchmakingQueue) startBotGame(username, gameID string) {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
 
-	// Check if player is still waiting
-	if wp, exists := mq.waitingPlayers[username]; exists {
+	// Check if player is still waiting for this game
+	if wp, exists := mq.waitingPlayers[username]; exists && wp.GameID == gameID {
 
-		bot := NewBotPlayer()
-		game := NewGame(gameID, username)
+		bot := NewBotPlayerWithDifficulty(wp.Difficulty)
+		game := NewGame(gameID, username, wp.Options)
 		game.Player1Conn = wp.Conn
+		game.sessions[0] = wp.Session
 		game.Player2 = bot.name
 		game.IsBotGame = true
+		game.Rated = false
+		game.BotDifficulty = bot.difficulty
+		game.BotSeat = Player2
 		game.StartGame(bot.name)
 		game.State = InProgress
+		game.mu.Lock()
+		defer game.mu.Unlock()
 
 		delete(mq.waitingPlayers, username)
 
 		gameManager.AddGame(game)
+		appendLog(game, LogGameStarted)
 
 		sendGameState(game, wp.Conn)
+		scheduleFlagCheck(game)
+		scheduleBotMove(game)
 
 		eventProducer.PublishEvent(Event{
-			Type:      "GAME_STARTED",
-			GameID:    gameID,
-			Player1:   username,
-			Player2:   bot.name,
-			Timestamp: time.Now(),
+			Type:       "GAME_STARTED",
+			GameID:     gameID,
+			Player1:    username,
+			Player2:    bot.name,
+			Difficulty: string(bot.difficulty),
+			Timestamp:  time.Now(),
 		})
 	}
 }
 
-// RemovePlayer removes a player from the matchmaking queue
-func (mq *MatchmakingQueue) RemovePlayer(username string) {
+// RemovePlayer removes a player from the matchmaking queue when their
+// connection closes, unless a newer connection has taken their place
+func (mq *MatchmakingQueue) RemovePlayer(username string, conn *Connection) {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
-	delete(mq.waitingPlayers, username)
+	if wp, exists := mq.waitingPlayers[username]; exists && wp.Conn == conn {
+		delete(mq.waitingPlayers, username)
+	}
 }
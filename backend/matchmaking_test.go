@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// newTestConnection returns a connection whose messages are queued but never written
+func newTestConnection(username string) *Connection {
+	return &Connection{
+		username:     username,
+		version:      ProtocolVersion,
+		send:         make(chan []byte, 256),
+		done:         make(chan struct{}),
+		lastActivity: time.Now(),
+	}
+}
+
+// sentMessage is a message queued on a test connection
+type sentMessage struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// sent returns the messages queued on a test connection since it was last read
+func sent(t *testing.T, conn *Connection) []sentMessage {
+	t.Helper()
+	var messages []sentMessage
+	for {
+		select {
+		case data := <-conn.send:
+			var m sentMessage
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("decoding %s: %v", data, err)
+			}
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+// lastError returns the code of the last error queued on a test connection
+// since it was last read, or "" if there was none
+func lastError(t *testing.T, conn *Connection) ErrorCode {
+	t.Helper()
+	code := ErrorCode("")
+	for _, m := range sent(t, conn) {
+		if m.Type == "ERROR" {
+			var payload ErrorPayload
+			if err := json.Unmarshal(m.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			code = payload.Code
+		}
+	}
+	return code
+}
+
+// newTestQueue returns an empty queue, with fresh games and stores for the
+// games it starts
+func newTestQueue(t *testing.T) *MatchmakingQueue {
+	useTestGlobals(t)
+	return NewMatchmakingQueue()
+}
+
+// addWaiting puts a player in the queue as if they had joined at joinedAt
+func (mq *MatchmakingQueue) addWaiting(username string, rating float64, joinedAt time.Time, opts GameOptions) *WaitingPlayer {
+	wp := &WaitingPlayer{
+		Username:   username,
+		Conn:       newTestConnection(username),
+		GameID:     "game-" + username,
+		Options:    opts,
+		Difficulty: DifficultyMedium,
+		Rating:     rating,
+		JoinedAt:   joinedAt,
+	}
+	mq.waitingPlayers[username] = wp
+	return wp
+}
+
+func TestRatingWindow(t *testing.T) {
+	joinedAt := time.Now()
+	tests := []struct {
+		waited time.Duration
+		want   float64
+	}{
+		{0, RatingWindowBase},
+		{time.Second, RatingWindowBase + RatingWindowGrowth},
+		{4 * time.Second, RatingWindowBase + 4*RatingWindowGrowth},
+		{1500 * time.Millisecond, RatingWindowBase + 1.5*RatingWindowGrowth},
+	}
+	for _, tt := range tests {
+		if got := ratingWindow(joinedAt, joinedAt.Add(tt.waited)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ratingWindow after %v = %v, want %v", tt.waited, got, tt.want)
+		}
+	}
+}
+
+func TestFindOpponent(t *testing.T) {
+	now := time.Now()
+	popOut := popOutOptions()
+
+	type waiting struct {
+		username string
+		rating   float64
+		waited   time.Duration
+		opts     GameOptions
+	}
+	tests := []struct {
+		name    string
+		waiting []waiting
+		rating  float64
+		want    string
+	}{
+		{"empty queue", nil, 1500, ""},
+		{
+			"closest rating",
+			[]waiting{{"far", 1580, 0, DefaultGameOptions()}, {"near", 1490, 0, DefaultGameOptions()}},
+			1500, "near",
+		},
+		{"out of range", []waiting{{"far", 1650, 0, DefaultGameOptions()}}, 1500, ""},
+		{"different options", []waiting{{"popout", 1500, 0, popOut}}, 1500, ""},
+		{
+			"window widened by the longer wait",
+			[]waiting{{"patient", 1750, 6 * time.Second, DefaultGameOptions()}},
+			1500, "patient",
+		},
+		{
+			"tie on gap goes to the longer wait",
+			[]waiting{{"newer", 1550, time.Second, DefaultGameOptions()}, {"older", 1450, 3 * time.Second, DefaultGameOptions()}},
+			1500, "older",
+		},
+		{
+			"tie on gap and wait goes to the username",
+			[]waiting{{"zed", 1520, time.Second, DefaultGameOptions()}, {"amy", 1480, time.Second, DefaultGameOptions()}},
+			1500, "amy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mq := NewMatchmakingQueue()
+			for _, w := range tt.waiting {
+				mq.addWaiting(w.username, w.rating, now.Add(-w.waited), w.opts)
+			}
+			wp := &WaitingPlayer{Username: "newcomer", Options: DefaultGameOptions(), Rating: tt.rating, JoinedAt: now}
+
+			got := ""
+			if opponent := mq.findOpponent(wp, now); opponent != nil {
+				got = opponent.Username
+			}
+			if got != tt.want {
+				t.Fatalf("findOpponent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchWaitingPlayersOrderAndWidening(t *testing.T) {
+	mq := newTestQueue(t)
+	start := time.Now()
+	mq.addWaiting("alice", 1500, start, DefaultGameOptions())
+	mq.addWaiting("bob", 1550, start.Add(time.Second), DefaultGameOptions())
+	mq.addWaiting("carol", 1520, start.Add(2*time.Second), DefaultGameOptions())
+	mq.addWaiting("dave", 1900, start.Add(3*time.Second), DefaultGameOptions())
+
+	// Alice has waited longest, so she picks first and takes the closer Carol.
+	// Bob and Dave are too far apart for either window.
+	mq.matchWaitingPlayers(start.Add(3 * time.Second))
+	game, exists := gameManager.GetGame("game-alice")
+	if !exists || game.Player1 != "alice" || game.Player2 != "carol" {
+		t.Fatalf("want alice to host carol, got %+v", game)
+	}
+	if len(mq.waitingPlayers) != 2 {
+		t.Fatalf("want bob and dave still waiting, got %d players", len(mq.waitingPlayers))
+	}
+
+	// Bob's window has grown past the 350 point gap
+	mq.matchWaitingPlayers(start.Add(12 * time.Second))
+	game, exists = gameManager.GetGame("game-bob")
+	if !exists || game.Player1 != "bob" || game.Player2 != "dave" {
+		t.Fatalf("want bob to host dave, got %+v", game)
+	}
+	if len(mq.waitingPlayers) != 0 {
+		t.Fatalf("want nobody waiting, got %d players", len(mq.waitingPlayers))
+	}
+}
+
+func TestMatchWaitingPlayersManyArrivals(t *testing.T) {
+	mq := newTestQueue(t)
+	start := time.Now()
+
+	// Players arrive a second apart with ratings spread over 1000 points,
+	// half of them asking for PopOut
+	const players = 40
+	for i := 0; i < players; i++ {
+		opts := DefaultGameOptions()
+		if i%2 == 1 {
+			opts = popOutOptions()
+		}
+		mq.addWaiting(fmt.Sprintf("player%02d", i), 1000+float64((i*37)%1000), start.Add(time.Duration(i)*time.Second), opts)
+	}
+
+	seen := map[string]bool{}
+	for sweep := time.Duration(players); sweep <= players+60; sweep += 5 {
+		now := start.Add(sweep * time.Second)
+		waiting := make(map[string]WaitingPlayer, len(mq.waitingPlayers))
+		for username, wp := range mq.waitingPlayers {
+			waiting[username] = *wp
+		}
+
+		mq.matchWaitingPlayers(now)
+
+		for _, game := range gameManager.activeGames() {
+			if seen[game.ID] {
+				continue
+			}
+			seen[game.ID] = true
+
+			host, guest := waiting[game.Player1], waiting[game.Player2]
+			if host.Options != guest.Options {
+				t.Fatalf("%s and %s were paired with different options", host.Username, guest.Username)
+			}
+			if host.JoinedAt.After(guest.JoinedAt) {
+				t.Fatalf("%s hosts %s but joined later", host.Username, guest.Username)
+			}
+			gap := math.Abs(host.Rating - guest.Rating)
+			if gap > ratingWindow(host.JoinedAt, now) {
+				t.Fatalf("%s and %s are %v apart, outside both windows", host.Username, guest.Username, gap)
+			}
+		}
+	}
+
+	// Every window is wide enough by the last sweep, so each variant pairs off
+	if len(mq.waitingPlayers) != 0 || len(seen) != players/2 {
+		t.Fatalf("want %d games and nobody waiting, got %d games and %d waiting", players/2, len(seen), len(mq.waitingPlayers))
+	}
+}
+
+func TestAddPlayerRejoinReplacesOptions(t *testing.T) {
+	mq := newTestQueue(t)
+
+	bobID := mq.AddPlayer("bob", newTestConnection("bob"), Session{}, popOutOptions(), DifficultyMedium)
+	aliceID := mq.AddPlayer("alice", newTestConnection("alice"), Session{}, DefaultGameOptions(), DifficultyMedium)
+	if aliceID == bobID || len(mq.waitingPlayers) != 2 {
+		t.Fatal("players with different options should both wait")
+	}
+
+	// Joining again with PopOut replaces Alice's options, so she meets Bob
+	conn := newTestConnection("alice")
+	gameID := mq.AddPlayer("alice", conn, Session{}, popOutOptions(), DifficultyHard)
+	if gameID != bobID {
+		t.Fatalf("want the game of bob, who waited longer, got %q", gameID)
+	}
+	game, exists := gameManager.GetGame(gameID)
+	if !exists || game.Player1 != "bob" || game.Player2 != "alice" || game.Variant != VariantPopOut {
+		t.Fatalf("want a PopOut game of bob against alice, got %+v", game)
+	}
+	if game.Player2Conn != conn {
+		t.Fatal("want alice playing on her latest connection")
+	}
+	if len(mq.waitingPlayers) != 0 {
+		t.Fatalf("want nobody waiting, got %d players", len(mq.waitingPlayers))
+	}
+}
+
+func TestRemovePlayer(t *testing.T) {
+	mq := newTestQueue(t)
+	old := newTestConnection("alice")
+	mq.AddPlayer("alice", old, Session{}, DefaultGameOptions(), DifficultyMedium)
+	latest := newTestConnection("alice")
+	mq.AddPlayer("alice", latest, Session{}, DefaultGameOptions(), DifficultyMedium)
+
+	// The connection that was replaced closing leaves Alice waiting
+	mq.RemovePlayer("alice", old)
+	if _, waiting := mq.waitingPlayers["alice"]; !waiting {
+		t.Fatal("closing a replaced connection removed the player")
+	}
+
+	mq.RemovePlayer("alice", latest)
+	if _, waiting := mq.waitingPlayers["alice"]; waiting {
+		t.Fatal("closing the waiting connection left the player in the queue")
+	}
+}
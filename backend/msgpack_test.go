@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fillValue sets every exported field of v to a value other than its zero
+// value. n counts the values set so far, so no two fields get the same one.
+func fillValue(v reflect.Value, n *int) {
+	*n++
+	if v.Type() == timeType {
+		v.Set(reflect.ValueOf(time.Date(2024, 1, 2, 3, 4, 5, 600+*n, time.UTC)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem(), n)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		v.SetInt(int64(*n) * -37)
+	case reflect.Int64:
+		v.SetInt(-1<<40 - int64(*n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(*n) * 300)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1234.5 + float64(*n))
+	case reflect.String:
+		s := "x"
+		for i := 0; i < *n; i++ {
+			s += "é"
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < s.Len(); i++ {
+			fillValue(s.Index(i), n)
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fillValue(v.Index(i), n)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillValue(v.Field(i), n)
+			}
+		}
+	}
+}
+
+// filled returns a value of the same type as v with every field set
+func filled(v interface{}) interface{} {
+	value := reflect.New(reflect.TypeOf(v)).Elem()
+	n := 0
+	fillValue(value, &n)
+	return value.Interface()
+}
+
+// decodeGeneric decodes JSON as encoding/json decodes into an interface{}
+func decodeGeneric(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// checkServerRoundTrip sends payload in an envelope encoded as JSON and as
+// MessagePack, decodes both the way a client would and checks they are equal,
+// both as generic values and as the payload's own type. It returns the
+// message as a generic value.
+func checkServerRoundTrip(t *testing.T, msgType string, payload interface{}) interface{} {
+	t.Helper()
+	env := outgoingEnvelope{V: ProtocolVersion, Seq: 1 << 33, Type: msgType, Payload: payload}
+	jsonData, err := EncodingJSON.marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgpackData, err := EncodingMsgpack.marshal(env)
+	if err != nil {
+		t.Fatalf("encoding %s as MessagePack: %v", msgType, err)
+	}
+	converted, err := msgpackToJSON(msgpackData)
+	if err != nil {
+		t.Fatalf("decoding %s from MessagePack: %v", msgType, err)
+	}
+
+	fromJSON, fromMsgpack := decodeGeneric(t, jsonData), decodeGeneric(t, converted)
+	if !reflect.DeepEqual(fromJSON, fromMsgpack) {
+		t.Fatalf("%s differs between encodings:\nJSON:        %s\nMessagePack: %s", msgType, jsonData, converted)
+	}
+
+	typed := func(data []byte) interface{} {
+		decoded := outgoingEnvelope{Payload: reflect.New(reflect.TypeOf(payload)).Interface()}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("decoding %s: %v", msgType, err)
+		}
+		return decoded
+	}
+	if jsonEnv, msgpackEnv := typed(jsonData), typed(converted); !reflect.DeepEqual(jsonEnv, msgpackEnv) {
+		t.Fatalf("%s decodes differently:\nJSON:        %+v\nMessagePack: %+v", msgType, jsonEnv, msgpackEnv)
+	}
+	return fromJSON
+}
+
+func TestMsgpackServerPayloads(t *testing.T) {
+	for msgType, payload := range serverPayloads {
+		t.Run(msgType, func(t *testing.T) {
+			checkServerRoundTrip(t, msgType, payload)
+			checkServerRoundTrip(t, msgType, filled(payload))
+		})
+	}
+}
+
+func TestMsgpackClientPayloads(t *testing.T) {
+	for msgType, newPayload := range clientPayloads {
+		t.Run(msgType, func(t *testing.T) {
+			zero := newPayload()
+			full := newPayload()
+			n := 0
+			fillValue(reflect.ValueOf(full).Elem(), &n)
+
+			for _, payload := range []interface{}{zero, full} {
+				raw, err := json.Marshal(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				env := Envelope{V: ProtocolVersion, Type: msgType, Payload: raw}
+
+				var results [2]interface{}
+				var errs [2]*ErrorPayload
+				for i, encoding := range []Encoding{EncodingJSON, EncodingMsgpack} {
+					data, err := encoding.marshal(env)
+					if err != nil {
+						t.Fatal(err)
+					}
+					results[i], errs[i] = encoding.decode(ProtocolVersion, data)
+				}
+				if !reflect.DeepEqual(results[0], results[1]) || !reflect.DeepEqual(errs[0], errs[1]) {
+					t.Fatalf("decodes differently:\nJSON:        %+v %v\nMessagePack: %+v %v", results[0], errs[0], results[1], errs[1])
+				}
+				// A payload with every field set is valid, so it comes back as sent
+				if payload == full && (errs[1] != nil || !reflect.DeepEqual(results[1], full)) {
+					t.Fatalf("decoded %+v, %v, want %+v", results[1], errs[1], full)
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackTimePointers(t *testing.T) {
+	started := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	tests := []struct {
+		name    string
+		replay  GameReplay
+		started bool
+	}{
+		{"unset", GameReplay{}, false},
+		{"started only", GameReplay{GameID: "abc", StartedAt: &started}, true},
+		{"every field", filled(GameReplay{}).(GameReplay), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := checkServerRoundTrip(t, "REPLAY", tt.replay).(map[string]interface{})
+			payload := msg["payload"].(map[string]interface{})
+			if _, ok := payload["startedAt"]; ok != tt.started {
+				t.Fatalf("startedAt present = %v, want %v", ok, tt.started)
+			}
+		})
+	}
+}
+
+func TestMsgpackEmbeddedStatus(t *testing.T) {
+	for _, payload := range []interface{}{filled(MoveAppliedPayload{}), filled(GameResponse{}), filled(GameUpdatedPayload{})} {
+		msg := checkServerRoundTrip(t, "STATUS", payload).(map[string]interface{})
+		fields := msg["payload"].(map[string]interface{})
+		// The embedded GameStatus's fields sit beside the payload's own
+		if _, nested := fields["GameStatus"]; nested {
+			t.Fatalf("%T nests its GameStatus", payload)
+		}
+		for _, name := range []string{"currentTurn", "state", "endReason", "player1TimeMs"} {
+			if _, ok := fields[name]; !ok {
+				t.Fatalf("%T is missing %s", payload, name)
+			}
+		}
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	deep := make([]byte, 0, 2*msgpackMaxDepth)
+	for i := 0; i < 2*msgpackMaxDepth; i++ {
+		deep = append(deep, 0x91)
+	}
+	deep = append(deep, 0xc0)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"unused type", []byte{0xc1}},
+		{"map missing its value", []byte{0x81, 0xa1, 'v'}},
+		{"map with a number key", []byte{0x81, 0x01, 0x02}},
+		{"map longer than the message", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{"array longer than the message", []byte{0xdd, 0x00, 0x01, 0x00, 0x00}},
+		{"string longer than the message", []byte{0xd9, 0x05, 'a'}},
+		{"truncated integer", []byte{0xcd, 0x01}},
+		{"truncated float", []byte{0xcb, 0x00, 0x00}},
+		{"binary", []byte{0xc4, 0x01, 0x00}},
+		{"extension", []byte{0xd4, 0x01, 0x00}},
+		{"two messages", []byte{0x80, 0x80}},
+		{"nested too deeply", deep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, perr := EncodingMsgpack.decode(ProtocolVersion, tt.data); perr == nil || perr.Code != ErrMalformedMessage {
+				t.Fatalf("decode(%x) = %v, want %s", tt.data, perr, ErrMalformedMessage)
+			}
+		})
+	}
+
+	// Every prefix of a valid message is cut short
+	data, err := marshalMsgpack(Envelope{V: ProtocolVersion, Type: "CHAT", Payload: json.RawMessage(`{"gameId":"abc","text":"hello"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, perr := EncodingMsgpack.decode(ProtocolVersion, data); perr != nil {
+		t.Fatalf("decoding the whole message: %v", perr)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, perr := EncodingMsgpack.decode(ProtocolVersion, data[:n]); perr == nil || perr.Code != ErrMalformedMessage {
+			t.Fatalf("decoding %d of %d bytes = %v, want %s", n, len(data), perr, ErrMalformedMessage)
+		}
+	}
+}
+
+// bytesPayload holds byte slices, which no message has yet
+type bytesPayload struct {
+	Data  []byte `json:"data"`
+	Empty []byte `json:"empty"`
+	Unset []byte `json:"unset"`
+	Omit  []byte `json:"omit,omitempty"`
+}
+
+func TestMsgpackBytes(t *testing.T) {
+	payload := bytesPayload{Data: []byte{0, 1, 0xfe, 0xff}, Empty: []byte{}}
+	msg := checkServerRoundTrip(t, "BYTES", payload).(map[string]interface{})
+	fields := msg["payload"].(map[string]interface{})
+	want := map[string]interface{}{"data": "AAH+/w==", "empty": "", "unset": nil}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("payload = %v, want %v", fields, want)
+	}
+
+	// The bytes are sent as a MessagePack string, not bin
+	data, err := marshalMsgpack(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, append([]byte{0xa4, 'd', 'a', 't', 'a', 0xa8}, "AAH+/w=="...)) {
+		t.Fatalf("data is not a base64 string in %x", data)
+	}
+
+	b := &schemaBuilder{defs: map[string]interface{}{}}
+	schema := b.schema(reflect.TypeOf([]byte(nil)))
+	if schema["type"] != "string" || schema["contentEncoding"] != "base64" {
+		t.Fatalf("schema of []byte = %v, want a base64 string", schema)
+	}
+}
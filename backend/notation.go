@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Positions can be written in two notations.
+//
+// A move string lists the columns played from the empty board, numbered
+// from 1 ("4453"). Columns 10 to 12 are written a to c, and a PopOut pop is
+// the column prefixed with p ("44p4").
+//
+// A board string lists the rows from top to bottom separated by '/', with x
+// for a Player1 disc, o for a Player2 disc and a number for a run of empty
+// cells, followed by the player to move: "7/7/7/7/7/3x3 o". If the player to
+// move is left out it is worked out from the disc counts.
+
+const (
+	player1Symbol = 'x'
+	player2Symbol = 'o'
+	popPrefix     = 'p'
+)
+
+// columnSymbol returns the move string symbol for a column
+func columnSymbol(col int) byte {
+	if col < 9 {
+		return byte('1' + col)
+	}
+	return byte('a' + col - 9)
+}
+
+// parseColumnSymbol returns the column for a move string symbol, or -1
+func parseColumnSymbol(symbol byte) int {
+	switch {
+	case symbol >= '1' && symbol <= '9':
+		return int(symbol - '1')
+	case symbol >= 'a' && symbol <= 'c':
+		return int(symbol-'a') + 9
+	}
+	return -1
+}
+
+// MoveString returns the game's moves in move string notation. For a game
+// started from a set-up position the moves are relative to StartPosition.
+func (g *Game) MoveString() string {
+	var sb strings.Builder
+	for _, move := range g.Moves {
+		if move.Kind == MovePop {
+			sb.WriteByte(popPrefix)
+		}
+		sb.WriteByte(columnSymbol(move.Column))
+	}
+	return sb.String()
+}
+
+// PositionString returns the current position in board string notation
+func (g *Game) PositionString() string {
+	return formatBoardString(&g.board, g.CurrentTurn)
+}
+
+// formatBoardString writes a board and the player to move in board string notation
+func formatBoardString(board *Bitboard, toMove Player) string {
+	var sb strings.Builder
+	for r := 0; r < board.Height(); r++ {
+		if r > 0 {
+			sb.WriteByte('/')
+		}
+		empty := 0
+		for c := 0; c < board.Width(); c++ {
+			cell := board.Cell(r, c)
+			if cell == Empty {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				sb.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			if cell == Player1 {
+				sb.WriteByte(player1Symbol)
+			} else {
+				sb.WriteByte(player2Symbol)
+			}
+		}
+		if empty > 0 {
+			sb.WriteString(strconv.Itoa(empty))
+		}
+	}
+
+	sb.WriteByte(' ')
+	if toMove == Player2 {
+		sb.WriteByte(player2Symbol)
+	} else {
+		sb.WriteByte(player1Symbol)
+	}
+	return sb.String()
+}
+
+// ParsePosition reads a position in either notation. A move string is played
+// on a board with the dimensions in opts; a board string sets its own
+// dimensions. The win length and variant always come from opts. Positions
+// where a player has already won are rejected.
+func ParsePosition(notation string, opts GameOptions) (Bitboard, Player, error) {
+	notation = strings.TrimSpace(notation)
+	if strings.ContainsRune(notation, '/') {
+		return parseBoardString(notation, opts)
+	}
+	return parseMoveString(notation, opts)
+}
+
+// parseMoveString plays a move string from the empty board
+func parseMoveString(moves string, opts GameOptions) (Bitboard, Player, error) {
+	if err := opts.validateRules(); err != nil {
+		return Bitboard{}, Empty, err
+	}
+
+	board := NewBitboard(opts.Width, opts.Height, opts.WinLength)
+	player := Player1
+
+	for i := 0; i < len(moves); i++ {
+		kind := MoveDrop
+		if moves[i] == popPrefix {
+			if opts.Variant != VariantPopOut {
+				return Bitboard{}, Empty, errors.New("pops are only allowed in PopOut positions")
+			}
+			kind = MovePop
+			i++
+			if i == len(moves) {
+				return Bitboard{}, Empty, errors.New("move string ends with a pop and no column")
+			}
+		}
+
+		col := parseColumnSymbol(moves[i])
+		if col == -1 || col >= opts.Width {
+			return Bitboard{}, Empty, fmt.Errorf("invalid column %q in move string", moves[i])
+		}
+
+		if board.IsWin(Player1) || board.IsWin(Player2) {
+			return Bitboard{}, Empty, errors.New("move string continues after the game is won")
+		}
+
+		if kind == MovePop {
+			if !board.CanPop(col, player) {
+				return Bitboard{}, Empty, fmt.Errorf("illegal pop in column %c", moves[i])
+			}
+			board.Pop(col)
+		} else {
+			if !board.CanPlay(col) {
+				return Bitboard{}, Empty, fmt.Errorf("column %c is full", moves[i])
+			}
+			board.Play(col, player)
+		}
+		player = opponent(player)
+	}
+
+	if board.IsWin(Player1) || board.IsWin(Player2) {
+		return Bitboard{}, Empty, errors.New("position is already won")
+	}
+	if !board.HasMove(player, opts.Variant == VariantPopOut) {
+		return Bitboard{}, Empty, errors.New("player to move has no legal move")
+	}
+	return board, player, nil
+}
+
+// errBoardStringTooWide rejects a board string row wider than any board
+var errBoardStringTooWide = fmt.Errorf("board string rows can be at most %d cells wide", MaxBoardWidth)
+
+// parseBoardString builds a board from board string notation
+func parseBoardString(notation string, opts GameOptions) (Bitboard, Player, error) {
+	fields := strings.Fields(notation)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Bitboard{}, Empty, errors.New("board string must be rows followed by an optional player to move")
+	}
+
+	rows := strings.Split(fields[0], "/")
+	grid := make([][]Player, len(rows))
+	for r, row := range rows {
+		for i := 0; i < len(row); i++ {
+			switch ch := row[i]; {
+			case ch == player1Symbol || ch == player2Symbol:
+				if len(grid[r]) == MaxBoardWidth {
+					return Bitboard{}, Empty, errBoardStringTooWide
+				}
+				if ch == player1Symbol {
+					grid[r] = append(grid[r], Player1)
+				} else {
+					grid[r] = append(grid[r], Player2)
+				}
+			case ch >= '0' && ch <= '9':
+				j := i
+				for j < len(row) && row[j] >= '0' && row[j] <= '9' {
+					j++
+				}
+				run, err := strconv.Atoi(row[i:j])
+				if err != nil {
+					return Bitboard{}, Empty, fmt.Errorf("invalid run of empty cells in board string: %w", err)
+				}
+				// Check the run before filling it in, so a huge number cannot
+				// make the row take up any memory
+				if run > MaxBoardWidth-len(grid[r]) {
+					return Bitboard{}, Empty, errBoardStringTooWide
+				}
+				for k := 0; k < run; k++ {
+					grid[r] = append(grid[r], Empty)
+				}
+				i = j - 1
+			default:
+				return Bitboard{}, Empty, fmt.Errorf("invalid character %q in board string", ch)
+			}
+		}
+		if len(grid[r]) != len(grid[0]) {
+			return Bitboard{}, Empty, errors.New("every row of the board string must have the same width")
+		}
+	}
+
+	opts.Width = len(grid[0])
+	opts.Height = len(grid)
+	if err := opts.validateRules(); err != nil {
+		return Bitboard{}, Empty, err
+	}
+
+	// Discs are dropped bottom-up so the bitboard heights come out right;
+	// a disc above an empty cell would be floating
+	board := NewBitboard(opts.Width, opts.Height, opts.WinLength)
+	counts := map[Player]int{}
+	for c := 0; c < opts.Width; c++ {
+		for r := opts.Height - 1; r >= 0; r-- {
+			if grid[r][c] == Empty {
+				for above := r - 1; above >= 0; above-- {
+					if grid[above][c] != Empty {
+						return Bitboard{}, Empty, fmt.Errorf("floating disc in column %d", c+1)
+					}
+				}
+				break
+			}
+			board.Play(c, grid[r][c])
+			counts[grid[r][c]]++
+		}
+	}
+
+	toMove := Player1
+	if counts[Player1] > counts[Player2] {
+		toMove = Player2
+	}
+	if len(fields) == 2 {
+		switch fields[1] {
+		case string(player1Symbol):
+			toMove = Player1
+		case string(player2Symbol):
+			toMove = Player2
+		default:
+			return Bitboard{}, Empty, fmt.Errorf("invalid player to move %q", fields[1])
+		}
+	}
+
+	// Without pops the disc counts fix whose turn it is
+	if opts.Variant != VariantPopOut {
+		diff := counts[Player1] - counts[Player2]
+		if (toMove == Player1 && diff != 0) || (toMove == Player2 && diff != 1) {
+			return Bitboard{}, Empty, errors.New("disc counts do not match the player to move")
+		}
+	}
+
+	if board.IsWin(Player1) || board.IsWin(Player2) {
+		return Bitboard{}, Empty, errors.New("position is already won")
+	}
+	if !board.HasMove(toMove, opts.Variant == VariantPopOut) {
+		return Bitboard{}, Empty, errors.New("player to move has no legal move")
+	}
+	return board, toMove, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func popOutOptions() GameOptions {
+	opts := DefaultGameOptions()
+	opts.Variant = VariantPopOut
+	return opts
+}
+
+func TestParsePosition(t *testing.T) {
+	wide := DefaultGameOptions()
+	wide.Width = 12
+	wide.Height = 8
+
+	tests := []struct {
+		name     string
+		notation string
+		opts     GameOptions
+		want     string
+	}{
+		{"empty move string", "", DefaultGameOptions(), "7/7/7/7/7/7 x"},
+		{"one move", "4", DefaultGameOptions(), "7/7/7/7/7/3x3 o"},
+		{"several moves", "4453", DefaultGameOptions(), "7/7/7/7/3o3/2oxx2 x"},
+		{"columns past 9", "abc1", wide, "12/12/12/12/12/12/12/o8xox x"},
+		{"pop", "44p4", popOutOptions(), "7/7/7/7/7/3o3 o"},
+		{"surrounding spaces", "  4  ", DefaultGameOptions(), "7/7/7/7/7/3x3 o"},
+		{"board string", "7/7/7/7/7/3x3 o", DefaultGameOptions(), "7/7/7/7/7/3x3 o"},
+		{"player to move worked out", "7/7/7/7/3o3/2oxx2", DefaultGameOptions(), "7/7/7/7/3o3/2oxx2 x"},
+		{"board string sets the size", "5/5/5/5", DefaultGameOptions(), "5/5/5/5 x"},
+		{"widest board string", "12/12/12/12/12/12/12/11x", wide, "12/12/12/12/12/12/12/11x o"},
+		{"popout player to move", "7/7/7/7/7/3o3 o", popOutOptions(), "7/7/7/7/7/3o3 o"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			board, toMove, err := ParsePosition(tt.notation, tt.opts)
+			if err != nil {
+				t.Fatalf("ParsePosition(%q) error: %v", tt.notation, err)
+			}
+			if got := formatBoardString(&board, toMove); got != tt.want {
+				t.Fatalf("ParsePosition(%q) = %q, want %q", tt.notation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePositionInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		notation string
+		opts     GameOptions
+		wantErr  string
+	}{
+		{"huge empty run", "300000000/7/7/7/7/7", DefaultGameOptions(), "at most 12 cells"},
+		{"empty run out of range", "99999999999999999999/7/7/7/7/7", DefaultGameOptions(), "invalid run"},
+		{"row too wide", "13/13/13/13/13/13", DefaultGameOptions(), "at most 12 cells"},
+		{"run too wide after discs", "xo11/13/13/13/13/13", DefaultGameOptions(), "at most 12 cells"},
+		{"too many discs", "xoxoxoxoxoxox/7/7/7/7/7", DefaultGameOptions(), "at most 12 cells"},
+		{"uneven rows", "7/7/7/7/7/6", DefaultGameOptions(), "same width"},
+		{"invalid character", "7/7/7/7/7/3z3", DefaultGameOptions(), "invalid character"},
+		{"floating disc", "7/7/7/7/3x3/7 o", DefaultGameOptions(), "floating disc"},
+		{"disc counts", "7/7/7/7/7/3x3 x", DefaultGameOptions(), "disc counts"},
+		{"invalid player to move", "7/7/7/7/7/3x3 q", DefaultGameOptions(), "invalid player"},
+		{"extra fields", "7/7/7/7/7/7 x o", DefaultGameOptions(), "optional player"},
+		{"board too small", "3/3/3/3", DefaultGameOptions(), "board width"},
+		{"board string already won", "7/7/7/7/7/xxxx3 o", popOutOptions(), "already won"},
+		{"column off the board", "8", DefaultGameOptions(), "invalid column"},
+		{"invalid column symbol", "4z", DefaultGameOptions(), "invalid column"},
+		{"pop outside PopOut", "4p4", DefaultGameOptions(), "only allowed in PopOut"},
+		{"pop without column", "4p", popOutOptions(), "no column"},
+		{"illegal pop", "4p4", popOutOptions(), "illegal pop"},
+		{"full column", "4444444", DefaultGameOptions(), "full"},
+		{"moves after a win", "12121212", DefaultGameOptions(), "after the game is won"},
+		{"move string already won", "1212121", DefaultGameOptions(), "already won"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParsePosition(tt.notation, tt.opts)
+			if err == nil {
+				t.Fatalf("ParsePosition(%q) succeeded, want an error", tt.notation)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParsePosition(%q) error %q, want it to mention %q", tt.notation, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMoveString(t *testing.T) {
+	wide := DefaultGameOptions()
+	wide.Width = 12
+	wide.Height = 8
+
+	tests := []struct {
+		name  string
+		opts  GameOptions
+		moves []Move
+		want  string
+	}{
+		{"no moves", DefaultGameOptions(), nil, ""},
+		{"drops", DefaultGameOptions(), []Move{{Column: 3}, {Column: 3}, {Column: 4}, {Column: 2}}, "4453"},
+		{"columns past 9", wide, []Move{{Column: 9}, {Column: 10}, {Column: 11}, {Column: 0}}, "abc1"},
+		{"pops", popOutOptions(), []Move{{Column: 3}, {Column: 3}, {Column: 3, Kind: MovePop}}, "44p4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := NewGame("notation", "alice", tt.opts)
+			game.StartGame("bob")
+			for _, move := range tt.moves {
+				var err error
+				if move.Kind == MovePop {
+					err = game.Pop(move.Column, game.CurrentTurn)
+				} else {
+					err = game.MakeMove(move.Column, game.CurrentTurn)
+				}
+				if err != nil {
+					t.Fatalf("move %+v: %v", move, err)
+				}
+			}
+
+			if got := game.MoveString(); got != tt.want {
+				t.Fatalf("MoveString() = %q, want %q", got, tt.want)
+			}
+
+			// Playing the move string again gives the same position
+			board, toMove, err := ParsePosition(game.MoveString(), tt.opts)
+			if err != nil {
+				t.Fatalf("ParsePosition(%q): %v", game.MoveString(), err)
+			}
+			if got := formatBoardString(&board, toMove); got != game.PositionString() {
+				t.Fatalf("ParsePosition(%q) = %q, want %q", game.MoveString(), got, game.PositionString())
+			}
+		})
+	}
+}
+
+// playMoveString plays a move string on a game move by move, the way the
+// players would have made the moves
+func playMoveString(game *Game, moves string) error {
+	for i := 0; i < len(moves); i++ {
+		kind := MoveDrop
+		if moves[i] == 'p' {
+			kind = MovePop
+			i++
+		}
+		if i == len(moves) {
+			return errors.New("pop without a column")
+		}
+		if err := game.PlayMove(kind, parseColumnSymbol(moves[i]), game.CurrentTurn); err != nil {
+			return fmt.Errorf("move %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func TestMoveStringResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   GameOptions
+		moves  string
+		winner Player
+		reason EndReason
+	}{
+		{"vertical", DefaultGameOptions(), "1212121", Player1, EndReasonConnect},
+		{"horizontal", DefaultGameOptions(), "1122334", Player1, EndReasonConnect},
+		{"diagonal", DefaultGameOptions(), "12234334544", Player1, EndReasonConnect},
+		{"anti-diagonal", DefaultGameOptions(), "76654554344", Player1, EndReasonConnect},
+		{"second player", DefaultGameOptions(), "71212121", Player2, EndReasonConnect},
+		{"wide board", boardOptions(12, 9, 4), "777878787", Player1, EndReasonConnect},
+		{"columns past 9", boardOptions(12, 9, 4), "abababa", Player1, EndReasonConnect},
+		{"win length 5", boardOptions(12, 9, 5), "556677889", Player1, EndReasonConnect},
+		{"unfinished", DefaultGameOptions(), "1122335", Empty, ""},
+		{"full board", boardOptions(4, 4, 4), "1234123421432143", Empty, EndReasonBoardFull},
+		{"pop completes the opponent's line", popOutOptions(), "11727364p1", Player2, EndReasonConnect},
+		{"pop repeats the start", popOutOptions(), "12p1p212p1p2", Empty, EndReasonRepetition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := NewGame("notation", "alice", tt.opts)
+			game.StartGame("bob")
+			if err := playMoveString(game, tt.moves); err != nil {
+				t.Fatalf("playing %q: %v", tt.moves, err)
+			}
+
+			if finished := game.State == Finished; finished != (tt.reason != "") {
+				t.Fatalf("after %q the game is finished: %v, want %v", tt.moves, finished, tt.reason != "")
+			}
+			if game.Winner != tt.winner || game.EndReason != tt.reason {
+				t.Fatalf("after %q winner %d by %q, want %d by %q", tt.moves, game.Winner, game.EndReason, tt.winner, tt.reason)
+			}
+			if game.IsDraw != (tt.reason != "" && tt.winner == Empty) {
+				t.Fatalf("after %q IsDraw = %v", tt.moves, game.IsDraw)
+			}
+
+			// A finished game's moves no longer parse as a position, since the
+			// game is over; an unfinished one parses to where it stands
+			_, _, err := ParsePosition(tt.moves, tt.opts)
+			if tt.reason == EndReasonConnect && err == nil {
+				t.Fatalf("ParsePosition(%q) accepted a won position", tt.moves)
+			}
+			if tt.reason == "" && err != nil {
+				t.Fatalf("ParsePosition(%q): %v", tt.moves, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the newest version of the WebSocket protocol. Clients
+// ask for a version with the Sec-WebSocket-Protocol header when they connect.
+const ProtocolVersion = 1
+
+// protocolPrefix starts the name of every WebSocket subprotocol the server
+// speaks; the version follows it, then the encoding if it is not JSON, as in
+// "connect-four.v1" or "connect-four.v1.msgpack"
+const protocolPrefix = "connect-four.v"
+
+// supportedVersions are the protocol versions the server speaks, newest first
+var supportedVersions = []int{ProtocolVersion}
+
+// Encoding is how messages are written in WebSocket frames. Every encoding
+// carries the same messages, built from the same Go types, one per frame.
+type Encoding int
+
+const (
+	// EncodingJSON sends each message as JSON in a text frame
+	EncodingJSON Encoding = iota
+	// EncodingMsgpack sends each message as MessagePack in a binary frame
+	EncodingMsgpack
+)
+
+// supportedEncodings are the encodings the server speaks, in order of
+// preference: a client offering both gets the more compact one
+var supportedEncodings = []Encoding{EncodingMsgpack, EncodingJSON}
+
+// suffix returns what the encoding adds to the name of a subprotocol
+func (e Encoding) suffix() string {
+	if e == EncodingMsgpack {
+		return ".msgpack"
+	}
+	return ""
+}
+
+// frameType returns the type of WebSocket frame the encoding is sent in
+func (e Encoding) frameType() int {
+	if e == EncodingMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// marshal encodes an outgoing message
+func (e Encoding) marshal(v interface{}) ([]byte, error) {
+	if e == EncodingMsgpack {
+		return marshalMsgpack(v)
+	}
+	return json.Marshal(v)
+}
+
+// decode strictly decodes a client message, as decodeMessage does for JSON
+func (e Encoding) decode(version int, data []byte) (interface{}, *ErrorPayload) {
+	if e == EncodingMsgpack {
+		converted, err := msgpackToJSON(data)
+		if err != nil {
+			return nil, &ErrorPayload{Code: ErrMalformedMessage, Message: err.Error()}
+		}
+		data = converted
+	}
+	return decodeMessage(version, data)
+}
+
+// protocolName returns the WebSocket subprotocol of a protocol version in an encoding
+func protocolName(version int, encoding Encoding) string {
+	return protocolPrefix + strconv.Itoa(version) + encoding.suffix()
+}
+
+// protocolNames returns the WebSocket subprotocols of the supported versions
+// and encodings, in order of preference
+func protocolNames() []string {
+	var names []string
+	for _, version := range supportedVersions {
+		for _, encoding := range supportedEncodings {
+			names = append(names, protocolName(version, encoding))
+		}
+	}
+	return names
+}
+
+// negotiateProtocol returns the newest supported protocol version the client
+// asked for when opening the WebSocket, in the preferred encoding it offered
+// for that version. It agrees with the subprotocol the upgrader picks.
+func negotiateProtocol(r *http.Request) (int, Encoding, bool) {
+	offered := websocket.Subprotocols(r)
+	for _, version := range supportedVersions {
+		for _, encoding := range supportedEncodings {
+			for _, name := range offered {
+				if name == protocolName(version, encoding) {
+					return version, encoding, true
+				}
+			}
+		}
+	}
+	return 0, EncodingJSON, false
+}
+
+// Envelope wraps every message in both directions. Payload holds the
+// message's own fields and is decoded into the payload type of its Type.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// outgoingEnvelope is an Envelope on its way to a client. Seq is the
+// sequence number of a game event, or of the latest event a GAME_STATE
+// snapshot includes.
+type outgoingEnvelope struct {
+	V       int         `json:"v"`
+	Seq     uint64      `json:"seq,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// ErrorCode says what went wrong in an ERROR message, so clients can react
+// without parsing the human-readable message
+type ErrorCode string
+
+const (
+	// Protocol errors: the message itself could not be accepted
+	ErrMalformedMessage   ErrorCode = "MALFORMED_MESSAGE"
+	ErrUnsupportedVersion ErrorCode = "UNSUPPORTED_VERSION"
+	ErrUnknownType        ErrorCode = "UNKNOWN_TYPE"
+	ErrInvalidPayload     ErrorCode = "INVALID_PAYLOAD"
+
+	// Request errors: the message was understood but cannot be carried out
+	ErrInvalidOptions    ErrorCode = "INVALID_OPTIONS"
+	ErrGameNotFound      ErrorCode = "GAME_NOT_FOUND"
+	ErrNotAPlayer        ErrorCode = "NOT_A_PLAYER"
+	ErrSeatTaken         ErrorCode = "SEAT_TAKEN"
+	ErrIllegalAction     ErrorCode = "ILLEGAL_ACTION"
+	ErrSessionRequired   ErrorCode = "SESSION_REQUIRED"
+	ErrSessionInvalid    ErrorCode = "SESSION_INVALID"
+	ErrSessionExpired    ErrorCode = "SESSION_EXPIRED"
+	ErrRoomUnavailable   ErrorCode = "ROOM_UNAVAILABLE"
+	ErrGameNotFinished   ErrorCode = "GAME_NOT_FINISHED"
+	ErrGameNotInProgress ErrorCode = "GAME_NOT_IN_PROGRESS"
+	ErrAlreadyPlaying    ErrorCode = "ALREADY_PLAYING"
+	ErrInvalidChat       ErrorCode = "INVALID_CHAT"
+	ErrRateLimited       ErrorCode = "RATE_LIMITED"
+	ErrOpponentLeft      ErrorCode = "OPPONENT_LEFT"
+	ErrInternal          ErrorCode = "INTERNAL"
+)
+
+// sessionErrorCode returns the code a session error is reported under
+func sessionErrorCode(err error) ErrorCode {
+	switch err {
+	case errSessionRequired:
+		return ErrSessionRequired
+	case errSessionExpired:
+		return ErrSessionExpired
+	}
+	return ErrSessionInvalid
+}
+
+/* Client payloads */
+
+// GameRules are the rules a player asks for when starting a game. Anything
+// left out uses the default.
+type GameRules struct {
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	WinLength int    `json:"winLength,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+	Casual    bool   `json:"casual,omitempty"`
+	// TimeControl is "minutes+seconds", such as "3+2", or empty for an untimed game
+	TimeControl string `json:"timeControl,omitempty"`
+	// Position is a starting position in either notation
+	Position string `json:"position,omitempty"`
+}
+
+// GameRef names the game a message is about. Without a game ID the
+// connection's current game is meant.
+type GameRef struct {
+	GameID string `json:"gameId,omitempty"`
+}
+
+// JoinPayload asks to be matched with an opponent
+type JoinPayload struct {
+	GameRules
+	// Difficulty is the bot's difficulty if no opponent is found in time
+	Difficulty string `json:"difficulty,omitempty"`
+}
+
+// CreateRoomPayload opens a private room
+type CreateRoomPayload struct {
+	GameRules
+}
+
+// JoinRoomPayload joins a private room by its invite code
+type JoinRoomPayload struct {
+	Code string `json:"code"`
+}
+
+// MovePayload drops a disc into a column, counted from 0
+type MovePayload struct {
+	GameRef
+	Column int `json:"column"`
+}
+
+// PopPayload pops the player's own disc out of the bottom of a column, in PopOut
+type PopPayload struct {
+	GameRef
+	Column int `json:"column"`
+}
+
+// TakebackRequestPayload asks the opponent to take back the player's last move
+type TakebackRequestPayload struct{ GameRef }
+
+// TakebackAcceptPayload accepts the opponent's takeback request
+type TakebackAcceptPayload struct{ GameRef }
+
+// ResignPayload resigns the game
+type ResignPayload struct{ GameRef }
+
+// OfferDrawPayload offers the opponent a draw
+type OfferDrawPayload struct{ GameRef }
+
+// AcceptDrawPayload accepts the opponent's draw offer
+type AcceptDrawPayload struct{ GameRef }
+
+// DeclineDrawPayload declines the opponent's draw offer
+type DeclineDrawPayload struct{ GameRef }
+
+// RematchRequestPayload asks the opponent for a rematch of a finished game
+type RematchRequestPayload struct{ GameRef }
+
+// RematchAcceptPayload accepts the opponent's rematch request
+type RematchAcceptPayload struct{ GameRef }
+
+// ReconnectPayload takes a seat back with the session token given when joining
+type ReconnectPayload struct {
+	GameRef
+	Token string `json:"token"`
+}
+
+// ResumePayload asks for the game's events after LastSeq to be sent again
+type ResumePayload struct {
+	GameRef
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// GetStatePayload asks for a full GAME_STATE snapshot of a game
+type GetStatePayload struct{ GameRef }
+
+// ReplayPayload streams a finished game
+type ReplayPayload struct {
+	GameID string `json:"gameId"`
+	// Speed is from 0.25 to 10, and 1 if left out
+	Speed float64 `json:"speed,omitempty"`
+}
+
+// SpectatePayload starts watching a game in progress
+type SpectatePayload struct {
+	GameID string `json:"gameId"`
+}
+
+// StopSpectatingPayload stops watching the game being watched
+type StopSpectatingPayload struct{}
+
+// ListGamesPayload asks for the games open to spectating
+type ListGamesPayload struct{}
+
+// ChatPayload sends a chat line to the game being played or watched
+type ChatPayload struct {
+	GameRef
+	Text string `json:"text"`
+}
+
+// MutePayload hides the opponent's chat
+type MutePayload struct{ GameRef }
+
+// UnmutePayload shows the opponent's chat again
+type UnmutePayload struct{ GameRef }
+
+// GetLeaderboardPayload asks for the leaderboard
+type GetLeaderboardPayload struct{}
+
+// clientPayloads maps each message type a client can send to a new payload of its type
+var clientPayloads = map[string]func() interface{}{
+	"JOIN":             func() interface{} { return &JoinPayload{} },
+	"CREATE_ROOM":      func() interface{} { return &CreateRoomPayload{} },
+	"JOIN_ROOM":        func() interface{} { return &JoinRoomPayload{} },
+	"MOVE":             func() interface{} { return &MovePayload{} },
+	"POP":              func() interface{} { return &PopPayload{} },
+	"TAKEBACK_REQUEST": func() interface{} { return &TakebackRequestPayload{} },
+	"TAKEBACK_ACCEPT":  func() interface{} { return &TakebackAcceptPayload{} },
+	"RESIGN":           func() interface{} { return &ResignPayload{} },
+	"OFFER_DRAW":       func() interface{} { return &OfferDrawPayload{} },
+	"ACCEPT_DRAW":      func() interface{} { return &AcceptDrawPayload{} },
+	"DECLINE_DRAW":     func() interface{} { return &DeclineDrawPayload{} },
+	"REMATCH_REQUEST":  func() interface{} { return &RematchRequestPayload{} },
+	"REMATCH_ACCEPT":   func() interface{} { return &RematchAcceptPayload{} },
+	"RECONNECT":        func() interface{} { return &ReconnectPayload{} },
+	"RESUME":           func() interface{} { return &ResumePayload{} },
+	"GET_STATE":        func() interface{} { return &GetStatePayload{} },
+	"REPLAY":           func() interface{} { return &ReplayPayload{} },
+	"SPECTATE":         func() interface{} { return &SpectatePayload{} },
+	"STOP_SPECTATING":  func() interface{} { return &StopSpectatingPayload{} },
+	"LIST_GAMES":       func() interface{} { return &ListGamesPayload{} },
+	"CHAT":             func() interface{} { return &ChatPayload{} },
+	"MUTE":             func() interface{} { return &MutePayload{} },
+	"UNMUTE":           func() interface{} { return &UnmutePayload{} },
+	"GET_LEADERBOARD":  func() interface{} { return &GetLeaderboardPayload{} },
+}
+
+/* Server payloads */
+
+// PlayerNotice tells a player about something another player did in a game
+type PlayerNotice struct {
+	GameID   string `json:"gameId"`
+	Username string `json:"username"`
+}
+
+// JoinedPayload confirms a JOIN or JOIN_ROOM
+type JoinedPayload struct {
+	GameID   string `json:"gameId"`
+	Username string `json:"username"`
+	// Code is the invite code of the room joined, if any
+	Code string `json:"code,omitempty"`
+	// Token is the session token to reconnect to the game with
+	Token string `json:"token"`
+}
+
+// RoomCreatedPayload confirms a CREATE_ROOM
+type RoomCreatedPayload struct {
+	GameID   string `json:"gameId"`
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	Token    string `json:"token"`
+}
+
+// RoomExpiredPayload tells a host their room expired before anyone joined
+type RoomExpiredPayload struct {
+	GameID string `json:"gameId"`
+	Code   string `json:"code"`
+}
+
+// MoveAppliedPayload is a move played in a game, with the game's status after
+// it, including the result if the move ended the game
+type MoveAppliedPayload struct {
+	GameID string `json:"gameId"`
+	Move   Move   `json:"move"`
+	// Ply is how many moves have been played, including this one
+	Ply int `json:"ply"`
+	GameStatus
+	// BoardHash is the hash of the board after the move
+	BoardHash string `json:"boardHash"`
+}
+
+// MovesUndonePayload is the moves a takeback undid, most recent first, with
+// the game's status after it
+type MovesUndonePayload struct {
+	GameID string `json:"gameId"`
+	Moves  []Move `json:"moves"`
+	// Ply is how many moves are left
+	Ply int `json:"ply"`
+	GameStatus
+	// BoardHash is the hash of the board after the takeback
+	BoardHash string `json:"boardHash"`
+}
+
+// GameUpdatedPayload is the game's status after a change that leaves the board as it is
+type GameUpdatedPayload struct {
+	GameID string `json:"gameId"`
+	GameStatus
+}
+
+// ErrorPayload reports a message that could not be accepted or carried out
+type ErrorPayload struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Error returns the error's message
+func (e *ErrorPayload) Error() string {
+	return e.Message
+}
+
+// ReconnectedPayload confirms a RECONNECT
+type ReconnectedPayload struct {
+	GameID string `json:"gameId"`
+	// Token replaces the session token used to reconnect
+	Token string `json:"token"`
+}
+
+// ResumedPayload confirms a RESUME once the missed events have been sent
+type ResumedPayload struct {
+	GameID string `json:"gameId"`
+	// Seq is the sequence number of the game's latest event
+	Seq uint64 `json:"seq"`
+	// Replayed is how many events were sent again
+	Replayed int `json:"replayed"`
+	// Snapshot is set if the events could not all be sent again, so a
+	// GAME_STATE was sent instead
+	Snapshot bool `json:"snapshot"`
+}
+
+// SessionSupersededPayload tells a connection another one has taken its seat
+type SessionSupersededPayload struct {
+	GameID string `json:"gameId"`
+}
+
+// TakebackRequestedPayload asks a player to accept their opponent's takeback
+type TakebackRequestedPayload struct{ PlayerNotice }
+
+// DrawOfferedPayload asks a player to answer their opponent's draw offer
+type DrawOfferedPayload struct{ PlayerNotice }
+
+// DrawDeclinedPayload tells a player their draw offer was declined
+type DrawDeclinedPayload struct{ PlayerNotice }
+
+// RematchRequestedPayload asks a player to accept their opponent's rematch request
+type RematchRequestedPayload struct{ PlayerNotice }
+
+// MutedPayload confirms a MUTE; Username is the opponent muted
+type MutedPayload struct{ PlayerNotice }
+
+// UnmutedPayload confirms an UNMUTE; Username is the opponent unmuted
+type UnmutedPayload struct{ PlayerNotice }
+
+// SpectatingPayload confirms a SPECTATE
+type SpectatingPayload struct {
+	GameID string `json:"gameId"`
+}
+
+// ChatLinePayload delivers a chat line
+type ChatLinePayload struct {
+	GameID string `json:"gameId"`
+	ChatMessage
+}
+
+// ReplayFramePayload is one position of a replay
+type ReplayFramePayload struct {
+	GameID string `json:"gameId"`
+	ReplayFrame
+}
+
+// ReplayEndPayload ends a replay
+type ReplayEndPayload struct {
+	GameID string `json:"gameId"`
+}
+
+// serverPayloads maps each message type the server sends to an example of its payload
+var serverPayloads = map[string]interface{}{
+	"JOINED":             JoinedPayload{},
+	"ROOM_CREATED":       RoomCreatedPayload{},
+	"ROOM_EXPIRED":       RoomExpiredPayload{},
+	"GAME_STATE":         GameResponse{},
+	"MOVE_APPLIED":       MoveAppliedPayload{},
+	"MOVES_UNDONE":       MovesUndonePayload{},
+	"GAME_UPDATED":       GameUpdatedPayload{},
+	"ERROR":              ErrorPayload{},
+	"LEADERBOARD":        []LeaderboardEntry{},
+	"RECONNECTED":        ReconnectedPayload{},
+	"RESUMED":            ResumedPayload{},
+	"SESSION_SUPERSEDED": SessionSupersededPayload{},
+	"TAKEBACK_REQUEST":   TakebackRequestedPayload{},
+	"DRAW_OFFERED":       DrawOfferedPayload{},
+	"DRAW_DECLINED":      DrawDeclinedPayload{},
+	"REMATCH_REQUEST":    RematchRequestedPayload{},
+	"SPECTATING":         SpectatingPayload{},
+	"GAMES":              []LiveGame{},
+	"CHAT":               ChatLinePayload{},
+	"MUTED":              MutedPayload{},
+	"UNMUTED":            UnmutedPayload{},
+	"REPLAY_FRAME":       ReplayFramePayload{},
+	"REPLAY_END":         ReplayEndPayload{},
+}
+
+// decodeMessage strictly decodes a client message in the connection's
+// protocol version: the envelope and the payload may not have fields the
+// protocol does not define, and the payload must have every required field.
+// It returns a pointer to the payload, whose type tells the message's type.
+func decodeMessage(version int, data []byte) (interface{}, *ErrorPayload) {
+	var env Envelope
+	if err := decodeStrict(data, &env); err != nil {
+		return nil, &ErrorPayload{Code: ErrMalformedMessage, Message: err.Error()}
+	}
+
+	if env.V != version {
+		return nil, &ErrorPayload{
+			Code:    ErrUnsupportedVersion,
+			Message: fmt.Sprintf("this connection speaks protocol version %d", version),
+		}
+	}
+
+	newPayload, known := clientPayloads[env.Type]
+	if !known {
+		return nil, &ErrorPayload{Code: ErrUnknownType, Message: fmt.Sprintf("unknown message type %q", env.Type)}
+	}
+
+	payload := newPayload()
+	raw := env.Payload
+	if len(raw) == 0 {
+		raw = []byte("{}")
+	}
+	if err := checkRequired(raw, payload); err != nil {
+		return nil, &ErrorPayload{Code: ErrInvalidPayload, Message: err.Error()}
+	}
+	if err := decodeStrict(raw, payload); err != nil {
+		return nil, &ErrorPayload{Code: ErrInvalidPayload, Message: err.Error()}
+	}
+	return payload, nil
+}
+
+// decodeStrict decodes JSON that must be a single value without unknown fields
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	// Only whitespace may follow the value. More would let a stray closing
+	// bracket through.
+	var extra json.RawMessage
+	if err := dec.Decode(&extra); err != io.EOF {
+		return fmt.Errorf("unexpected data after the message")
+	}
+	return nil
+}
+
+// checkRequired reports the first required field of the payload type that
+// the JSON object leaves out
+func checkRequired(raw json.RawMessage, payload interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return fmt.Errorf("payload must be an object")
+	}
+
+	var missing []string
+	for _, field := range jsonFields(derefType(payload)) {
+		if _, present := fields[field.name]; field.required && !present {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required field %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
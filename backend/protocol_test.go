@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDecodeMessageRejectsTrailingData(t *testing.T) {
+	const message = `{"v":1,"type":"CHAT","payload":{"gameId":"abc","text":"hello"}}`
+	if _, perr := decodeMessage(ProtocolVersion, []byte(message+" \r\n")); perr != nil {
+		t.Fatalf("message followed by whitespace: %v", perr)
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"closing brace", message + "}"},
+		{"closing brace then text", message + "}x"},
+		{"closing bracket", message + "]"},
+		{"text", message + "x"},
+		{"second message", message + message},
+		{"payload closing brace", `{"v":1,"type":"CHAT","payload":{"gameId":"abc","text":"hello"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, perr := decodeMessage(ProtocolVersion, []byte(tt.data)); perr == nil || perr.Code != ErrMalformedMessage {
+				t.Fatalf("decodeMessage(%s) = %v, want %s", tt.data, perr, ErrMalformedMessage)
+			}
+		})
+	}
+
+	// The payload is decoded strictly too
+	var payload ChatPayload
+	if err := decodeStrict([]byte(`{"gameId":"abc","text":"hello"}}x`), &payload); err == nil {
+		t.Fatal("payload with trailing data was decoded")
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	srv := startTestServer(t)
+	client := dialTestClient(t, srv, "alice")
+
+	// The longest chat line, with every character escaped as a surrogate
+	// pair, fits within the limit
+	longest := strings.Repeat(`\ud83d\ude00`, MaxChatLength)
+	message := `{"v":1,"type":"CHAT","payload":{"gameId":"abc","text":"` + longest + `"}}`
+	if len(message) > maxMessageSize {
+		t.Fatalf("the longest valid message is %d bytes, over the %d byte limit", len(message), maxMessageSize)
+	}
+	if err := client.ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	var reply ErrorPayload
+	if err := client.await("ERROR", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != ErrGameNotFound {
+		t.Fatalf("longest chat line was rejected with %s: %s", reply.Code, reply.Message)
+	}
+
+	// Anything longer closes the connection
+	payload, err := json.Marshal(ChatPayload{GameRef: GameRef{GameID: "abc"}, Text: strings.Repeat("x", maxMessageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ws.WriteJSON(Envelope{V: ProtocolVersion, Type: "CHAT", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := client.read()
+		if websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading after an oversized message: %v, want the connection closed as too big", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Glicko-2 parameters. New players start at DefaultRating with a large
+// deviation, which shrinks as they play. ratingTau limits how quickly a
+// player's volatility can change.
+const (
+	DefaultRating     = 1500.0
+	DefaultDeviation  = 350.0
+	DefaultVolatility = 0.06
+
+	ratingTau       = 0.5
+	glickoScale     = 173.7178
+	volatilityDelta = 0.000001
+)
+
+// PlayerRating is a player's Glicko-2 rating and record in rated games
+type PlayerRating struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	Draws      int     `json:"draws"`
+}
+
+// GamesPlayed returns the number of rated games the player has finished
+func (r *PlayerRating) GamesPlayed() int {
+	return r.Wins + r.Losses + r.Draws
+}
+
+// LeaderboardEntry is one ranked row of the leaderboard
+type LeaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	Username    string `json:"username"`
+	Rating      int    `json:"rating"`
+	Deviation   int    `json:"deviation"`
+	GamesPlayed int    `json:"gamesPlayed"`
+	Wins        int    `json:"wins"`
+	Losses      int    `json:"losses"`
+	Draws       int    `json:"draws"`
+}
+
+// RatingSystem rates finished games. The ratings themselves are kept in the
+// game store, so they survive a restart, and each game's record says whether
+// it has been rated.
+type RatingSystem struct {
+	// mu keeps two games from updating the same player's rating at once
+	mu sync.Mutex
+}
+
+func NewRatingSystem() *RatingSystem {
+	return &RatingSystem{}
+}
+
+// playerRating returns a player's stored rating, or a new rating if they have none
+func playerRating(username string) (PlayerRating, error) {
+	r, exists, err := gameStore.GetPlayer(username)
+	if err != nil || !exists {
+		r = PlayerRating{
+			Rating:     DefaultRating,
+			Deviation:  DefaultDeviation,
+			Volatility: DefaultVolatility,
+		}
+	}
+	return r, err
+}
+
+// Rating returns a player's current rating, or DefaultRating if they have not finished a rated game
+func (rs *RatingSystem) Rating(username string) float64 {
+	r, err := playerRating(username)
+	if err != nil {
+		log.Printf("Error loading rating for %s: %v", username, err)
+	}
+	return r.Rating
+}
+
+// RecordGame updates both players' ratings for a finished game and saves the
+// game marked as rated along with them. Unrated games and bot games do not
+// count, nor does a game already rated. Forfeits count as an ordinary loss.
+// The caller must hold the game's lock.
+func (rs *RatingSystem) RecordGame(game *Game) {
+	if !game.Rated || game.IsBotGame || game.State != Finished || game.EndReason == EndReasonAbandoned || game.RatingsRecorded {
+		return
+	}
+
+	score1 := 0.5
+	switch game.Winner {
+	case Player1:
+		score1 = 1
+	case Player2:
+		score1 = 0
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// A game finished again after recovering from a crash may have been
+	// rated before it
+	if record, found, err := gameStore.GetGame(game.ID); err == nil && found && record.RatingsRecorded {
+		game.RatingsRecorded = true
+		return
+	}
+
+	r1, err1 := playerRating(game.Player1)
+	r2, err2 := playerRating(game.Player2)
+	if err1 != nil || err2 != nil {
+		// Rating from a default would overwrite the stored rating
+		log.Printf("Error loading ratings for game %s: %v %v", game.ID, err1, err2)
+		return
+	}
+
+	// Both updates use the ratings from before the game
+	before1, before2 := r1, r2
+	r1.update(before2, score1)
+	r2.update(before1, 1-score1)
+
+	game.RatingsRecorded = true
+	err := gameStore.SaveRatedGame(gameRecord(game), map[string]PlayerRating{game.Player1: r1, game.Player2: r2})
+	if err != nil {
+		game.RatingsRecorded = false
+		log.Printf("Error saving ratings for game %s: %v", game.ID, err)
+	}
+}
+
+// ratedResult is one game of a rating period: the opponent's rating before
+// the game and the score, 1 for a win, 0.5 for a draw and 0 for a loss
+type ratedResult struct {
+	opponent PlayerRating
+	score    float64
+}
+
+// update applies one game against opponent, treating the game as its own
+// rating period
+func (r *PlayerRating) update(opponent PlayerRating, score float64) {
+	switch score {
+	case 1:
+		r.Wins++
+	case 0:
+		r.Losses++
+	default:
+		r.Draws++
+	}
+	r.rate([]ratedResult{{opponent: opponent, score: score}})
+}
+
+// rate applies the games of one rating period, as in steps 2 to 8 of the
+// Glicko-2 paper. It does not change the player's record.
+func (r *PlayerRating) rate(results []ratedResult) {
+	// Convert to the Glicko-2 scale
+	mu := (r.Rating - DefaultRating) / glickoScale
+	phi := r.Deviation / glickoScale
+
+	var vInverse, improvement float64
+	for _, result := range results {
+		muOpp := (result.opponent.Rating - DefaultRating) / glickoScale
+		phiOpp := result.opponent.Deviation / glickoScale
+
+		g := 1 / math.Sqrt(1+3*phiOpp*phiOpp/(math.Pi*math.Pi))
+		expected := 1 / (1 + math.Exp(-g*(mu-muOpp)))
+		vInverse += g * g * expected * (1 - expected)
+		improvement += g * (result.score - expected)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	sigma := newVolatility(phi, r.Volatility, v, delta)
+
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+
+	r.Rating = glickoScale*newMu + DefaultRating
+	r.Deviation = math.Min(glickoScale*newPhi, DefaultDeviation)
+	r.Volatility = sigma
+}
+
+// newVolatility solves for the new volatility with the Illinois algorithm,
+// as in step 5 of the Glicko-2 paper
+func newVolatility(phi, sigma, v, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(ratingTau*ratingTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*ratingTau) < 0 {
+			k++
+		}
+		B = a - k*ratingTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > volatilityDelta {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+
+	return math.Exp(A / 2)
+}
+
+// GetLeaderboard returns every rated player ranked by rating. Ties are broken
+// by games played and then by username so the order is stable.
+func (rs *RatingSystem) GetLeaderboard() []LeaderboardEntry {
+	ratings, err := gameStore.Players()
+	if err != nil {
+		log.Printf("Error loading leaderboard: %v", err)
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(ratings))
+	for username, r := range ratings {
+		entries = append(entries, LeaderboardEntry{
+			Username:    username,
+			Rating:      int(math.Round(r.Rating)),
+			Deviation:   int(math.Round(r.Deviation)),
+			GamesPlayed: r.GamesPlayed(),
+			Wins:        r.Wins,
+			Losses:      r.Losses,
+			Draws:       r.Draws,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Rating != b.Rating {
+			return a.Rating > b.Rating
+		}
+		if a.GamesPlayed != b.GamesPlayed {
+			return a.GamesPlayed > b.GamesPlayed
+		}
+		return a.Username < b.Username
+	})
+
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// checkRating fails the test if r is not within tolerance of the wanted
+// rating, deviation and volatility
+func checkRating(t *testing.T, r PlayerRating, rating, deviation, volatility float64) {
+	t.Helper()
+	if math.Abs(r.Rating-rating) > 0.01 || math.Abs(r.Deviation-deviation) > 0.01 || math.Abs(r.Volatility-volatility) > 0.00001 {
+		t.Fatalf("rating %.2f, deviation %.2f, volatility %.5f; want %.2f, %.2f, %.5f",
+			r.Rating, r.Deviation, r.Volatility, rating, deviation, volatility)
+	}
+}
+
+func TestGlicko2PaperExample(t *testing.T) {
+	// The worked example from Glickman's "Example of the Glicko-2 system"
+	player := PlayerRating{Rating: 1500, Deviation: 200, Volatility: DefaultVolatility}
+	player.rate([]ratedResult{
+		{opponent: PlayerRating{Rating: 1400, Deviation: 30}, score: 1},
+		{opponent: PlayerRating{Rating: 1550, Deviation: 100}, score: 0},
+		{opponent: PlayerRating{Rating: 1700, Deviation: 300}, score: 0},
+	})
+	checkRating(t, player, 1464.06, 151.52, 0.05999)
+}
+
+func TestRatingUpdateDraw(t *testing.T) {
+	newPlayer := PlayerRating{Rating: DefaultRating, Deviation: DefaultDeviation, Volatility: DefaultVolatility}
+
+	// Between equals a draw moves neither rating, only their certainty
+	a, b := newPlayer, newPlayer
+	a.update(newPlayer, 0.5)
+	b.update(newPlayer, 0.5)
+	if a != b || a.Draws != 1 || a.Wins+a.Losses != 0 {
+		t.Fatalf("equal players drew and ended up with %+v and %+v", a, b)
+	}
+	if math.Abs(a.Rating-DefaultRating) > 1e-9 || a.Deviation >= DefaultDeviation {
+		t.Fatalf("draw between equals gave %+v, want the rating kept and the deviation shrunk", a)
+	}
+
+	// Otherwise the stronger player loses what the weaker one gains
+	strong := PlayerRating{Rating: 1800, Deviation: 80, Volatility: DefaultVolatility}
+	weak := PlayerRating{Rating: 1400, Deviation: 80, Volatility: DefaultVolatility}
+	strongAfter, weakAfter := strong, weak
+	strongAfter.update(weak, 0.5)
+	weakAfter.update(strong, 0.5)
+	if strongAfter.Rating >= strong.Rating || weakAfter.Rating <= weak.Rating {
+		t.Fatalf("draw took 1800 to %.2f and 1400 to %.2f", strongAfter.Rating, weakAfter.Rating)
+	}
+	if gain, loss := weakAfter.Rating-weak.Rating, strong.Rating-strongAfter.Rating; math.Abs(gain-loss) > 0.01 {
+		t.Fatalf("weaker player gained %.2f but stronger player lost %.2f", gain, loss)
+	}
+}
+
+func TestRatingDeviationGrows(t *testing.T) {
+	// The deviation first grows with the volatility, as for a rating period
+	// without games, so a settled player's deviation ends up higher after a
+	// game that says little about them
+	settled := PlayerRating{Rating: 1500, Deviation: 30, Volatility: DefaultVolatility}
+	unknown := PlayerRating{Rating: 1500, Deviation: DefaultDeviation, Volatility: DefaultVolatility}
+	after := settled
+	after.update(unknown, 0.5)
+	if after.Deviation <= settled.Deviation {
+		t.Fatalf("deviation went from %.2f to %.2f, want it to grow", settled.Deviation, after.Deviation)
+	}
+
+	// It never grows past that of a new player
+	volatile := PlayerRating{Rating: 1500, Deviation: 349, Volatility: 1}
+	volatile.update(unknown, 1)
+	if volatile.Deviation > DefaultDeviation {
+		t.Fatalf("deviation grew to %.2f, past %.0f", volatile.Deviation, DefaultDeviation)
+	}
+}
+
+func TestRecordGameRatesOnce(t *testing.T) {
+	useTestGlobals(t)
+	rs := NewRatingSystem()
+
+	game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	game.StartGame("bob")
+	game.Forfeit(Player2, EndReasonResignation)
+	rs.RecordGame(game)
+	rs.RecordGame(game)
+
+	checkRecords := func(context string) {
+		t.Helper()
+		alice, _, _ := gameStore.GetPlayer("alice")
+		bob, _, _ := gameStore.GetPlayer("bob")
+		if alice.Wins != 1 || alice.GamesPlayed() != 1 || bob.Losses != 1 || bob.GamesPlayed() != 1 {
+			t.Fatalf("%s: alice %+v, bob %+v; want the game counted once", context, alice, bob)
+		}
+	}
+	checkRecords("rated twice")
+
+	record, found, err := gameStore.GetGame(game.ID)
+	if err != nil || !found || !record.RatingsRecorded {
+		t.Fatalf("stored game found %v, rated %v, err %v; want it stored as rated", found, record.RatingsRecorded, err)
+	}
+
+	// A game loaded from the store keeps its flag
+	loaded, err := record.Game()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.RecordGame(loaded)
+	checkRecords("rated after loading")
+
+	// A game replayed from the log after a crash finishes again without the
+	// flag, but the store has it
+	replayed := NewGame(game.ID, "alice", DefaultGameOptions())
+	replayed.StartGame("bob")
+	replayed.Forfeit(Player2, EndReasonResignation)
+	NewRatingSystem().RecordGame(replayed)
+	checkRecords("rated after a restart")
+	if !replayed.RatingsRecorded {
+		t.Fatal("replayed game was not marked as rated")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// LogEntryKind is what a log entry records about an active game
+type LogEntryKind string
+
+const (
+	LogGameStarted LogEntryKind = "start"
+	LogMove        LogEntryKind = "move"
+	LogTakeback    LogEntryKind = "takeback"
+	LogSession     LogEntryKind = "session"
+	LogChat        LogEntryKind = "chat"
+	// LogDrawOffer records a draw offer being made or declined
+	LogDrawOffer LogEntryKind = "drawOffer"
+	// LogTakebackRequest records a takeback being asked for
+	LogTakebackRequest LogEntryKind = "takebackRequest"
+	// LogMute records a player muting or unmuting their opponent
+	LogMute LogEntryKind = "mute"
+)
+
+// LogEntry is one change to an active game in the write-ahead log. Together
+// with the last snapshot, the log tail is enough to rebuild every active game.
+type LogEntry struct {
+	Seq    uint64       `json:"seq"`
+	GameID string       `json:"gameId"`
+	Kind   LogEntryKind `json:"kind"`
+	// Game is the game as it started, for a start entry
+	Game *GameRecord `json:"game,omitempty"`
+	// Move is the move made, for a move entry
+	Move *Move `json:"move,omitempty"`
+	// Sessions are the seats' sessions, for a session entry
+	Sessions *[2]Session `json:"sessions,omitempty"`
+	// Chat is the line sent, for a chat entry, and ChatLines how many lines
+	// the game has once it is applied
+	Chat      *ChatMessage `json:"chat,omitempty"`
+	ChatLines int          `json:"chatLines,omitempty"`
+	// DrawOfferedBy is the player whose draw offer stands once the entry is
+	// applied, for a draw offer entry
+	DrawOfferedBy Player `json:"drawOfferedBy,omitempty"`
+	// TakebackRequestedBy is the player waiting for a takeback, for a
+	// takeback request entry
+	TakebackRequestedBy Player `json:"takebackRequestedBy,omitempty"`
+	// MutedOpponent is which players have muted their opponent, for a mute entry
+	MutedOpponent *[2]bool `json:"mutedOpponent,omitempty"`
+	// Ply is how many moves the game has once the entry is applied. Entries
+	// the snapshot already reflects are recognised by it and skipped.
+	Ply int `json:"ply"`
+	// ClocksMs is the time each player has left once the entry is applied, in milliseconds
+	ClocksMs [2]int64 `json:"clocksMs"`
+}
+
+// appendLog writes an entry for the game to the write-ahead log
+func appendLog(game *Game, kind LogEntryKind) {
+	entry := LogEntry{
+		GameID:   game.ID,
+		Kind:     kind,
+		Ply:      len(game.Moves),
+		ClocksMs: [2]int64{game.Clocks[0].Milliseconds(), game.Clocks[1].Milliseconds()},
+	}
+	switch kind {
+	case LogGameStarted:
+		record := gameRecord(game)
+		entry.Game = &record
+	case LogMove:
+		move := game.Moves[len(game.Moves)-1]
+		entry.Move = &move
+	case LogSession:
+		sessions := game.sessions
+		entry.Sessions = &sessions
+	case LogChat:
+		line := game.Chat[len(game.Chat)-1]
+		entry.Chat = &line
+		entry.ChatLines = len(game.Chat)
+	case LogDrawOffer:
+		entry.DrawOfferedBy = game.DrawOfferedBy
+	case LogTakebackRequest:
+		entry.TakebackRequestedBy = game.TakebackRequestedBy
+	case LogMute:
+		muted := game.mutedOpponent
+		entry.MutedOpponent = &muted
+	}
+
+	if err := gameStore.AppendLog(entry); err != nil {
+		log.Printf("Error logging %s for game %s: %v", kind, game.ID, err)
+	}
+}
+
+// RunCheckpoints periodically snapshots the active games, so the log only
+// needs to be replayed from the last checkpoint
+func (gm *GameManager) RunCheckpoints(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			gm.checkpoint()
+		}
+	}()
+}
+
+// checkpoint writes a snapshot of the games in progress to the game store
+func (gm *GameManager) checkpoint() {
+	// Every entry logged so far is already reflected in the games
+	seq, err := gameStore.LastLogSeq()
+	if err != nil {
+		log.Printf("Error reading log position: %v", err)
+		return
+	}
+
+	records := make([]GameRecord, 0)
+	for _, game := range gm.activeGames() {
+		game.mu.Lock()
+		if game.State == InProgress {
+			records = append(records, gameRecord(game))
+		}
+		game.mu.Unlock()
+	}
+
+	if err := gameStore.Checkpoint(records, seq); err != nil {
+		log.Printf("Error writing checkpoint: %v", err)
+	}
+}
+
+// RecoverGames rebuilds the games that were in progress when the server last
+// stopped from the last snapshot and the log written since. Recovered games
+// are paused until their players reconnect, so the downtime is not charged
+// to either clock.
+func (gm *GameManager) RecoverGames() {
+	snapshot, entries, err := gameStore.Recover()
+	if err != nil {
+		log.Printf("Error reading games to recover: %v", err)
+		return
+	}
+
+	games := make(map[string]*Game)
+	for _, record := range snapshot {
+		game, err := record.Game()
+		if err != nil {
+			log.Printf("Error recovering game %s: %v", record.GameID, err)
+			continue
+		}
+		games[game.ID] = game
+	}
+
+	for _, entry := range entries {
+		if err := applyLogEntry(games, entry); err != nil {
+			log.Printf("Error recovering game %s at log entry %d: %v", entry.GameID, entry.Seq, err)
+			delete(games, entry.GameID)
+		}
+	}
+
+	now := time.Now()
+	recovered := 0
+	for _, game := range games {
+		// A game that finished just before the crash may already be stored
+		if _, finished, _ := gameStore.GetGame(game.ID); finished {
+			continue
+		}
+
+		game.mu.Lock()
+		gm.AddGame(game)
+		if game.State == Finished {
+			completeGame(game)
+		} else {
+			game.Paused = true
+			game.LastMoveAt = now
+			recovered++
+		}
+		game.mu.Unlock()
+	}
+
+	if recovered > 0 {
+		log.Printf("Recovered %d games in progress", recovered)
+	}
+	gm.checkpoint()
+}
+
+// applyLogEntry applies one log entry to the games being recovered
+func applyLogEntry(games map[string]*Game, entry LogEntry) error {
+	if entry.Kind == LogGameStarted {
+		if _, exists := games[entry.GameID]; exists || entry.Game == nil {
+			return nil
+		}
+		game, err := entry.Game.Game()
+		if err != nil {
+			return err
+		}
+		games[game.ID] = game
+		return nil
+	}
+
+	game, exists := games[entry.GameID]
+	if !exists {
+		return nil
+	}
+
+	switch entry.Kind {
+	case LogMove:
+		if entry.Move == nil || len(game.Moves) != entry.Ply-1 {
+			return nil
+		}
+		if err := game.replayMove(*entry.Move); err != nil {
+			return err
+		}
+	case LogTakeback:
+		if len(game.Moves) <= entry.Ply {
+			return nil
+		}
+		for len(game.Moves) > entry.Ply {
+			game.undoMove()
+		}
+		game.TakebackRequestedBy = Empty
+	case LogSession:
+		if entry.Sessions != nil {
+			game.sessions = *entry.Sessions
+		}
+		return nil
+	case LogChat:
+		if entry.Chat != nil && len(game.Chat) == entry.ChatLines-1 {
+			game.Chat = append(game.Chat, *entry.Chat)
+		}
+		return nil
+	case LogDrawOffer:
+		// A move made since has already withdrawn or declined the offer
+		if len(game.Moves) == entry.Ply {
+			game.DrawOfferedBy = entry.DrawOfferedBy
+		}
+		return nil
+	case LogTakebackRequest:
+		if len(game.Moves) == entry.Ply {
+			game.TakebackRequestedBy = entry.TakebackRequestedBy
+		}
+		return nil
+	case LogMute:
+		if entry.MutedOpponent != nil {
+			game.mutedOpponent = *entry.MutedOpponent
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	game.Clocks = [2]time.Duration{
+		time.Duration(entry.ClocksMs[0]) * time.Millisecond,
+		time.Duration(entry.ClocksMs[1]) * time.Millisecond,
+	}
+	return nil
+}
+
+// seatReady reports whether a seat in a recovered game can play: the bot's
+// seat always can, a human's once they have reconnected
+func (g *Game) seatReady(player Player) bool {
+	return (g.IsBotGame && g.BotSeat == player) || g.connFor(player) != nil
+}
+
+// Resume restarts a recovered game once both seats are ready, starting the
+// clock of the player to move afresh. It reports whether the game resumed.
+func (g *Game) Resume(now time.Time) bool {
+	if !g.Paused || !g.seatReady(Player1) || !g.seatReady(Player2) {
+		return false
+	}
+	g.Paused = false
+	g.turnStartedAt = now
+	g.LastMoveAt = now
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recoverableState is the part of a game that must survive a crash
+type recoverableState struct {
+	Moves               []Move
+	Chat                []ChatMessage
+	DrawOfferedBy       Player
+	TakebackRequestedBy Player
+	MutedOpponent       [2]bool
+	Sessions            [2]Session
+}
+
+func stateOf(game *Game) recoverableState {
+	record := gameRecord(game)
+	return recoverableState{
+		Moves:               record.Moves,
+		Chat:                record.Chat,
+		DrawOfferedBy:       record.DrawOfferedBy,
+		TakebackRequestedBy: record.TakebackRequestedBy,
+		MutedOpponent:       record.MutedOpponent,
+		Sessions:            record.Sessions,
+	}
+}
+
+// crash recovers the games in store as a server restarting after a crash
+// would, leaving store as it is
+func crash(t *testing.T, store *MemoryGameStore) *GameManager {
+	t.Helper()
+	snapshot, entries, err := store.Recover()
+	if err != nil {
+		t.Fatalf("reading the store: %v", err)
+	}
+	restarted := NewMemoryGameStore()
+	restarted.snapshot = snapshot
+	restarted.log = entries
+	if len(entries) > 0 {
+		restarted.logSeq = entries[len(entries)-1].Seq
+	}
+
+	saved := gameStore
+	gameStore = restarted
+	defer func() { gameStore = saved }()
+	gm := NewGameManager()
+	gm.RecoverGames()
+	return gm
+}
+
+func TestRecoverGamesAfterEachLogEntry(t *testing.T) {
+	useTestGlobals(t)
+	store := NewMemoryGameStore()
+	gameStore = store
+
+	opts := DefaultGameOptions()
+	opts.Rated = false
+	alice, bob := newTestConnection("alice"), newTestConnection("bob")
+	game := NewGame("game-recovery", "alice", opts)
+	game.Player1Conn = alice
+	game.Player2Conn = bob
+	now := time.Now()
+	var tokens [2]string
+	for i := range tokens {
+		token, session, err := newSession(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[i] = token
+		game.sessions[i] = session
+	}
+	game.StartGame("bob")
+	game.State = InProgress
+	gameManager.AddGame(game)
+	game.mu.Lock()
+	appendLog(game, LogGameStarted)
+	game.mu.Unlock()
+
+	steps := []struct {
+		name string
+		do   func()
+	}{
+		{"start", func() {}},
+		{"move", func() { handleMove(alice, game.ID, 3, MoveDrop) }},
+		{"chat", func() { handleChat(bob, &ChatPayload{GameRef: GameRef{GameID: game.ID}, Text: "good luck"}) }},
+		{"draw offer", func() { handleOfferDraw(bob, game.ID) }},
+		{"checkpoint", func() { gameManager.checkpoint() }},
+		{"chat after the checkpoint", func() { handleChat(alice, &ChatPayload{GameRef: GameRef{GameID: game.ID}, Text: "you too"}) }},
+		{"mute", func() { handleMute(alice, game.ID, true) }},
+		{"draw decline", func() { handleDeclineDraw(alice, game.ID) }},
+		{"second move", func() { handleMove(bob, game.ID, 4, MoveDrop) }},
+		{"takeback request", func() { handleTakebackRequest(bob, game.ID) }},
+		{"takeback", func() { handleTakebackAccept(alice, game.ID) }},
+		{"draw offer withdrawn by a move", func() {
+			handleOfferDraw(bob, game.ID)
+			handleMove(bob, game.ID, 2, MoveDrop)
+		}},
+		{"session", func() {
+			handleReconnect(newTestConnection("alice"), &ReconnectPayload{GameRef: GameRef{GameID: game.ID}, Token: tokens[0]})
+		}},
+		{"unmute", func() { handleMute(alice, game.ID, false) }},
+	}
+
+	for _, step := range steps {
+		step.do()
+		game.mu.Lock()
+		want := stateOf(game)
+		game.mu.Unlock()
+
+		recovered, exists := crash(t, store).GetGame(game.ID)
+		if !exists {
+			t.Fatalf("after %s: game was not recovered", step.name)
+		}
+		if got := stateOf(recovered); !reflect.DeepEqual(got, want) {
+			t.Fatalf("after %s: recovered %+v, want %+v", step.name, got, want)
+		}
+		if !recovered.Paused {
+			t.Fatalf("after %s: recovered game is not paused", step.name)
+		}
+	}
+
+	// Each kind the steps log must have been tried
+	seen := make(map[LogEntryKind]bool)
+	_, entries, _ := store.Recover()
+	for _, entry := range entries {
+		seen[entry.Kind] = true
+	}
+	for _, kind := range []LogEntryKind{LogMove, LogChat, LogDrawOffer, LogMute, LogTakebackRequest, LogTakeback, LogSession} {
+		if !seen[kind] {
+			t.Errorf("no %s entry was logged after the checkpoint", kind)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// SeriesScore is the head-to-head score of a rematch series. It is kept by
+// username because the players swap colors from one game to the next.
+type SeriesScore struct {
+	Players [2]string `json:"players"`
+	Wins    [2]int    `json:"wins"`
+	Draws   int       `json:"draws"`
+}
+
+// Series returns the score of the series this game belongs to, counting
+// this game once it has finished
+func (g *Game) Series() SeriesScore {
+	score := g.seriesBefore
+	if score.Players[0] == "" {
+		score.Players = [2]string{g.Player1, g.Player2}
+	}
+
+	if g.State != Finished {
+		return score
+	}
+	if g.IsDraw {
+		score.Draws++
+		return score
+	}
+	for i, name := range score.Players {
+		if name == g.WinnerName() {
+			score.Wins[i]++
+		}
+	}
+	return score
+}
+
+// RequestRematch asks the opponent for a rematch of a finished game
+func (g *Game) RequestRematch(player Player) error {
+	if g.State != Finished {
+		return errors.New("the game is not over yet")
+	}
+
+	if g.RematchGameID != "" {
+		return errors.New("a rematch has already started")
+	}
+
+	if g.RematchRequestedBy == player {
+		return errors.New("you have already asked for a rematch")
+	}
+
+	g.RematchRequestedBy = player
+	return nil
+}
+
+// AcceptRematch accepts the opponent's rematch request and starts the
+// rematch, played by the same two players with colors swapped
+func (g *Game) AcceptRematch(player Player, id string) (*Game, error) {
+	if g.RematchRequestedBy != opponent(player) {
+		return nil, errors.New("there is no rematch request to accept")
+	}
+
+	if g.RematchGameID != "" {
+		return nil, errors.New("a rematch has already started")
+	}
+
+	rematch := NewGame(id, g.Player2, g.Options())
+	rematch.Player1Conn = g.Player2Conn
+	rematch.Player2Conn = g.Player1Conn
+	rematch.IsBotGame = g.IsBotGame
+	rematch.Private = g.Private
+	rematch.BotDifficulty = g.BotDifficulty
+	if g.IsBotGame {
+		rematch.BotSeat = opponent(g.BotSeat)
+	}
+	rematch.PreviousGameID = g.ID
+	rematch.seriesBefore = g.Series()
+	// Mutes carry over, following each player to their new color
+	rematch.mutedOpponent = [2]bool{g.mutedOpponent[1], g.mutedOpponent[0]}
+	// So do sessions, so each player's token keeps working for the rematch
+	rematch.sessions = [2]Session{g.sessions[1], g.sessions[0]}
+	rematch.StartGame(g.Player1)
+
+	g.RematchGameID = id
+	g.RematchRequestedBy = Empty
+	return rematch, nil
+}
+
+// handleRematchRequest handles a player asking for a rematch after a game.
+// The bot accepts at once; a human opponent is asked to accept.
+func handleRematchRequest(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	// Both players asking for a rematch agree to it
+	if game.RematchRequestedBy == opponent(player) {
+		startRematch(game, player)
+		return
+	}
+
+	opponentConn := game.connFor(opponent(player))
+	if !game.IsBotGame && (opponentConn == nil || opponentConn.GameID() != game.ID) {
+		sendError(conn, ErrOpponentLeft, "your opponent has left the game")
+		return
+	}
+
+	if err := game.RequestRematch(player); err != nil {
+		sendError(conn, ErrIllegalAction, err.Error())
+		return
+	}
+
+	if game.IsBotGame {
+		startRematch(game, game.BotSeat)
+		return
+	}
+
+	publishGameEvent(game, toPlayer(opponent(player)), "REMATCH_REQUEST", RematchRequestedPayload{PlayerNotice{
+		GameID:   game.ID,
+		Username: conn.username,
+	}})
+	broadcastGameUpdate(game)
+}
+
+// handleRematchAccept handles a player accepting their opponent's rematch request
+func handleRematchAccept(conn *Connection, gameID string) {
+	game, player, ok := findPlayerGame(conn, gameID)
+	if !ok {
+		return
+	}
+	defer game.mu.Unlock()
+
+	startRematch(game, player)
+}
+
+// startRematch accepts a pending rematch on behalf of player and moves both
+// connections to the new game. The caller must hold the game's lock.
+func startRematch(game *Game, player Player) {
+	rematch, err := game.AcceptRematch(player, generateGameID())
+	if err != nil {
+		if conn := game.connFor(player); conn != nil {
+			sendError(conn, ErrIllegalAction, err.Error())
+		}
+		return
+	}
+	rematch.mu.Lock()
+	defer rematch.mu.Unlock()
+
+	gameManager.AddGame(rematch)
+	appendLog(rematch, LogGameStarted)
+	// The finished game now links to its rematch
+	saveGame(game)
+	for _, conn := range []*Connection{rematch.Player1Conn, rematch.Player2Conn} {
+		if conn != nil {
+			conn.SetGameID(rematch.ID)
+		}
+	}
+
+	eventProducer.PublishEvent(Event{
+		Type:           "GAME_STARTED",
+		GameID:         rematch.ID,
+		Player1:        rematch.Player1,
+		Player2:        rematch.Player2,
+		Difficulty:     string(rematch.BotDifficulty),
+		PreviousGameID: game.ID,
+		Timestamp:      time.Now(),
+	})
+
+	broadcastGameUpdate(game)
+	sendGameState(rematch, rematch.Player1Conn)
+	sendGameState(rematch, rematch.Player2Conn)
+	scheduleFlagCheck(rematch)
+	scheduleBotMove(rematch)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rematch has requester ask for a rematch of the finished game and the
+// opponent accept, and returns the rematch
+func rematch(t *testing.T, game *Game, requester, accepter *Connection) *Game {
+	t.Helper()
+	handleRematchRequest(requester, game.ID)
+	handleRematchAccept(accepter, game.ID)
+	for _, conn := range []*Connection{requester, accepter} {
+		if code := lastError(t, conn); code != "" {
+			t.Fatalf("%s got %s", conn.username, code)
+		}
+	}
+	next, exists := gameManager.GetGame(game.RematchGameID)
+	if !exists {
+		t.Fatal("no rematch started")
+	}
+	return next
+}
+
+func TestRematchSeries(t *testing.T) {
+	useTestGlobals(t)
+	first, alice, bob := startTestGame(t, DefaultGameOptions())
+	alice.SetGameID(first.ID)
+	bob.SetGameID(first.ID)
+	handleResign(alice, first.ID)
+
+	// The rematch swaps colors, links back to the first game and moves both
+	// connections to it
+	second := rematch(t, first, alice, bob)
+	if second.Player1 != "bob" || second.Player2 != "alice" || second.Player1Conn != bob || second.Player2Conn != alice {
+		t.Fatalf("rematch is %s against %s, want bob against alice", second.Player1, second.Player2)
+	}
+	if second.PreviousGameID != first.ID || second.State != InProgress || second.CurrentTurn != Player1 {
+		t.Fatalf("rematch after %q is %v with player %d to move, want %s in progress with bob to move", second.PreviousGameID, second.State, second.CurrentTurn, first.ID)
+	}
+	if alice.GameID() != second.ID || bob.GameID() != second.ID {
+		t.Fatalf("connections are on %s and %s, want the rematch %s", alice.GameID(), bob.GameID(), second.ID)
+	}
+	if record, _, _ := gameStore.GetGame(first.ID); record.RematchGameID != second.ID {
+		t.Fatalf("stored first game links to rematch %q, want %s", record.RematchGameID, second.ID)
+	}
+
+	// The score follows the players across colors
+	want := SeriesScore{Players: [2]string{"alice", "bob"}, Wins: [2]int{0, 1}}
+	if score := second.Series(); score != want {
+		t.Fatalf("score during the rematch %+v, want %+v", score, want)
+	}
+	handleResign(bob, second.ID)
+	want.Wins[0]++
+	if score := second.Series(); score != want {
+		t.Fatalf("score after the rematch %+v, want %+v", score, want)
+	}
+
+	third := rematch(t, second, alice, bob)
+	if third.Player1 != "alice" || third.PreviousGameID != second.ID {
+		t.Fatalf("third game is %s against %s after %q, want alice against bob after %s", third.Player1, third.Player2, third.PreviousGameID, second.ID)
+	}
+	handleOfferDraw(alice, third.ID)
+	handleAcceptDraw(bob, third.ID)
+	want.Draws++
+	if score := third.Series(); score != want {
+		t.Fatalf("score after a drawn third game %+v, want %+v", score, want)
+	}
+	if status := lastStatus(t, bob); status.Series != want {
+		t.Fatalf("players told the score is %+v, want %+v", status.Series, want)
+	}
+
+	// A game has only one rematch
+	handleRematchRequest(alice, second.ID)
+	if code := lastError(t, alice); code == "" {
+		t.Fatal("second rematch of the same game was allowed")
+	}
+}
+
+func TestBotRematch(t *testing.T) {
+	useTestGlobals(t)
+	alice := newTestConnection("alice")
+	game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	game.Player1Conn = alice
+	game.IsBotGame = true
+	game.Rated = false
+	game.BotDifficulty = DifficultyEasy
+	game.BotSeat = Player2
+	game.StartGame("Bot")
+	gameManager.AddGame(game)
+	alice.SetGameID(game.ID)
+	handleResign(alice, game.ID)
+
+	// The bot accepts at once and takes the other color
+	handleRematchRequest(alice, game.ID)
+	if code := lastError(t, alice); code != "" {
+		t.Fatalf("asking the bot for a rematch got %s", code)
+	}
+	next, exists := gameManager.GetGame(game.RematchGameID)
+	if !exists {
+		t.Fatal("no rematch started")
+	}
+
+	next.mu.Lock()
+	if !next.IsBotGame || next.BotSeat != Player1 || next.Player1 != "Bot" || next.Player2Conn != alice || next.BotDifficulty != DifficultyEasy || next.Rated {
+		t.Fatalf("rematch %s against %s with the bot in seat %d, want the bot as player 1", next.Player1, next.Player2, next.BotSeat)
+	}
+	next.mu.Unlock()
+
+	// so it makes the first move
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		next.mu.Lock()
+		moves := len(next.Moves)
+		next.mu.Unlock()
+		if moves > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the bot did not move first in the rematch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if next.Moves[0].Player != Player1 || next.CurrentTurn != Player2 {
+		t.Fatalf("first move by player %d with player %d to move, want the bot's move then alice's turn", next.Moves[0].Player, next.CurrentTurn)
+	}
+}
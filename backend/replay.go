@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Replay speeds. A speed of 1 plays one move per ReplayBaseInterval.
+const (
+	ReplayBaseInterval = time.Second
+	MinReplaySpeed     = 0.25
+	MaxReplaySpeed     = 10
+)
+
+// GameReplay is the full record of a finished game, as returned by GET /games/{id}/replay
+type GameReplay struct {
+	GameID    string `json:"gameId"`
+	Player1   string `json:"player1"`
+	Player2   string `json:"player2"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	WinLength int    `json:"winLength"`
+	Variant   string `json:"variant"`
+	// StartPosition is the board string the game started from, or empty for the empty board
+	StartPosition string     `json:"startPosition,omitempty"`
+	MoveString    string     `json:"moveString"`
+	TimeControl   string     `json:"timeControl,omitempty"`
+	Winner        int        `json:"winner"`
+	IsDraw        bool       `json:"isDraw"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	EndedAt       *time.Time `json:"endedAt,omitempty"`
+	Moves         []Move     `json:"moves"`
+	// Chat is the game's chat, as delivered after filtering
+	Chat []ChatMessage `json:"chat,omitempty"`
+}
+
+// ReplayFrame is one position streamed in response to a REPLAY message.
+// Ply 0 is the starting position and has no move.
+type ReplayFrame struct {
+	Ply   int     `json:"ply"`
+	Total int     `json:"total"`
+	Move  *Move   `json:"move,omitempty"`
+	Board [][]int `json:"board"`
+}
+
+// buildReplay collects the replay record of a game
+func buildReplay(game *Game) GameReplay {
+	moves := make([]Move, len(game.Moves))
+	copy(moves, game.Moves)
+	chat := make([]ChatMessage, len(game.Chat))
+	copy(chat, game.Chat)
+
+	return GameReplay{
+		GameID:        game.ID,
+		Player1:       game.Player1,
+		Player2:       game.Player2,
+		Width:         game.Width,
+		Height:        game.Height,
+		WinLength:     game.WinLength,
+		Variant:       string(game.Variant),
+		StartPosition: game.StartPosition,
+		MoveString:    game.MoveString(),
+		TimeControl:   game.TimeControl.String(),
+		Winner:        int(game.Winner),
+		IsDraw:        game.IsDraw,
+		StartedAt:     game.StartedAt,
+		EndedAt:       game.EndedAt,
+		Moves:         moves,
+		Chat:          chat,
+	}
+}
+
+// replayFrames rebuilds the starting position and the position after every move
+func replayFrames(replay GameReplay) []ReplayFrame {
+	board := NewBitboard(replay.Width, replay.Height, replay.WinLength)
+	if replay.StartPosition != "" {
+		opts := GameOptions{
+			Width:     replay.Width,
+			Height:    replay.Height,
+			WinLength: replay.WinLength,
+			Variant:   Variant(replay.Variant),
+		}
+		board, _, _ = ParsePosition(replay.StartPosition, opts)
+	}
+	total := len(replay.Moves)
+
+	frames := make([]ReplayFrame, 0, total+1)
+	frames = append(frames, ReplayFrame{Ply: 0, Total: total, Board: boardToInts(board.Array())})
+	for i := range replay.Moves {
+		move := replay.Moves[i]
+		if move.Kind == MovePop {
+			board.Pop(move.Column)
+		} else {
+			board.Play(move.Column, move.Player)
+		}
+		frames = append(frames, ReplayFrame{
+			Ply:   i + 1,
+			Total: total,
+			Move:  &move,
+			Board: boardToInts(board.Array()),
+		})
+	}
+
+	return frames
+}
+
+// boardToInts converts a board to plain ints for JSON
+func boardToInts(board [][]Player) [][]int {
+	ints := make([][]int, len(board))
+	for r, row := range board {
+		ints[r] = make([]int, len(row))
+		for c, cell := range row {
+			ints[r][c] = int(cell)
+		}
+	}
+	return ints
+}
+
+// handleReplayHTTP handles GET /games/{id}/replay
+func handleReplayHTTP(w http.ResponseWriter, r *http.Request, gameID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	game, exists := gameManager.GetGame(gameID)
+	if !exists {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return
+	}
+
+	game.mu.Lock()
+	finished := game.State == Finished
+	var replay GameReplay
+	if finished {
+		replay = buildReplay(game)
+	}
+	game.mu.Unlock()
+
+	if !finished {
+		http.Error(w, "game is still in progress", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(replay)
+}
+
+// handleGamesHTTP routes requests under /games/
+func handleGamesHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/games/"), "/"), "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "replay" {
+		handleReplayHTTP(w, r, parts[0])
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handleReplay streams a finished game to the connection one position at a time.
+// A new REPLAY message replaces any replay already streaming to the connection.
+func handleReplay(conn *Connection, p *ReplayPayload) {
+	if p.GameID == "" {
+		sendError(conn, ErrInvalidPayload, "game ID is required")
+		return
+	}
+
+	game, exists := gameManager.GetGame(p.GameID)
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return
+	}
+
+	game.mu.Lock()
+	finished := game.State == Finished
+	var replay GameReplay
+	if finished {
+		replay = buildReplay(game)
+	}
+	game.mu.Unlock()
+
+	if !finished {
+		sendError(conn, ErrGameNotFinished, "game is still in progress")
+		return
+	}
+
+	speed := p.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	if speed < MinReplaySpeed || speed > MaxReplaySpeed {
+		sendError(conn, ErrInvalidPayload, "replay speed must be between 0.25 and 10")
+		return
+	}
+
+	interval := time.Duration(float64(ReplayBaseInterval) / speed)
+	stop := conn.startReplay()
+
+	go streamReplay(conn, replay, interval, stop)
+}
+
+// streamReplay sends a REPLAY_FRAME for every position, then REPLAY_END
+func streamReplay(conn *Connection, replay GameReplay, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i, frame := range replayFrames(replay) {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			case <-conn.done:
+				return
+			}
+		}
+		sendMessage(conn, "REPLAY_FRAME", ReplayFramePayload{GameID: replay.GameID, ReplayFrame: frame})
+	}
+
+	sendMessage(conn, "REPLAY_END", ReplayEndPayload{GameID: replay.GameID})
+}
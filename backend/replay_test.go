@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGenerateGameIDIsUniqueAndURLSafe(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := generateGameID()
+		if seen[id] {
+			t.Fatalf("game ID %q generated twice", id)
+		}
+		seen[id] = true
+		if escaped := url.PathEscape(id); escaped != id {
+			t.Fatalf("game ID %q needs escaping in a path: %q", id, escaped)
+		}
+	}
+}
+
+func TestReplayHTTP(t *testing.T) {
+	useTestGlobals(t)
+
+	finished := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	finished.StartGame("bob")
+	finished.MakeMove(3, Player1)
+	finished.Forfeit(Player2, EndReasonResignation)
+	gameManager.AddGame(finished)
+
+	inProgress := NewGame(generateGameID(), "carol", DefaultGameOptions())
+	inProgress.StartGame("dave")
+	gameManager.AddGame(inProgress)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"finished game", http.MethodGet, "/games/" + finished.ID + "/replay", http.StatusOK},
+		{"trailing slash", http.MethodGet, "/games/" + finished.ID + "/replay/", http.StatusOK},
+		{"game in progress", http.MethodGet, "/games/" + inProgress.ID + "/replay", http.StatusConflict},
+		{"unknown game", http.MethodGet, "/games/" + generateGameID() + "/replay", http.StatusNotFound},
+		{"missing game ID", http.MethodGet, "/games//replay", http.StatusNotFound},
+		{"other path", http.MethodGet, "/games/" + finished.ID, http.StatusNotFound},
+		{"wrong method", http.MethodPost, "/games/" + finished.ID + "/replay", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleGamesHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var replay GameReplay
+			if err := json.NewDecoder(rec.Body).Decode(&replay); err != nil {
+				t.Fatal(err)
+			}
+			if replay.GameID != finished.ID || replay.MoveString != finished.MoveString() || len(replay.Moves) != 1 {
+				t.Fatalf("replay = %+v", replay)
+			}
+		})
+	}
+}
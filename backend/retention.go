@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// RetentionSweepInterval is how often completed games are checked against the maximum age
+const RetentionSweepInterval = time.Minute
+
+// ArchiveSink receives completed games as they are evicted from memory
+type ArchiveSink interface {
+	Archive(game *Game) error
+}
+
+// storeArchive archives evicted games to the game store. The store already
+// has each game from when it finished; archiving saves it again so anything
+// added since, such as post-game chat, is kept.
+type storeArchive struct{}
+
+// Archive saves the game's final record to the game store
+func (storeArchive) Archive(game *Game) error {
+	game.mu.Lock()
+	record := gameRecord(game)
+	game.mu.Unlock()
+	return gameStore.SaveGame(record)
+}
+
+// archiveSink receives the completed games evicted by the retention policy
+var archiveSink ArchiveSink = storeArchive{}
+
+// RunRetention periodically evicts completed games that are older than the
+// configured maximum age, and evicts games over the limit as soon as a
+// completed game is added
+func (gm *GameManager) RunRetention() {
+	ticker := time.NewTicker(RetentionSweepInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+			case <-gm.evict:
+			}
+			gm.evictCompletedGames(time.Now())
+		}
+	}()
+}
+
+// evictCompletedGames moves completed games out of memory and into the
+// archive, oldest first, while there are more than the configured limit or
+// the oldest has been completed for longer than the maximum age. A limit or
+// maximum age of zero leaves that bound off.
+func (gm *GameManager) evictCompletedGames(now time.Time) {
+	gm.mu.Lock()
+	evicted := []*Game{}
+	for len(gm.completedOrder) > 0 {
+		oldest := gm.completedOrder[0]
+		overLimit := config.CompletedGameLimit > 0 && len(gm.completedOrder) > config.CompletedGameLimit
+		tooOld := config.CompletedGameMaxAge > 0 && now.Sub(oldest.completedAt) > config.CompletedGameMaxAge
+		if !overLimit && !tooOld {
+			break
+		}
+
+		gm.completedOrder = gm.completedOrder[1:]
+		if game, exists := gm.completedGames[oldest.gameID]; exists {
+			delete(gm.completedGames, oldest.gameID)
+			unindex(gm.completedByPlayer, game)
+			evicted = append(evicted, game)
+		}
+	}
+	gm.mu.Unlock()
+
+	for _, game := range evicted {
+		// No one can reconnect to a game once it has left memory
+		game.mu.Lock()
+		game.revokeSessions()
+		game.mu.Unlock()
+		if err := archiveSink.Archive(game); err != nil {
+			log.Printf("Error archiving game %s: %v", game.ID, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingArchive records the IDs of the games archived to it
+type recordingArchive struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (a *recordingArchive) Archive(game *Game) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ids = append(a.ids, game.ID)
+	return nil
+}
+
+func TestCompleteGameLeavesEvictionToRetentionLoop(t *testing.T) {
+	useTestGlobals(t)
+	config.CompletedGameLimit = 1
+	config.CompletedGameMaxAge = 0
+	archive := &recordingArchive{}
+	archiveSink = archive
+
+	gm := NewGameManager()
+	games := []*Game{
+		NewGame(generateGameID(), "alice", DefaultGameOptions()),
+		NewGame(generateGameID(), "carol", DefaultGameOptions()),
+	}
+	games[0].StartGame("bob")
+	games[1].StartGame("dave")
+
+	// Both games finish at once, each completed under its own lock as the
+	// handlers do
+	var wg sync.WaitGroup
+	for _, game := range games {
+		gm.AddGame(game)
+		wg.Add(1)
+		go func(game *Game) {
+			defer wg.Done()
+			game.mu.Lock()
+			defer game.mu.Unlock()
+			game.Forfeit(Player2, EndReasonResignation)
+			gm.CompleteGame(game.ID)
+		}(game)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("completing two games at once deadlocked")
+	}
+
+	if len(archive.ids) != 0 {
+		t.Fatalf("games were evicted while completing: %v", archive.ids)
+	}
+	select {
+	case <-gm.evict:
+	default:
+		t.Fatal("completing a game over the limit did not ask for a sweep")
+	}
+
+	gm.evictCompletedGames(time.Now())
+	if len(gm.completedGames) != 1 || len(archive.ids) != 1 {
+		t.Fatalf("want one game kept and one archived, got %d kept and %v archived", len(gm.completedGames), archive.ids)
+	}
+	if _, kept := gm.completedGames[archive.ids[0]]; kept {
+		t.Fatalf("archived game %s is still in memory", archive.ids[0])
+	}
+	checkUnindexed(t, gm, archive.ids[0])
+}
+
+func TestLoadedGamesAreShared(t *testing.T) {
+	useTestGlobals(t)
+	config.CompletedGameLimit = 0
+	config.CompletedGameMaxAge = time.Hour
+	archive := &recordingArchive{}
+	archiveSink = archive
+
+	// A finished game that has already been evicted from memory
+	game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	game.StartGame("bob")
+	game.Forfeit(Player2, EndReasonResignation)
+	if err := gameStore.SaveGame(gameRecord(game)); err != nil {
+		t.Fatal(err)
+	}
+
+	gm := NewGameManager()
+	loaded := make([]*Game, 20)
+	var wg sync.WaitGroup
+	for i := range loaded {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				loaded[i], _ = gm.GetGame(game.ID)
+			} else {
+				loaded[i], _ = gm.GetGameByUsername("bob")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, g := range loaded {
+		if g == nil || g != loaded[0] {
+			t.Fatalf("lookup %d returned %p, want the game every other lookup shares, %p", i, g, loaded[0])
+		}
+	}
+	if loaded[0].ID != game.ID || loaded[0].Winner != Player1 {
+		t.Fatalf("loaded game %s won by %d, want %s won by 1", loaded[0].ID, loaded[0].Winner, game.ID)
+	}
+
+	// The loaded game leaves memory again like any completed game
+	gm.evictCompletedGames(time.Now().Add(2 * time.Hour))
+	if _, kept := gm.completedGames[game.ID]; kept || len(archive.ids) != 1 {
+		t.Fatalf("loaded game kept %v after its maximum age, archived %v", kept, archive.ids)
+	}
+}
+
+// checkUnindexed fails the test if either player index still points at the game
+func checkUnindexed(t *testing.T, gm *GameManager, gameID string) {
+	t.Helper()
+	for _, index := range []map[string]string{gm.activeByPlayer, gm.completedByPlayer} {
+		for username, id := range index {
+			if id == gameID {
+				t.Fatalf("evicted game %s is still indexed for %s", gameID, username)
+			}
+		}
+	}
+}
+
+func TestPausedGameEndsAfterReconnectTimeout(t *testing.T) {
+	useTestGlobals(t)
+	config.ReconnectTimeout = time.Minute
+	config.CompletedGameLimit = 0
+	config.CompletedGameMaxAge = time.Hour
+
+	tests := []struct {
+		name     string
+		pausedAt time.Duration
+		returned []Player
+		// reason is how the game ends, or empty if it stays paused
+		reason EndReason
+		winner Player
+	}{
+		{"neither back in time", 2 * time.Minute, nil, EndReasonAbandoned, Empty},
+		{"one back in time", 2 * time.Minute, []Player{Player2}, EndReasonTimeout, Player2},
+		{"before the timeout", 30 * time.Second, nil, "", Empty},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gameManager = NewGameManager()
+			archive := &recordingArchive{}
+			archiveSink = archive
+
+			// A game recovered after a restart, as RecoverGames leaves it
+			game := NewGame(generateGameID(), "alice", DefaultGameOptions())
+			game.StartGame("bob")
+			game.State = InProgress
+			game.Paused = true
+			game.LastMoveAt = time.Now().Add(-tt.pausedAt)
+			for _, player := range tt.returned {
+				game.setConn(player, newTestConnection(game.playerName(player)))
+			}
+			gameManager.AddGame(game)
+
+			gameManager.checkDisconnection(game)
+			if tt.reason == "" {
+				if game.State != InProgress || !game.Paused {
+					t.Fatalf("game ended by %s before the timeout", game.EndReason)
+				}
+				return
+			}
+			if game.State != Finished || game.EndReason != tt.reason || game.Winner != tt.winner || game.IsDraw {
+				t.Fatalf("game ended by %q won by %d, draw %v; want %q won by %d", game.EndReason, game.Winner, game.IsDraw, tt.reason, tt.winner)
+			}
+			if _, active := gameManager.activeByPlayer["alice"]; active {
+				t.Fatal("ended game is still indexed as alice's active game")
+			}
+
+			// The ended game leaves memory with the other completed games
+			gameManager.evictCompletedGames(time.Now().Add(2 * time.Hour))
+			if len(archive.ids) != 1 || archive.ids[0] != game.ID {
+				t.Fatalf("archived %v, want %s", archive.ids, game.ID)
+			}
+			if _, kept := gameManager.completedGames[game.ID]; kept {
+				t.Fatalf("game %s is still in memory", game.ID)
+			}
+			checkUnindexed(t, gameManager, game.ID)
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invite codes are RoomCodeLength characters from an alphabet without
+// look-alike characters such as 0/O and 1/I/L, so they are easy to read out
+const (
+	RoomCodeLength    = 6
+	roomCodeAlphabet  = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	RoomSweepInterval = 10 * time.Second
+)
+
+// RoomStatus is where a private room is in its life
+type RoomStatus string
+
+const (
+	RoomWaiting RoomStatus = "waiting"
+	RoomStarted RoomStatus = "started"
+	RoomExpired RoomStatus = "expired"
+)
+
+// Room is a private game that only a player with its invite code can join
+type Room struct {
+	Code   string     `json:"code"`
+	GameID string     `json:"gameId"`
+	Host   string     `json:"host"`
+	Guest  string     `json:"guest,omitempty"`
+	Status RoomStatus `json:"status"`
+	// Rated rooms cannot be joined by guests
+	Rated     bool      `json:"rated"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// ClosedAt is when the room started or expired
+	ClosedAt *time.Time `json:"closedAt,omitempty"`
+}
+
+// RoomManager manages private rooms by invite code. Closed rooms are kept for
+// one more idle timeout so their status can still be checked.
+type RoomManager struct {
+	rooms map[string]*Room
+	mu    sync.RWMutex
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms: make(map[string]*Room),
+	}
+}
+
+// generateRoomCode returns a random invite code
+func generateRoomCode() (string, error) {
+	code := make([]byte, RoomCodeLength)
+	max := big.NewInt(int64(len(roomCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = roomCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeRoomCode makes code lookups ignore case and surrounding spaces
+func normalizeRoomCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CreateRoom opens a room for a waiting game and returns it
+func (rm *RoomManager) CreateRoom(game *Game) (*Room, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	var code string
+	for {
+		var err error
+		code, err = generateRoomCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, taken := rm.rooms[code]; !taken {
+			break
+		}
+	}
+
+	now := time.Now()
+	room := &Room{
+		Code:      code,
+		GameID:    game.ID,
+		Host:      game.Player1,
+		Status:    RoomWaiting,
+		Rated:     game.Rated,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.RoomIdleTimeout),
+	}
+	rm.rooms[code] = room
+	return room, nil
+}
+
+// GetRoom returns a copy of the room with the given code
+func (rm *RoomManager) GetRoom(code string) (Room, bool) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	room, exists := rm.rooms[normalizeRoomCode(code)]
+	if !exists {
+		return Room{}, false
+	}
+	return *room, true
+}
+
+// ClaimRoom marks a waiting room as started by guest at now and returns it. A
+// guest without an account can only claim a casual room. The caller must hold
+// the lock of the room's game and call it only once the guest can be seated,
+// so the room is never left started without its game.
+func (rm *RoomManager) ClaimRoom(code, guest string, casualOnly bool, now time.Time) (Room, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	room, exists := rm.rooms[normalizeRoomCode(code)]
+	if !exists {
+		return Room{}, errRoomNotFound
+	}
+	if err := room.checkGuest(guest, casualOnly, now); err != nil {
+		return Room{}, err
+	}
+
+	room.Status = RoomStarted
+	room.Guest = guest
+	room.ClosedAt = &now
+	return *room, nil
+}
+
+// checkGuest reports why guest cannot join the room at now, if they cannot. A
+// room past its expiry time is expired even before the sweep closes it.
+func (room *Room) checkGuest(guest string, casualOnly bool, now time.Time) error {
+	switch {
+	case room.Status == RoomExpired:
+		return errRoomExpired
+	case room.Status == RoomStarted:
+		return errRoomStarted
+	case now.After(room.ExpiresAt):
+		return errRoomExpired
+	case room.Host == guest:
+		return errOwnRoom
+	case room.Rated && casualOnly:
+		return errRoomRated
+	}
+	return nil
+}
+
+// ExpireIdleRooms periodically expires rooms nobody has joined in time and
+// forgets closed rooms once they have been closed for an idle timeout
+func (rm *RoomManager) ExpireIdleRooms() {
+	ticker := time.NewTicker(RoomSweepInterval)
+	go func() {
+		for range ticker.C {
+			rm.expireRooms(time.Now())
+		}
+	}()
+}
+
+// expireRooms closes the waiting rooms that have expired by now
+func (rm *RoomManager) expireRooms(now time.Time) {
+	rm.mu.Lock()
+	expired := []*Room{}
+	for code, room := range rm.rooms {
+		if room.ClosedAt != nil {
+			if now.Sub(*room.ClosedAt) > config.RoomIdleTimeout {
+				delete(rm.rooms, code)
+			}
+			continue
+		}
+		if now.After(room.ExpiresAt) {
+			room.Status = RoomExpired
+			closedAt := now
+			room.ClosedAt = &closedAt
+			expired = append(expired, room)
+		}
+	}
+	rm.mu.Unlock()
+
+	for _, room := range expired {
+		game, exists := gameManager.GetGame(room.GameID)
+		if !exists {
+			continue
+		}
+		gameManager.RemoveGame(room.GameID)
+		game.mu.Lock()
+		if game.Player1Conn != nil {
+			sendMessage(game.Player1Conn, "ROOM_EXPIRED", RoomExpiredPayload{GameID: room.GameID, Code: room.Code})
+		}
+		game.mu.Unlock()
+	}
+}
+
+// Room errors sent back to a player trying to join
+var (
+	errRoomNotFound = errors.New("no room has that invite code")
+	errRoomExpired  = errors.New("that room has expired")
+	errRoomStarted  = errors.New("that room's game has already started")
+	errOwnRoom      = errors.New("you cannot join your own room")
+	errRoomRated    = errors.New("that room is rated, so log in to join it")
+)
+
+// handleCreateRoom handles a player opening a private room. The room's game
+// waits for a guest with the invite code instead of going through matchmaking,
+// so there is no bot fallback.
+func handleCreateRoom(conn *Connection, p *CreateRoomPayload) {
+	opts, err := gameOptionsFromRules(conn, p.GameRules)
+	if err != nil {
+		sendError(conn, ErrInvalidOptions, err.Error())
+		return
+	}
+
+	token, session, err := newSession(time.Now())
+	if err != nil {
+		sendError(conn, ErrInternal, "could not start a session")
+		return
+	}
+
+	game := NewGame(generateGameID(), conn.username, opts)
+	game.Player1Conn = conn
+	game.sessions[0] = session
+	game.Private = true
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	room, err := roomManager.CreateRoom(game)
+	if err != nil {
+		sendError(conn, ErrInternal, "could not create a room")
+		return
+	}
+	gameManager.AddGame(game)
+	conn.SetGameID(game.ID)
+
+	sendMessage(conn, "ROOM_CREATED", RoomCreatedPayload{
+		GameID:   game.ID,
+		Username: conn.username,
+		Code:     room.Code,
+		Token:    token,
+	})
+	sendGameState(game, conn)
+}
+
+// handleJoinRoom handles a player joining a private room with its invite code
+func handleJoinRoom(conn *Connection, p *JoinRoomPayload) {
+	if p.Code == "" {
+		sendError(conn, ErrInvalidPayload, "invite code is required")
+		return
+	}
+
+	room, exists := roomManager.GetRoom(p.Code)
+	if !exists {
+		sendError(conn, ErrRoomUnavailable, errRoomNotFound.Error())
+		return
+	}
+	if err := room.checkGuest(conn.username, conn.guest, time.Now()); err != nil {
+		sendError(conn, ErrRoomUnavailable, err.Error())
+		return
+	}
+
+	game, exists := gameManager.GetGame(room.GameID)
+	if !exists {
+		sendError(conn, ErrRoomUnavailable, "that room's game is no longer available")
+		return
+	}
+
+	token, session, err := newSession(time.Now())
+	if err != nil {
+		sendError(conn, ErrInternal, "could not start a session")
+		return
+	}
+
+	// Claiming the room under the game's lock decides between two guests, or
+	// a guest and the room expiring. The game waits for as long as the room
+	// does, so a claimed room's game can always be started.
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	room, err = roomManager.ClaimRoom(p.Code, conn.username, conn.guest, time.Now())
+	if err != nil {
+		sendError(conn, ErrRoomUnavailable, err.Error())
+		return
+	}
+
+	conn.SetGameID(game.ID)
+
+	game.Player2Conn = conn
+	game.sessions[1] = session
+	game.StartGame(conn.username)
+	gameManager.IndexPlayers(game)
+	appendLog(game, LogGameStarted)
+
+	sendMessage(conn, "JOINED", JoinedPayload{
+		GameID:   game.ID,
+		Username: conn.username,
+		Code:     room.Code,
+		Token:    token,
+	})
+	sendGameState(game, game.Player1Conn)
+	sendGameState(game, game.Player2Conn)
+	scheduleFlagCheck(game)
+
+	eventProducer.PublishEvent(Event{
+		Type:      "GAME_STARTED",
+		GameID:    game.ID,
+		Player1:   game.Player1,
+		Player2:   game.Player2,
+		Timestamp: time.Now(),
+	})
+}
+
+// handleRoomHTTP handles GET /rooms/{code}, reporting whether a room is
+// waiting for a guest, has started or has expired
+func handleRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, exists := roomManager.GetRoom(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/"))
+	if !exists {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(room)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// createTestRoom has the host create a room and returns its code and game ID
+func createTestRoom(t *testing.T, host *Connection, p *CreateRoomPayload) RoomCreatedPayload {
+	t.Helper()
+	handleCreateRoom(host, p)
+	var created RoomCreatedPayload
+	for _, m := range sent(t, host) {
+		if m.Type == "ROOM_CREATED" {
+			json.Unmarshal(m.Payload, &created)
+		}
+	}
+	if created.Code == "" {
+		t.Fatalf("room was not created: %s", lastError(t, host))
+	}
+	return created
+}
+
+func TestJoinRoomRace(t *testing.T) {
+	useTestGlobals(t)
+	created := createTestRoom(t, newTestConnection("alice"), &CreateRoomPayload{})
+
+	// Every guest tries to join at once and only one is seated
+	guests := make([]*Connection, 10)
+	var wg sync.WaitGroup
+	for i := range guests {
+		guests[i] = newTestConnection("guest" + string(rune('a'+i)))
+		wg.Add(1)
+		go func(conn *Connection) {
+			defer wg.Done()
+			handleJoinRoom(conn, &JoinRoomPayload{Code: created.Code})
+		}(guests[i])
+	}
+	wg.Wait()
+
+	var winner string
+	for _, conn := range guests {
+		joined := false
+		for _, m := range sent(t, conn) {
+			switch m.Type {
+			case "JOINED":
+				joined = true
+			case "ERROR":
+				var e ErrorPayload
+				json.Unmarshal(m.Payload, &e)
+				if e.Code != ErrRoomUnavailable || e.Message != errRoomStarted.Error() {
+					t.Fatalf("%s was turned away with %s: %s", conn.username, e.Code, e.Message)
+				}
+			}
+		}
+		if joined {
+			if winner != "" {
+				t.Fatalf("both %s and %s joined the room", winner, conn.username)
+			}
+			winner = conn.username
+		}
+	}
+	if winner == "" {
+		t.Fatal("nobody joined the room")
+	}
+
+	game, _ := gameManager.GetGame(created.GameID)
+	room, _ := roomManager.GetRoom(created.Code)
+	if game.Player2 != winner || game.State != InProgress || room.Guest != winner || room.Status != RoomStarted {
+		t.Fatalf("game %v against %q, room %s with %q; want both started with %s", game.State, game.Player2, room.Status, room.Guest, winner)
+	}
+}
+
+func TestClaimRoomRejections(t *testing.T) {
+	useTestGlobals(t)
+	rated := createTestRoom(t, newTestConnection("alice"), &CreateRoomPayload{})
+	casual := createTestRoom(t, newTestConnection("bob"), &CreateRoomPayload{GameRules: GameRules{Casual: true}})
+	if room, _ := roomManager.GetRoom(rated.Code); !room.Rated {
+		t.Fatal("room with the default rules is not rated")
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name       string
+		code       string
+		guest      string
+		casualOnly bool
+		want       error
+	}{
+		{"unknown code", "NOPE22", "carol", false, errRoomNotFound},
+		{"own room", rated.Code, "alice", false, errOwnRoom},
+		{"rated room without an account", rated.Code, "Guest-1", true, errRoomRated},
+	}
+	for _, tt := range tests {
+		if _, err := roomManager.ClaimRoom(tt.code, tt.guest, tt.casualOnly, now); !errors.Is(err, tt.want) {
+			t.Fatalf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A guest without an account can join a casual room, and the code is not
+	// case sensitive
+	conn := newTestConnection("Guest-2")
+	conn.guest = true
+	handleJoinRoom(conn, &JoinRoomPayload{Code: " " + strings.ToLower(casual.Code) + " "})
+	if code := lastError(t, conn); code != "" {
+		t.Fatalf("guest joining a casual room got %s", code)
+	}
+	if _, err := roomManager.ClaimRoom(casual.Code, "carol", false, now); !errors.Is(err, errRoomStarted) {
+		t.Fatalf("claiming a started room: %v, want %v", err, errRoomStarted)
+	}
+}
+
+func TestClaimExpiredRoom(t *testing.T) {
+	useTestGlobals(t)
+	created := createTestRoom(t, newTestConnection("alice"), &CreateRoomPayload{})
+	room, _ := roomManager.GetRoom(created.Code)
+
+	// A room past its expiry time cannot be claimed before the sweep closes it
+	if _, err := roomManager.ClaimRoom(created.Code, "bob", false, room.ExpiresAt.Add(time.Millisecond)); !errors.Is(err, errRoomExpired) {
+		t.Fatalf("claiming after the expiry time: %v, want %v", err, errRoomExpired)
+	}
+	if room, _ := roomManager.GetRoom(created.Code); room.Status != RoomWaiting || room.Guest != "" {
+		t.Fatalf("refused claim left the room %s with %q", room.Status, room.Guest)
+	}
+
+	// Once swept the room is expired and its game is gone
+	roomManager.expireRooms(room.ExpiresAt.Add(time.Millisecond))
+	if room, _ := roomManager.GetRoom(created.Code); room.Status != RoomExpired {
+		t.Fatalf("room is %s after the sweep, want %s", room.Status, RoomExpired)
+	}
+	if _, exists := gameManager.GetGame(created.GameID); exists {
+		t.Fatal("expired room's game is still active")
+	}
+	conn := newTestConnection("bob")
+	handleJoinRoom(conn, &JoinRoomPayload{Code: created.Code})
+	if code := lastError(t, conn); code != ErrRoomUnavailable {
+		t.Fatalf("joining an expired room got %q, want %s", code, ErrRoomUnavailable)
+	}
+}
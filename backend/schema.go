@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jsonField is a field as it appears in a struct's JSON encoding
+type jsonField struct {
+	name string
+	typ  reflect.Type
+	// index is the field's index sequence for reflect.Value.FieldByIndex
+	index    []int
+	required bool
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// derefType returns the type of v, looking through pointers
+func derefType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// jsonFields lists the fields of a struct type the way encoding/json sees
+// them, with the fields of embedded structs promoted. A field without
+// omitempty is always encoded, so it is required.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, field := range jsonFields(f.Type) {
+				field.index = append([]int{i}, field.index...)
+				fields = append(fields, field)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{
+			name:     name,
+			typ:      f.Type,
+			index:    []int{i},
+			required: !strings.Contains(options, "omitempty"),
+		})
+	}
+	return fields
+}
+
+// hasRequiredField reports whether a struct type has a required field
+func hasRequiredField(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for _, field := range jsonFields(t) {
+		if field.required {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaBuilder builds JSON Schemas from Go types, keeping one definition
+// per named struct type
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+// schema returns the JSON Schema of a type
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		// encoding/json writes a []byte as a base64 string
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":     "array",
+			"items":    b.schema(t.Elem()),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		return b.ref(t)
+	}
+	// interface{} and anything else can hold any value
+	return map[string]interface{}{}
+}
+
+// ref returns a reference to the definition of a struct type, adding the
+// definition the first time the type is seen
+func (b *schemaBuilder) ref(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if name == "" {
+		return b.object(t)
+	}
+	if _, done := b.defs[name]; !done {
+		// Mark the type first, so a type that refers to itself terminates
+		b.defs[name] = nil
+		b.defs[name] = b.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+// object returns the JSON Schema of a struct type
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, field := range jsonFields(t) {
+		properties[field.name] = b.schema(field.typ)
+		if field.required {
+			required = append(required, field.name)
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// envelopes returns the schema of an envelope for each message type, sorted
+// by type. The server always sends a payload, and a sequence number with game
+// events; a client may leave out the payload of a message whose fields are
+// all optional.
+func (b *schemaBuilder) envelopes(payloads map[string]reflect.Type, fromServer bool) []interface{} {
+	types := make([]string, 0, len(payloads))
+	for msgType := range payloads {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+
+	envelopes := make([]interface{}, 0, len(types))
+	for _, msgType := range types {
+		required := []string{"v", "type"}
+		if fromServer || hasRequiredField(payloads[msgType]) {
+			required = append(required, "payload")
+		}
+		properties := map[string]interface{}{
+			"v":       map[string]interface{}{"const": ProtocolVersion},
+			"type":    map[string]interface{}{"const": msgType},
+			"payload": b.schema(payloads[msgType]),
+		}
+		if fromServer {
+			properties["seq"] = map[string]interface{}{"type": "integer", "minimum": 1}
+		}
+		envelopes = append(envelopes, map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		})
+	}
+	return envelopes
+}
+
+// ProtocolSchema returns a JSON Schema of the current protocol version,
+// generated from the payload types. ClientMessage and ServerMessage in its
+// definitions describe every message each side can send. MessagePack
+// messages carry the same values, mapped as msgpack.go describes, so it
+// describes them too.
+func ProtocolSchema() map[string]interface{} {
+	b := &schemaBuilder{defs: map[string]interface{}{}}
+
+	client := make(map[string]reflect.Type, len(clientPayloads))
+	for msgType, newPayload := range clientPayloads {
+		client[msgType] = derefType(newPayload())
+	}
+	server := make(map[string]reflect.Type, len(serverPayloads))
+	for msgType, payload := range serverPayloads {
+		server[msgType] = reflect.TypeOf(payload)
+	}
+
+	b.defs["ClientMessage"] = map[string]interface{}{"oneOf": b.envelopes(client, false)}
+	b.defs["ServerMessage"] = map[string]interface{}{"oneOf": b.envelopes(server, true)}
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     protocolName(ProtocolVersion, EncodingJSON),
+		"title":   fmt.Sprintf("Connect Four WebSocket protocol, version %d", ProtocolVersion),
+		"oneOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/ClientMessage"},
+			map[string]interface{}{"$ref": "#/$defs/ServerMessage"},
+		},
+		"$defs": b.defs,
+	}
+}
+
+// handleSchemaHTTP handles GET /protocol/schema, serving the JSON Schema of the protocol
+func handleSchemaHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(ProtocolSchema())
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaValidator checks values against the parts of JSON Schema that
+// ProtocolSchema uses
+type schemaValidator struct {
+	defs map[string]interface{}
+}
+
+// newSchemaValidator loads the protocol schema as a client would read it
+func newSchemaValidator(t *testing.T) *schemaValidator {
+	t.Helper()
+	data, err := json.Marshal(ProtocolSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	return &schemaValidator{defs: schema["$defs"].(map[string]interface{})}
+}
+
+// validate returns why value does not match schema, if it does not
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, ok := v.defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown reference %s", path, ref)
+		}
+		return v.validate(def, value, path)
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		var errs []string
+		for _, option := range oneOf {
+			if err := v.validate(option.(map[string]interface{}), value, path); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				matched++
+			}
+		}
+		if matched != 1 {
+			sort.Strings(errs)
+			return fmt.Errorf("%s: matches %d of the oneOf schemas, want 1 (%s)", path, matched, strings.Join(errs, "; "))
+		}
+		return nil
+	}
+
+	if want, ok := schema["const"]; ok && want != value {
+		return fmt.Errorf("%s: %v, want %v", path, value, want)
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", path, value)
+		}
+		for _, name := range schema["required"].([]interface{}) {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %s", path, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, field := range object {
+			fieldSchema, known := properties[name].(map[string]interface{})
+			if !known {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unexpected property %s", path, name)
+					}
+					continue
+				case map[string]interface{}:
+					fieldSchema = additional
+				default:
+					continue
+				}
+			}
+			if err := v.validate(fieldSchema, field, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", path, value)
+		}
+		if min, ok := schema["minItems"].(float64); ok && float64(len(array)) < min {
+			return fmt.Errorf("%s: %d items, want at least %v", path, len(array), min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(array)) > max {
+			return fmt.Errorf("%s: %d items, want at most %v", path, len(array), max)
+		}
+		for i, item := range array {
+			if err := v.validate(schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", path, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, s)
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: %v is not an integer", path, value)
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			return fmt.Errorf("%s: %v is below %v", path, n, min)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", path, value)
+		}
+	}
+	return nil
+}
+
+// validateMessage checks an encoded message against the server's messages in the schema
+func (v *schemaValidator) validateMessage(data []byte) error {
+	var message interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	return v.validate(map[string]interface{}{"$ref": "#/$defs/ServerMessage"}, message, "message")
+}
+
+// examplePayloads returns a payload of every type the server sends, with the
+// values it would send, taken from a game played between alice and bob
+func examplePayloads(t *testing.T) map[string]interface{} {
+	opts := DefaultGameOptions()
+	opts.TimeControl = TimeControl{Base: time.Minute, Increment: time.Second}
+	game, _, _ := startTestGame(t, opts)
+	play(t, game, drop(Player1, 3), drop(Player2, 3), drop(Player1, 4))
+	live := gameManager.GetLiveGames()
+	chat := ChatMessage{From: "carol", Text: "good luck", Spectator: true, Timestamp: time.Now()}
+	game.Chat = append(game.Chat, chat)
+	game.Forfeit(Player2, EndReasonResignation)
+	ratingSystem.RecordGame(game)
+	notice := PlayerNotice{GameID: game.ID, Username: "alice"}
+	frames := replayFrames(buildReplay(game))
+
+	return map[string]interface{}{
+		"JOINED":       JoinedPayload{GameID: game.ID, Username: "bob", Code: "ABC234", Token: "token"},
+		"ROOM_CREATED": RoomCreatedPayload{GameID: game.ID, Username: "alice", Code: "ABC234", Token: "token"},
+		"ROOM_EXPIRED": RoomExpiredPayload{GameID: game.ID, Code: "ABC234"},
+		"GAME_STATE":   gameResponse(game),
+		"MOVE_APPLIED": MoveAppliedPayload{
+			GameID:     game.ID,
+			Move:       game.Moves[2],
+			Ply:        3,
+			GameStatus: gameStatus(game),
+			BoardHash:  boardHash(game.Board()),
+		},
+		"MOVES_UNDONE": MovesUndonePayload{
+			GameID:     game.ID,
+			Moves:      []Move{game.Moves[2], game.Moves[1]},
+			Ply:        1,
+			GameStatus: gameStatus(game),
+			BoardHash:  boardHash(game.Board()),
+		},
+		"GAME_UPDATED":       GameUpdatedPayload{GameID: game.ID, GameStatus: gameStatus(game)},
+		"ERROR":              ErrorPayload{Code: ErrIllegalAction, Message: "not your turn"},
+		"LEADERBOARD":        ratingSystem.GetLeaderboard(),
+		"RECONNECTED":        ReconnectedPayload{GameID: game.ID, Token: "token"},
+		"RESUMED":            ResumedPayload{GameID: game.ID, Seq: 4, Replayed: 2},
+		"SESSION_SUPERSEDED": SessionSupersededPayload{GameID: game.ID},
+		"TAKEBACK_REQUEST":   TakebackRequestedPayload{notice},
+		"DRAW_OFFERED":       DrawOfferedPayload{notice},
+		"DRAW_DECLINED":      DrawDeclinedPayload{notice},
+		"REMATCH_REQUEST":    RematchRequestedPayload{notice},
+		"SPECTATING":         SpectatingPayload{GameID: game.ID},
+		"GAMES":              live,
+		"CHAT":               ChatLinePayload{GameID: game.ID, ChatMessage: chat},
+		"MUTED":              MutedPayload{notice},
+		"UNMUTED":            UnmutedPayload{notice},
+		"REPLAY_FRAME":       ReplayFramePayload{GameID: game.ID, ReplayFrame: frames[len(frames)-1]},
+		"REPLAY_END":         ReplayEndPayload{GameID: game.ID},
+	}
+}
+
+func TestServerMessagesMatchSchema(t *testing.T) {
+	useTestGlobals(t)
+	v := newSchemaValidator(t)
+	examples := examplePayloads(t)
+	for msgType := range serverPayloads {
+		if _, ok := examples[msgType]; !ok {
+			t.Errorf("no example of %s", msgType)
+		}
+	}
+
+	conn := newTestConnection("alice")
+	for msgType, payload := range examples {
+		// Every message may be sent on its own or as a game event
+		sendMessage(conn, msgType, payload)
+		sendEvent(conn, GameEvent{Seq: 7, Type: msgType, Payload: payload})
+		for i := 0; i < 2; i++ {
+			data := <-conn.send
+			if err := v.validateMessage(data); err != nil {
+				t.Errorf("%s does not match the schema: %v\n%s", msgType, err, data)
+			}
+		}
+	}
+}
+
+func TestSchemaRejectsOtherMessages(t *testing.T) {
+	v := newSchemaValidator(t)
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"missing required field", `{"v":1,"type":"ERROR","payload":{"code":"ILLEGAL_ACTION"}}`},
+		{"extra payload field", `{"v":1,"type":"ERROR","payload":{"code":"ILLEGAL_ACTION","message":"no","hint":"x"}}`},
+		{"extra envelope field", `{"v":1,"type":"ERROR","payload":{"code":"ILLEGAL_ACTION","message":"no"},"id":3}`},
+		{"missing payload", `{"v":1,"type":"SPECTATING"}`},
+		{"wrong field type", `{"v":1,"type":"SPECTATING","payload":{"gameId":7}}`},
+		{"unknown type", `{"v":1,"type":"HELLO","payload":{}}`},
+		{"other version", `{"v":2,"type":"SPECTATING","payload":{"gameId":"abc"}}`},
+		{"sequence number zero", `{"v":1,"seq":0,"type":"SPECTATING","payload":{"gameId":"abc"}}`},
+		{"nested extra field", `{"v":1,"type":"REPLAY_FRAME","payload":{"gameId":"abc","ply":1,"total":1,"board":[[0]],"move":{"player":1,"column":0,"kind":"drop","row":0,"timestamp":"2024-03-01T12:00:00Z","x":1}}}`},
+	}
+	for _, tt := range tests {
+		if err := v.validateMessage([]byte(tt.message)); err == nil {
+			t.Errorf("%s: %s matches the schema", tt.name, tt.message)
+		}
+	}
+	if err := v.validateMessage([]byte(`{"v":1,"type":"SPECTATING","payload":{"gameId":"abc"}}`)); err != nil {
+		t.Fatalf("valid message rejected: %v", err)
+	}
+}
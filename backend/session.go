@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// SessionTokenBytes is how many random bytes make up a session token
+const SessionTokenBytes = 32
+
+// Session lets whoever holds its token reconnect to a seat in a game. Only a
+// hash of the token is kept, so neither memory nor the game store holds a
+// token that could be used to take over the seat.
+type Session struct {
+	TokenHash string    `json:"tokenHash"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Session errors sent back to a player trying to reconnect
+var (
+	errSessionRequired = errors.New("session token is required")
+	errSessionInvalid  = errors.New("that session token is not valid for this game")
+	errSessionExpired  = errors.New("your session has expired, please start a new game")
+)
+
+// newSession creates a session that expires after the configured lifetime,
+// returning it with its token
+func newSession(now time.Time) (string, Session, error) {
+	raw := make([]byte, SessionTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", Session{}, err
+	}
+	token := hex.EncodeToString(raw)
+	return token, Session{TokenHash: hashToken(token), ExpiresAt: now.Add(config.SessionTTL)}, nil
+}
+
+// hashToken returns the hash a session keeps of its token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// seatForToken returns the seat whose session the token belongs to
+func (g *Game) seatForToken(token string, now time.Time) (Player, error) {
+	if token == "" {
+		return Empty, errSessionRequired
+	}
+
+	hash := []byte(hashToken(token))
+	for _, player := range []Player{Player1, Player2} {
+		session := g.sessions[player-1]
+		if session.TokenHash == "" || subtle.ConstantTimeCompare(hash, []byte(session.TokenHash)) != 1 {
+			continue
+		}
+		if now.After(session.ExpiresAt) {
+			return Empty, errSessionExpired
+		}
+		return player, nil
+	}
+	return Empty, errSessionInvalid
+}
+
+// renewSession replaces a seat's session with a new one, revoking the old
+// token, and returns the new token
+func (g *Game) renewSession(player Player, now time.Time) (string, error) {
+	token, session, err := newSession(now)
+	if err != nil {
+		return "", err
+	}
+	g.sessions[player-1] = session
+	return token, nil
+}
+
+// revokeSessions revokes the sessions of both seats, so no one can reconnect to the game
+func (g *Game) revokeSessions() {
+	g.sessions = [2]Session{}
+}
+
+// seatOf returns the seat conn is playing, or Empty if conn is not connected
+// to either seat
+func (g *Game) seatOf(conn *Connection) Player {
+	switch conn {
+	case nil:
+		return Empty
+	case g.Player1Conn:
+		return Player1
+	case g.Player2Conn:
+		return Player2
+	}
+	return Empty
+}
+
+// setConn connects conn to a seat
+func (g *Game) setConn(player Player, conn *Connection) {
+	if player == Player1 {
+		g.Player1Conn = conn
+	} else {
+		g.Player2Conn = conn
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// LiveGame summarises a game in progress for the list of games open to spectating
+type LiveGame struct {
+	GameID      string    `json:"gameId"`
+	Player1     string    `json:"player1"`
+	Player2     string    `json:"player2"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	WinLength   int       `json:"winLength"`
+	Variant     string    `json:"variant"`
+	TimeControl string    `json:"timeControl,omitempty"`
+	Rated       bool      `json:"rated"`
+	IsBotGame   bool      `json:"isBotGame"`
+	MoveCount   int       `json:"moveCount"`
+	Spectators  int       `json:"spectators"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// AddSpectator starts sending the game's updates to conn
+func (g *Game) AddSpectator(conn *Connection) {
+	g.spectatorsMu.Lock()
+	defer g.spectatorsMu.Unlock()
+	if g.spectators == nil {
+		g.spectators = make(map[*Connection]bool)
+	}
+	g.spectators[conn] = true
+}
+
+// RemoveSpectator stops sending the game's updates to conn
+func (g *Game) RemoveSpectator(conn *Connection) {
+	g.spectatorsMu.Lock()
+	defer g.spectatorsMu.Unlock()
+	delete(g.spectators, conn)
+}
+
+// IsSpectator reports whether conn is watching the game
+func (g *Game) IsSpectator(conn *Connection) bool {
+	g.spectatorsMu.Lock()
+	defer g.spectatorsMu.Unlock()
+	return g.spectators[conn]
+}
+
+// SpectatorCount returns how many connections are watching the game
+func (g *Game) SpectatorCount() int {
+	g.spectatorsMu.Lock()
+	defer g.spectatorsMu.Unlock()
+	return len(g.spectators)
+}
+
+// spectatorConns returns the connections watching the game
+func (g *Game) spectatorConns() []*Connection {
+	g.spectatorsMu.Lock()
+	defer g.spectatorsMu.Unlock()
+	conns := make([]*Connection, 0, len(g.spectators))
+	for conn := range g.spectators {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// liveGame summarises the game for the live games list
+func (g *Game) liveGame() LiveGame {
+	live := LiveGame{
+		GameID:      g.ID,
+		Player1:     g.Player1,
+		Player2:     g.Player2,
+		Width:       g.Width,
+		Height:      g.Height,
+		WinLength:   g.WinLength,
+		Variant:     string(g.Variant),
+		TimeControl: g.TimeControl.String(),
+		Rated:       g.Rated,
+		IsBotGame:   g.IsBotGame,
+		MoveCount:   len(g.Moves),
+		Spectators:  g.SpectatorCount(),
+	}
+	if g.StartedAt != nil {
+		live.StartedAt = *g.StartedAt
+	}
+	return live
+}
+
+// GetLiveGames returns the games in progress, most recently started first.
+// Private room games are left out; they can only be watched by their ID.
+func (gm *GameManager) GetLiveGames() []LiveGame {
+	live := make([]LiveGame, 0)
+	for _, game := range gm.activeGames() {
+		game.mu.Lock()
+		if game.State == InProgress && !game.Private {
+			live = append(live, game.liveGame())
+		}
+		game.mu.Unlock()
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		if !live[i].StartedAt.Equal(live[j].StartedAt) {
+			return live[i].StartedAt.After(live[j].StartedAt)
+		}
+		return live[i].GameID < live[j].GameID
+	})
+	return live
+}
+
+// handleSpectate handles a connection asking to watch a game in progress. A
+// connection watches one game at a time, so watching another game stops
+// watching the last one, and the read pump stops it when it disconnects. A
+// request that is turned down leaves the connection watching what it was.
+func handleSpectate(conn *Connection, p *SpectatePayload) {
+	if p.GameID == "" {
+		sendError(conn, ErrInvalidPayload, "game ID is required")
+		return
+	}
+
+	game, exists := gameManager.GetGame(p.GameID)
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return
+	}
+
+	previous, ok := watch(conn, game)
+	if ok && previous != game.ID {
+		unwatch(conn, previous)
+	}
+}
+
+// watch adds the connection to the game's spectators if the game can be
+// watched, returning the ID of the game it was watching before
+func watch(conn *Connection, game *Game) (string, bool) {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	if game.State != InProgress {
+		sendError(conn, ErrGameNotInProgress, "only games in progress can be watched")
+		return "", false
+	}
+
+	if conn.username != "" && (game.Player1 == conn.username || game.Player2 == conn.username) {
+		sendError(conn, ErrAlreadyPlaying, "you are playing in this game")
+		return "", false
+	}
+
+	previous := conn.Spectating()
+	game.AddSpectator(conn)
+	conn.SetSpectating(game.ID)
+
+	sendMessage(conn, "SPECTATING", SpectatingPayload{GameID: game.ID})
+	sendGameState(game, conn)
+	broadcastGameUpdate(game)
+	return previous, true
+}
+
+// stopSpectating removes the connection from the game it is watching, if any
+func stopSpectating(conn *Connection) {
+	gameID := conn.Spectating()
+	conn.SetSpectating("")
+	unwatch(conn, gameID)
+}
+
+// unwatch removes the connection from the spectators of a game it has stopped watching
+func unwatch(conn *Connection, gameID string) {
+	if gameID == "" {
+		return
+	}
+	if game, exists := gameManager.GetGame(gameID); exists {
+		game.mu.Lock()
+		if game.IsSpectator(conn) {
+			game.RemoveSpectator(conn)
+			broadcastGameUpdate(game)
+		}
+		game.mu.Unlock()
+	}
+}
+
+// handleListGames handles a request for the games open to spectating
+func handleListGames(conn *Connection) {
+	sendMessage(conn, "GAMES", gameManager.GetLiveGames())
+}
+
+// handleLiveGamesHTTP handles GET /games, listing the games open to spectating
+func handleLiveGamesHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(gameManager.GetLiveGames())
+}
@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestSpectateKeepsOneGamePerConnection(t *testing.T) {
+	useTestGlobals(t)
+	first := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	first.StartGame("bob")
+	gameManager.AddGame(first)
+	second := NewGame(generateGameID(), "carol", DefaultGameOptions())
+	second.StartGame("dave")
+	gameManager.AddGame(second)
+
+	conn := newTestConnection("eve")
+	counts := func() (int, int) {
+		return first.SpectatorCount(), second.SpectatorCount()
+	}
+
+	// Spectating the same game again does not add the connection twice
+	handleSpectate(conn, &SpectatePayload{GameID: first.ID})
+	handleSpectate(conn, &SpectatePayload{GameID: first.ID})
+	if a, b := counts(); a != 1 || b != 0 || conn.Spectating() != first.ID {
+		t.Fatalf("after watching the first game twice: spectators %d and %d, watching %q", a, b, conn.Spectating())
+	}
+
+	// Spectating another game leaves the first one
+	handleSpectate(conn, &SpectatePayload{GameID: second.ID})
+	if a, b := counts(); a != 0 || b != 1 || conn.Spectating() != second.ID {
+		t.Fatalf("after switching games: spectators %d and %d, watching %q", a, b, conn.Spectating())
+	}
+
+	// Disconnecting leaves the game being watched
+	stopSpectating(conn)
+	if a, b := counts(); a != 0 || b != 0 || conn.Spectating() != "" {
+		t.Fatalf("after stopping: spectators %d and %d, watching %q", a, b, conn.Spectating())
+	}
+}
+
+func TestRejectedSpectateKeepsWatching(t *testing.T) {
+	useTestGlobals(t)
+	watched := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	watched.StartGame("bob")
+	gameManager.AddGame(watched)
+	playing := NewGame(generateGameID(), "eve", DefaultGameOptions())
+	playing.StartGame("carol")
+	gameManager.AddGame(playing)
+	finished := NewGame(generateGameID(), "dave", DefaultGameOptions())
+	finished.StartGame("frank")
+	finished.Forfeit(Player2, EndReasonResignation)
+	gameManager.AddGame(finished)
+
+	conn := newTestConnection("eve")
+	handleSpectate(conn, &SpectatePayload{GameID: watched.ID})
+	tests := []struct {
+		name   string
+		gameID string
+		want   ErrorCode
+	}{
+		{"game over", finished.ID, ErrGameNotInProgress},
+		{"own game", playing.ID, ErrAlreadyPlaying},
+		{"unknown game", "nope", ErrGameNotFound},
+		{"no game", "", ErrInvalidPayload},
+	}
+	for _, tt := range tests {
+		sent(t, conn)
+		handleSpectate(conn, &SpectatePayload{GameID: tt.gameID})
+		if code := lastError(t, conn); code != tt.want {
+			t.Fatalf("%s: got %q, want %s", tt.name, code, tt.want)
+		}
+		if conn.Spectating() != watched.ID || watched.SpectatorCount() != 1 {
+			t.Fatalf("%s: watching %q with %d spectators, want still watching %s", tt.name, conn.Spectating(), watched.SpectatorCount(), watched.ID)
+		}
+	}
+}
+
+func TestLiveGamesLeaveOutRooms(t *testing.T) {
+	useTestGlobals(t)
+	public := NewGame(generateGameID(), "alice", DefaultGameOptions())
+	public.StartGame("bob")
+	gameManager.AddGame(public)
+
+	created := createTestRoom(t, newTestConnection("carol"), &CreateRoomPayload{})
+	handleJoinRoom(newTestConnection("dave"), &JoinRoomPayload{Code: created.Code})
+	private, _ := gameManager.GetGame(created.GameID)
+	if private.State != InProgress {
+		t.Fatalf("room game is %v, want in progress", private.State)
+	}
+
+	live := gameManager.GetLiveGames()
+	if len(live) != 1 || live[0].GameID != public.ID {
+		t.Fatalf("live games %+v, want only %s", live, public.ID)
+	}
+
+	// The room game can still be watched by its ID
+	conn := newTestConnection("eve")
+	handleSpectate(conn, &SpectatePayload{GameID: created.GameID})
+	if code := lastError(t, conn); code != "" || conn.Spectating() != created.GameID {
+		t.Fatalf("watching the room game: %q, watching %q", code, conn.Spectating())
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GameRecord is a game as kept in the game store: a finished game, or an
+// active game in a snapshot
+type GameRecord struct {
+	GameID        string    `json:"gameId"`
+	Player1       string    `json:"player1"`
+	Player2       string    `json:"player2"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	WinLength     int       `json:"winLength"`
+	Variant       string    `json:"variant"`
+	Rated         bool      `json:"rated"`
+	StartPosition string    `json:"startPosition,omitempty"`
+	TimeControl   string    `json:"timeControl,omitempty"`
+	Moves         []Move    `json:"moves"`
+	Winner        Player    `json:"winner"`
+	IsDraw        bool      `json:"isDraw"`
+	EndReason     EndReason `json:"endReason"`
+	// ClocksMs is the time each player had left when the record was made, in milliseconds
+	ClocksMs            [2]int64      `json:"clocksMs"`
+	RatingsRecorded     bool          `json:"ratingsRecorded,omitempty"`
+	Private             bool          `json:"private,omitempty"`
+	DrawOfferedBy       Player        `json:"drawOfferedBy,omitempty"`
+	TakebackRequestedBy Player        `json:"takebackRequestedBy,omitempty"`
+	MutedOpponent       [2]bool       `json:"mutedOpponent"`
+	Sessions            [2]Session    `json:"sessions"`
+	IsBotGame           bool          `json:"isBotGame"`
+	BotDifficulty       Difficulty    `json:"botDifficulty,omitempty"`
+	BotSeat             Player        `json:"botSeat,omitempty"`
+	PreviousGameID      string        `json:"previousGameId,omitempty"`
+	RematchGameID       string        `json:"rematchGameId,omitempty"`
+	SeriesBefore        SeriesScore   `json:"seriesBefore"`
+	Chat                []ChatMessage `json:"chat,omitempty"`
+	CreatedAt           time.Time     `json:"createdAt"`
+	StartedAt           *time.Time    `json:"startedAt,omitempty"`
+	EndedAt             *time.Time    `json:"endedAt,omitempty"`
+}
+
+// GameStore keeps finished games, player ratings and accounts. Active games live in
+// the GameManager; the store only holds a snapshot of them and a log of what
+// has happened since, so they can be recovered after a crash.
+type GameStore interface {
+	// SaveGame adds or replaces a finished game
+	SaveGame(record GameRecord) error
+	// GetGame returns the finished game with the given ID
+	GetGame(gameID string) (GameRecord, bool, error)
+	// LatestGame returns the most recently finished game the player took part in
+	LatestGame(username string) (GameRecord, bool, error)
+	// SaveRatedGame adds or replaces a finished game together with the
+	// ratings of its players updated for it, so the game is never rated
+	// without the record saying so
+	SaveRatedGame(record GameRecord, ratings map[string]PlayerRating) error
+	// GetPlayer returns a player's rating
+	GetPlayer(username string) (PlayerRating, bool, error)
+	// Players returns the ratings of every player
+	Players() (map[string]PlayerRating, error)
+	// CreateAccount adds an account, failing with errAccountExists if the
+	// username is taken in any case
+	CreateAccount(account Account) error
+	// GetAccount returns the account with the given username, in any case
+	GetAccount(username string) (Account, bool, error)
+	// AppendLog adds an entry to the log of active games, setting its sequence number
+	AppendLog(entry LogEntry) error
+	// LastLogSeq returns the sequence number of the most recent log entry
+	LastLogSeq() (uint64, error)
+	// Checkpoint replaces the snapshot of active games and drops the log
+	// entries up to and including seq, which the snapshot already reflects
+	Checkpoint(games []GameRecord, seq uint64) error
+	// Recover returns the snapshot of active games and the log entries written since
+	Recover() ([]GameRecord, []LogEntry, error)
+}
+
+// gameRecord captures a game for the store
+func gameRecord(g *Game) GameRecord {
+	moves := make([]Move, len(g.Moves))
+	copy(moves, g.Moves)
+	chat := make([]ChatMessage, len(g.Chat))
+	copy(chat, g.Chat)
+
+	return GameRecord{
+		GameID:        g.ID,
+		Player1:       g.Player1,
+		Player2:       g.Player2,
+		Width:         g.Width,
+		Height:        g.Height,
+		WinLength:     g.WinLength,
+		Variant:       string(g.Variant),
+		Rated:         g.Rated,
+		StartPosition: g.StartPosition,
+		TimeControl:   g.TimeControl.String(),
+		Moves:         moves,
+		Winner:        g.Winner,
+		IsDraw:        g.IsDraw,
+		EndReason:     g.EndReason,
+		ClocksMs: [2]int64{
+			g.RemainingTime(Player1).Milliseconds(),
+			g.RemainingTime(Player2).Milliseconds(),
+		},
+		RatingsRecorded:     g.RatingsRecorded,
+		Private:             g.Private,
+		DrawOfferedBy:       g.DrawOfferedBy,
+		TakebackRequestedBy: g.TakebackRequestedBy,
+		MutedOpponent:       g.mutedOpponent,
+		Sessions:            g.sessions,
+		IsBotGame:           g.IsBotGame,
+		BotDifficulty:       g.BotDifficulty,
+		BotSeat:             g.BotSeat,
+		PreviousGameID:      g.PreviousGameID,
+		RematchGameID:       g.RematchGameID,
+		SeriesBefore:        g.seriesBefore,
+		Chat:                chat,
+		CreatedAt:           g.CreatedAt,
+		StartedAt:           g.StartedAt,
+		EndedAt:             g.EndedAt,
+	}
+}
+
+// Game rebuilds the game from its record by replaying its moves. A record
+// without an end time is rebuilt as a game in progress. The rebuilt game has
+// no player connections.
+func (r GameRecord) Game() (*Game, error) {
+	timeControl, err := ParseTimeControl(r.TimeControl)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := GameOptions{
+		Width:       r.Width,
+		Height:      r.Height,
+		WinLength:   r.WinLength,
+		Variant:     Variant(r.Variant),
+		Rated:       r.Rated,
+		Position:    r.StartPosition,
+		TimeControl: timeControl,
+	}
+	if r.StartPosition != "" {
+		if _, _, err := ParsePosition(r.StartPosition, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	g := NewGame(r.GameID, r.Player1, opts)
+	g.Player2 = r.Player2
+	g.State = InProgress
+	if g.Variant == VariantPopOut {
+		g.recordPosition()
+	}
+	for i, move := range r.Moves {
+		if err := g.replayMove(move); err != nil {
+			return nil, fmt.Errorf("replaying move %d: %v", i+1, err)
+		}
+	}
+
+	// A game can end without a move, by resignation for example
+	if r.EndedAt != nil {
+		g.State = Finished
+		g.Winner = r.Winner
+		g.IsDraw = r.IsDraw
+		g.EndReason = r.EndReason
+	}
+	g.RatingsRecorded = r.RatingsRecorded
+	g.Private = r.Private
+	g.DrawOfferedBy = r.DrawOfferedBy
+	g.TakebackRequestedBy = r.TakebackRequestedBy
+	g.mutedOpponent = r.MutedOpponent
+	g.sessions = r.Sessions
+	g.Clocks = [2]time.Duration{
+		time.Duration(r.ClocksMs[0]) * time.Millisecond,
+		time.Duration(r.ClocksMs[1]) * time.Millisecond,
+	}
+	g.IsBotGame = r.IsBotGame
+	g.BotDifficulty = r.BotDifficulty
+	g.BotSeat = r.BotSeat
+	g.PreviousGameID = r.PreviousGameID
+	g.RematchGameID = r.RematchGameID
+	g.seriesBefore = r.SeriesBefore
+	g.Chat = r.Chat
+	g.CreatedAt = r.CreatedAt
+	g.StartedAt = r.StartedAt
+	g.EndedAt = r.EndedAt
+	if r.EndedAt != nil {
+		g.LastMoveAt = *r.EndedAt
+	}
+	return g, nil
+}
+
+// replayMove applies a recorded move without running the clocks, keeping the
+// move's original time
+func (g *Game) replayMove(move Move) error {
+	timeControl := g.TimeControl
+	g.TimeControl = TimeControl{}
+	err := g.PlayMove(move.Kind, move.Column, move.Player)
+	g.TimeControl = timeControl
+	if err != nil {
+		return err
+	}
+
+	g.Moves[len(g.Moves)-1] = move
+	g.LastMoveAt = move.Timestamp
+	if g.State == Finished {
+		endedAt := move.Timestamp
+		g.EndedAt = &endedAt
+	}
+	return nil
+}
+
+// endedBefore reports whether a finished before b, for picking a player's latest game
+func (r GameRecord) endedBefore(other GameRecord) bool {
+	if r.EndedAt == nil || other.EndedAt == nil {
+		return other.EndedAt != nil
+	}
+	return r.EndedAt.Before(*other.EndedAt)
+}
+
+// MemoryGameStore is a GameStore that lives only as long as the process
+type MemoryGameStore struct {
+	games    map[string]GameRecord
+	players  map[string]PlayerRating
+	accounts map[string]Account
+	snapshot []GameRecord
+	log      []LogEntry
+	logSeq   uint64
+	mu       sync.RWMutex
+}
+
+func NewMemoryGameStore() *MemoryGameStore {
+	return &MemoryGameStore{
+		games:    make(map[string]GameRecord),
+		players:  make(map[string]PlayerRating),
+		accounts: make(map[string]Account),
+	}
+}
+
+// SaveGame adds or replaces a finished game
+func (s *MemoryGameStore) SaveGame(record GameRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.games[record.GameID] = record
+	return nil
+}
+
+// GetGame returns the finished game with the given ID
+func (s *MemoryGameStore) GetGame(gameID string) (GameRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, exists := s.games[gameID]
+	return record, exists, nil
+}
+
+// LatestGame returns the most recently finished game the player took part in
+func (s *MemoryGameStore) LatestGame(username string) (GameRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest GameRecord
+	found := false
+	for _, record := range s.games {
+		if record.Player1 != username && record.Player2 != username {
+			continue
+		}
+		if !found || latest.endedBefore(record) {
+			latest = record
+			found = true
+		}
+	}
+	return latest, found, nil
+}
+
+// SaveRatedGame adds or replaces a finished game together with its players' ratings
+func (s *MemoryGameStore) SaveRatedGame(record GameRecord, ratings map[string]PlayerRating) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.games[record.GameID] = record
+	for username, rating := range ratings {
+		s.players[username] = rating
+	}
+	return nil
+}
+
+// GetPlayer returns a player's rating
+func (s *MemoryGameStore) GetPlayer(username string) (PlayerRating, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rating, exists := s.players[username]
+	return rating, exists, nil
+}
+
+// Players returns the ratings of every player
+func (s *MemoryGameStore) Players() (map[string]PlayerRating, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	players := make(map[string]PlayerRating, len(s.players))
+	for username, rating := range s.players {
+		players[username] = rating
+	}
+	return players, nil
+}
+
+// CreateAccount adds an account, failing with errAccountExists if the
+// username is taken in any case
+func (s *MemoryGameStore) CreateAccount(account Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := accountKey(account.Username)
+	if _, exists := s.accounts[key]; exists {
+		return errAccountExists
+	}
+	s.accounts[key] = account
+	return nil
+}
+
+// GetAccount returns the account with the given username, in any case
+func (s *MemoryGameStore) GetAccount(username string) (Account, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account, exists := s.accounts[accountKey(username)]
+	return account, exists, nil
+}
+
+// AppendLog adds an entry to the log of active games, setting its sequence number
+func (s *MemoryGameStore) AppendLog(entry LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logSeq++
+	entry.Seq = s.logSeq
+	s.log = append(s.log, entry)
+	return nil
+}
+
+// LastLogSeq returns the sequence number of the most recent log entry
+func (s *MemoryGameStore) LastLogSeq() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logSeq, nil
+}
+
+// Checkpoint replaces the snapshot of active games and drops the log
+// entries up to and including seq
+func (s *MemoryGameStore) Checkpoint(games []GameRecord, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = games
+	kept := s.log[:0]
+	for _, entry := range s.log {
+		if entry.Seq > seq {
+			kept = append(kept, entry)
+		}
+	}
+	s.log = kept
+	return nil
+}
+
+// Recover returns the snapshot of active games and the log entries written since
+func (s *MemoryGameStore) Recover() ([]GameRecord, []LogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := make([]GameRecord, len(s.snapshot))
+	copy(snapshot, s.snapshot)
+	log := make([]LogEntry, len(s.log))
+	copy(log, s.log)
+	return snapshot, log, nil
+}
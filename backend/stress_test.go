@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a WebSocket client speaking the JSON encoding of the protocol
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// startTestServer serves WebSockets against fresh games, rooms, queue and
+// stores. Once the test's clients have closed, it waits for the server's side
+// of every connection to finish, so no connection outlives the test, before
+// what it replaced is put back.
+func startTestServer(t *testing.T) *httptest.Server {
+	useTestGlobals(t)
+	if err := loadAuthSecret("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewConnectionManager()
+	go manager.run()
+	srv := httptest.NewServer(serveWS(manager))
+	t.Cleanup(func() {
+		srv.Close()
+		manager.mu.RLock()
+		defer manager.mu.RUnlock()
+		for conn := range manager.connections {
+			select {
+			case <-conn.done:
+			case <-time.After(5 * time.Second):
+				t.Error("a connection is still open after its client closed")
+				return
+			}
+		}
+	})
+	return srv
+}
+
+// dialTestClient connects to the server as username
+func dialTestClient(t *testing.T, srv *httptest.Server, username string) *testClient {
+	token, err := signToken(Identity{Username: username}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{protocolName(ProtocolVersion, EncodingJSON)}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return &testClient{t: t, ws: ws}
+}
+
+// send sends a message. Only one goroutine may send on a client at a time.
+func (c *testClient) send(msgType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteJSON(Envelope{V: ProtocolVersion, Type: msgType, Payload: data})
+}
+
+// read reads the next message, waiting at most five seconds for it
+func (c *testClient) read() (Envelope, error) {
+	c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var env Envelope
+	err := c.ws.ReadJSON(&env)
+	return env, err
+}
+
+// await reads messages until one of the given type arrives and decodes its payload
+func (c *testClient) await(msgType string, payload interface{}) error {
+	for {
+		env, err := c.read()
+		if err != nil {
+			return fmt.Errorf("waiting for %s: %v", msgType, err)
+		}
+		if env.Type == msgType {
+			return json.Unmarshal(env.Payload, payload)
+		}
+	}
+}
+
+// next is await for the test's own goroutine, failing the test on an error
+func (c *testClient) next(msgType string, payload interface{}) {
+	if err := c.await(msgType, payload); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reconnect takes a seat back with its session token, as a client does after
+// losing its connection, and has the game's events sent again from the start
+func (c *testClient) reconnect(gameID, token string) error {
+	ref := GameRef{GameID: gameID}
+	if err := c.send("RECONNECT", ReconnectPayload{GameRef: ref, Token: token}); err != nil {
+		return err
+	}
+	var reconnected ReconnectedPayload
+	if err := c.await("RECONNECTED", &reconnected); err != nil {
+		return err
+	}
+	if err := c.send("RESUME", ResumePayload{GameRef: ref}); err != nil {
+		return err
+	}
+	var resumed ResumedPayload
+	return c.await("RESUMED", &resumed)
+}
+
+// playBot makes up to moves moves in a bot game, waiting for the bot to
+// answer each, and reports whether the game has ended
+func (c *testClient) playBot(r *rand.Rand, moves int) (bool, error) {
+	for i := 0; i < moves; i++ {
+		if err := c.send("MOVE", MovePayload{Column: r.Intn(DefaultBoardWidth)}); err != nil {
+			return false, err
+		}
+		for answered := false; !answered; {
+			env, err := c.read()
+			if err != nil {
+				return false, fmt.Errorf("waiting for the bot: %v", err)
+			}
+			switch env.Type {
+			case "ERROR":
+				// The column was full; the next move picks another
+				var e ErrorPayload
+				json.Unmarshal(env.Payload, &e)
+				if e.Code != ErrIllegalAction {
+					return false, fmt.Errorf("move rejected: %s: %s", e.Code, e.Message)
+				}
+				answered = true
+			case "MOVE_APPLIED":
+				var applied MoveAppliedPayload
+				if err := json.Unmarshal(env.Payload, &applied); err != nil {
+					return false, err
+				}
+				if applied.State == "finished" {
+					return true, nil
+				}
+				answered = applied.Move.Player == Player2
+			}
+		}
+	}
+	return false, nil
+}
+
+// drain reads messages until the connection closes, reporting the errors
+// that mean the server mishandled a valid message
+func (c *testClient) drain(errs chan<- error) {
+	for {
+		var env Envelope
+		if err := c.ws.ReadJSON(&env); err != nil {
+			return
+		}
+		if env.Type != "ERROR" {
+			continue
+		}
+		var e ErrorPayload
+		json.Unmarshal(env.Payload, &e)
+		switch e.Code {
+		case ErrMalformedMessage, ErrInvalidPayload, ErrUnknownType, ErrInternal:
+			select {
+			case errs <- fmt.Errorf("server rejected a valid message: %s: %s", e.Code, e.Message):
+			default:
+			}
+		}
+	}
+}
+
+// TestConcurrentGames plays many games at once, so go test -race can catch
+// games sharing state unsafely. In the room games both players and a
+// spectator send at the same time; some players drop their connection and
+// reconnect mid-game, and some games are left to run out of time. The bot
+// games run the bot's moves alongside them.
+func TestConcurrentGames(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping concurrent games in short mode")
+	}
+	srv := startTestServer(t)
+
+	const (
+		games    = 12
+		botGames = 4
+		messages = 60
+		// flagAfter is what is left on the clocks of the games run out of time
+		flagAfter = 300 * time.Millisecond
+	)
+	actions := []string{"MOVE", "MOVE", "MOVE", "MOVE", "CHAT", "OFFER_DRAW", "DECLINE_DRAW",
+		"TAKEBACK_REQUEST", "TAKEBACK_ACCEPT", "GET_STATE", "LIST_GAMES"}
+
+	errs := make(chan error, 100)
+	var writers sync.WaitGroup
+	gameIDs := make([]string, 0, games+botGames)
+	flagged := make(map[string]bool)
+
+	for g := 0; g < games; g++ {
+		host := dialTestClient(t, srv, fmt.Sprintf("host%d", g))
+		guest := dialTestClient(t, srv, fmt.Sprintf("guest%d", g))
+		spectator := dialTestClient(t, srv, fmt.Sprintf("spectator%d", g))
+
+		// Every fourth game the guest loses their connection and comes back
+		// on a new one halfway through, and in another the players stop
+		// moving and the clock ends the game. Half the games are timed, so
+		// their clocks run alongside the moves.
+		reconnects := g%4 == 0
+		flags := g%4 == 3
+		var rejoin *testClient
+		if reconnects {
+			rejoin = dialTestClient(t, srv, fmt.Sprintf("guest%d", g))
+		}
+		rules := GameRules{Casual: g%2 == 0}
+		if g%2 == 1 {
+			rules.TimeControl = "1+0"
+		}
+		if err := host.send("CREATE_ROOM", CreateRoomPayload{GameRules: rules}); err != nil {
+			t.Fatal(err)
+		}
+		var created RoomCreatedPayload
+		host.next("ROOM_CREATED", &created)
+		if err := guest.send("JOIN_ROOM", JoinRoomPayload{Code: created.Code}); err != nil {
+			t.Fatal(err)
+		}
+		var joined JoinedPayload
+		guest.next("JOINED", &joined)
+		if err := spectator.send("SPECTATE", SpectatePayload{GameID: created.GameID}); err != nil {
+			t.Fatal(err)
+		}
+		var spectating SpectatingPayload
+		spectator.next("SPECTATING", &spectating)
+		gameIDs = append(gameIDs, created.GameID)
+
+		if flags {
+			// The shortest time control lasts a minute, so the clocks are
+			// wound down to run out while the players are still talking
+			game, _ := gameManager.GetGame(created.GameID)
+			game.mu.Lock()
+			game.Clocks = [2]time.Duration{flagAfter, flagAfter}
+			scheduleFlagCheck(game)
+			game.mu.Unlock()
+			flagged[created.GameID] = true
+		}
+
+		for _, client := range []*testClient{host, guest, spectator} {
+			client.ws.SetReadDeadline(time.Time{})
+			go client.drain(errs)
+		}
+
+		for p, player := range []*testClient{host, guest} {
+			var playerRejoin *testClient
+			if p == 1 {
+				playerRejoin = rejoin
+			}
+			writers.Add(1)
+			go func(player, rejoin *testClient, seed int64) {
+				defer writers.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < messages; i++ {
+					if rejoin != nil && i == messages/2 {
+						player.ws.Close()
+						if err := rejoin.reconnect(joined.GameID, joined.Token); err != nil {
+							t.Errorf("reconnecting to game %s: %v", joined.GameID, err)
+							return
+						}
+						player = rejoin
+						player.ws.SetReadDeadline(time.Time{})
+						go player.drain(errs)
+					}
+
+					var payload interface{} = GameRef{}
+					action := actions[r.Intn(len(actions))]
+					switch action {
+					case "MOVE":
+						if flags {
+							action = "GET_STATE"
+							break
+						}
+						payload = MovePayload{Column: r.Intn(DefaultBoardWidth)}
+					case "CHAT":
+						payload = ChatPayload{Text: "good luck"}
+					case "LIST_GAMES":
+						payload = ListGamesPayload{}
+					}
+					if err := player.send(action, payload); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if !flags {
+					player.send("RESIGN", ResignPayload{})
+				}
+			}(player, playerRejoin, int64(2*g+p))
+		}
+
+		writers.Add(1)
+		go func(spectator *testClient) {
+			defer writers.Done()
+			for i := 0; i < messages/4; i++ {
+				spectator.send("CHAT", ChatPayload{Text: "nice move"})
+				spectator.send("RESUME", ResumePayload{LastSeq: uint64(i)})
+				spectator.send("GET_STATE", GetStatePayload{})
+			}
+		}(spectator)
+	}
+
+	// The bot games are started one at a time, straight after each JOIN, so
+	// matchmaking never pairs two of their players with each other
+	for b := 0; b < botGames; b++ {
+		username := fmt.Sprintf("solo%d", b)
+		player := dialTestClient(t, srv, username)
+		rejoin := dialTestClient(t, srv, username)
+		join := JoinPayload{GameRules: GameRules{Casual: true}, Difficulty: string(DifficultyEasy)}
+		if err := player.send("JOIN", join); err != nil {
+			t.Fatal(err)
+		}
+		var joined JoinedPayload
+		player.next("JOINED", &joined)
+		matchmakingQueue.startBotGame(username, joined.GameID)
+		var state GameResponse
+		player.next("GAME_STATE", &state)
+		if !state.IsBotGame {
+			t.Fatalf("game %s is not a bot game", joined.GameID)
+		}
+		gameIDs = append(gameIDs, joined.GameID)
+
+		// The player makes a few moves, drops their connection and comes
+		// back to play a few more against the bot before resigning
+		writers.Add(1)
+		go func(player, rejoin *testClient, seed int64) {
+			defer writers.Done()
+			r := rand.New(rand.NewSource(seed))
+			finished, err := player.playBot(r, 3)
+			if err == nil && !finished {
+				player.ws.Close()
+				player = rejoin
+				err = player.reconnect(joined.GameID, joined.Token)
+			}
+			if err == nil && !finished {
+				finished, err = player.playBot(r, 3)
+			}
+			if err != nil {
+				t.Errorf("bot game %s: %v", joined.GameID, err)
+				return
+			}
+			if !finished {
+				player.send("RESIGN", ResignPayload{})
+			}
+		}(player, rejoin, int64(games+b))
+	}
+
+	writers.Wait()
+
+	// Every game ends once a player has resigned or run out of time, if it
+	// had not ended already
+	deadline := time.Now().Add(10 * time.Second)
+	for _, gameID := range gameIDs {
+		for {
+			game, exists := gameManager.GetGame(gameID)
+			if !exists {
+				t.Fatalf("game %s is gone", gameID)
+			}
+			game.mu.Lock()
+			state, reason := game.State, game.EndReason
+			game.mu.Unlock()
+			if state == Finished {
+				if flagged[gameID] && reason != EndReasonTime {
+					t.Errorf("game %s ended by %s, want it to run out of time", gameID, reason)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("game %s did not finish", gameID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
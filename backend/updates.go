@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// boardHash returns a hash of the board clients can check their own copy
+// against: the 32-bit FNV-1a hash of the cells row by row from the top, each
+// written as the digit of its player, or 0 if empty, in 8 hex digits
+func boardHash(board [][]Player) string {
+	h := fnv.New32a()
+	for _, row := range board {
+		for _, cell := range row {
+			h.Write([]byte{byte('0' + cell)})
+		}
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// broadcastMove sends the game's latest move to both players and every
+// spectator as a game event. The caller must hold the game's lock.
+func broadcastMove(game *Game) {
+	publishGameEvent(game, ToEveryone, "MOVE_APPLIED", MoveAppliedPayload{
+		GameID:     game.ID,
+		Move:       game.Moves[len(game.Moves)-1],
+		Ply:        len(game.Moves),
+		GameStatus: gameStatus(game),
+		BoardHash:  boardHash(game.Board()),
+	})
+}
+
+// broadcastTakeback sends the moves a takeback undid, most recent first, to
+// both players and every spectator as a game event. The caller must hold the
+// game's lock.
+func broadcastTakeback(game *Game, undone []Move) {
+	publishGameEvent(game, ToEveryone, "MOVES_UNDONE", MovesUndonePayload{
+		GameID:     game.ID,
+		Moves:      undone,
+		Ply:        len(game.Moves),
+		GameStatus: gameStatus(game),
+		BoardHash:  boardHash(game.Board()),
+	})
+}
+
+// handleGetState handles a client asking for a full GAME_STATE snapshot of a
+// game it is playing or watching, such as after its board hash stopped matching
+func handleGetState(conn *Connection, gameID string) {
+	if gameID == "" {
+		gameID = conn.GameID()
+		if spectating := conn.Spectating(); spectating != "" {
+			gameID = spectating
+		}
+	}
+
+	game, exists := gameManager.GetGame(gameID)
+	if !exists {
+		sendError(conn, ErrGameNotFound, "game not found")
+		return
+	}
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if _, ok := game.audienceOf(conn); !ok {
+		sendError(conn, ErrNotAPlayer, "you are not in this game")
+		return
+	}
+	sendGameState(game, conn)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// parseBoard reads a board written as rows of player digits from the top
+func parseBoard(rows ...string) [][]Player {
+	board := make([][]Player, len(rows))
+	for r, row := range rows {
+		board[r] = make([]Player, len(row))
+		for c, cell := range row {
+			board[r][c] = Player(cell - '0')
+		}
+	}
+	return board
+}
+
+// TestBoardHashVectors fixes the hash for a few boards. boardHash in
+// frontend/script.js gives the same hashes for the same boards.
+func TestBoardHashVectors(t *testing.T) {
+	tests := []struct {
+		name  string
+		board [][]Player
+		want  string
+	}{
+		{"empty", parseBoard("0000000", "0000000", "0000000", "0000000", "0000000", "0000000"), "4c40a46d"},
+		{"midgame", parseBoard("0000000", "0000000", "0000000", "0002000", "0012100", "0211120"), "c01a8284"},
+		{"full 4x4", parseBoard("1212", "2121", "1212", "2121"), "01aaf6a5"},
+	}
+	for _, tt := range tests {
+		if got := boardHash(tt.board); got != tt.want {
+			t.Errorf("%s: boardHash = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// applyMove applies a MOVE_APPLIED move to a board the way the frontend does
+func applyMove(board [][]Player, move Move) {
+	if move.Kind == MovePop {
+		for r := len(board) - 1; r > 0; r-- {
+			board[r][move.Column] = board[r-1][move.Column]
+		}
+		board[0][move.Column] = Empty
+		return
+	}
+	board[move.Row][move.Column] = move.Player
+}
+
+func TestMoveAppliedUpdatesBoard(t *testing.T) {
+	useTestGlobals(t)
+	opts := DefaultGameOptions()
+	opts.Variant = VariantPopOut
+	game, alice, bob := startTestGame(t, opts)
+	carol := newTestConnection("carol")
+	game.AddSpectator(carol)
+
+	board := game.Board()
+	moves := []struct {
+		conn   *Connection
+		column int
+		kind   MoveKind
+	}{
+		{alice, 3, MoveDrop},
+		{bob, 3, MoveDrop},
+		{alice, 2, MoveDrop},
+		{bob, 3, MoveDrop},
+		// Popping from under two discs drops them both a row
+		{alice, 3, MovePop},
+		{bob, 4, MoveDrop},
+		{alice, 2, MovePop},
+		{bob, 3, MovePop},
+		{alice, 3, MoveDrop},
+	}
+	for i, m := range moves {
+		handleMove(m.conn, game.ID, m.column, m.kind)
+		if code := lastError(t, m.conn); code != "" {
+			t.Fatalf("move %d: %s", i+1, code)
+		}
+
+		var update MoveAppliedPayload
+		for _, message := range sent(t, carol) {
+			if message.Type == "MOVE_APPLIED" {
+				json.Unmarshal(message.Payload, &update)
+			}
+		}
+		if update.Ply != i+1 {
+			t.Fatalf("move %d: MOVE_APPLIED for ply %d", i+1, update.Ply)
+		}
+		applyMove(board, update.Move)
+
+		game.mu.Lock()
+		want := game.Board()
+		game.mu.Unlock()
+		if !reflect.DeepEqual(board, want) || update.BoardHash != boardHash(want) {
+			t.Fatalf("move %d (%s in column %d): board after the update %v, want %v with hash %s", i+1, m.kind, m.column, board, want, update.BoardHash)
+		}
+	}
+}
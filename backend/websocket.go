@@ -1,9 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,42 +11,93 @@ import (
 )
 
 var upgrader = websocket.Upgrader{
+	Subprotocols: protocolNames(),
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
 	},
 }
 
+// maxMessageSize is the largest message a client may send. The largest valid
+// message is a chat line of MaxChatLength characters, each escaped in JSON as
+// a surrogate pair, which comes to under 3 KB with its envelope.
+const maxMessageSize = 4096
+
 // Connection represents a WebSocket connection
 type Connection struct {
-	conn         *websocket.Conn
-	send         chan []byte
-	username     string
+	conn     *websocket.Conn
+	send     chan []byte
+	username string
+	// guest is set for a connection without an account
+	guest bool
+	// version and encoding are the protocol version and wire encoding
+	// negotiated when the connection opened
+	version      int
+	encoding     Encoding
 	gameID       string
 	lastActivity time.Time
-	mu           sync.RWMutex
-}
-
-// Message represents a WebSocket message
-type Message struct {
-	Type      string      `json:"type"`
-	Data      interface{} `json:"data,omitempty"`
-	Error     string      `json:"error,omitempty"`
-	GameID    string      `json:"gameId,omitempty"`
-	Username  string      `json:"username,omitempty"`
-	Column    int         `json:"column,omitempty"`
+	// done is closed when the read pump exits
+	done chan struct{}
+	// replayStop stops the replay currently streaming to this connection
+	replayStop chan struct{}
+	// spectating is the ID of the game this connection is watching, if any
+	spectating string
+	// chatTokens and chatRefilledAt rate limit the connection's chat lines
+	chatTokens     float64
+	chatRefilledAt time.Time
+	mu             sync.RWMutex
 }
 
 // GameResponse represents the game state sent to clients
 type GameResponse struct {
-	GameID      string              `json:"gameId"`
-	Player1     string              `json:"player1"`
-	Player2     string              `json:"player2"`
-	Board       [BoardHeight][BoardWidth]int `json:"board"`
-	CurrentTurn int                 `json:"currentTurn"`
-	State       string              `json:"state"`
-	Winner      int                 `json:"winner"`
-	IsDraw      bool                `json:"isDraw"`
-	IsBotGame   bool                `json:"isBotGame"`
+	GameID        string  `json:"gameId"`
+	Player1       string  `json:"player1"`
+	Player2       string  `json:"player2"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	WinLength     int     `json:"winLength"`
+	Variant       string  `json:"variant"`
+	Board         [][]int `json:"board"`
+	BoardHash     string  `json:"boardHash"`
+	IsBotGame     bool    `json:"isBotGame"`
+	BotDifficulty string  `json:"botDifficulty,omitempty"`
+	Rated         bool    `json:"rated"`
+	Moves         []Move  `json:"moves"`
+	MoveString    string  `json:"moveString"`
+	Position      string  `json:"position"`
+	StartPosition string  `json:"startPosition,omitempty"`
+	// TimeControl is empty for an untimed game, in which case the remaining times are zero
+	TimeControl string `json:"timeControl,omitempty"`
+	// PreviousGameID links the game to the one it is a rematch of
+	PreviousGameID string `json:"previousGameId,omitempty"`
+	GameStatus
+}
+
+// GameStatus is the part of the game state that changes during a game,
+// besides the board and the moves. Every field is always sent, so a client
+// can merge a status into its copy of the game.
+type GameStatus struct {
+	CurrentTurn int    `json:"currentTurn"`
+	State       string `json:"state"`
+	Winner      int    `json:"winner"`
+	IsDraw      bool   `json:"isDraw"`
+	// TakebackRequestedBy is the player waiting for a takeback to be accepted, or 0
+	TakebackRequestedBy int `json:"takebackRequestedBy"`
+	// DrawOfferedBy is the player waiting for a draw offer to be answered, or 0
+	DrawOfferedBy int `json:"drawOfferedBy"`
+	// EndReason says how a finished game ended
+	EndReason     string `json:"endReason"`
+	Player1TimeMs int64  `json:"player1TimeMs"`
+	Player2TimeMs int64  `json:"player2TimeMs"`
+	// RematchGameID links the game to its rematch, once accepted
+	RematchGameID string `json:"rematchGameId"`
+	// RematchRequestedBy is the player waiting for a rematch to be accepted, or 0
+	RematchRequestedBy int `json:"rematchRequestedBy"`
+	// Series is the head-to-head score of the players' rematch series
+	Series SeriesScore `json:"series"`
+	// Spectators is how many connections are watching the game
+	Spectators int `json:"spectators"`
+	// Paused is set while a game recovered after a restart waits for its players to reconnect
+	Paused bool `json:"paused"`
 }
 
 // ConnectionManager manages all WebSocket connections
@@ -100,9 +151,13 @@ func (cm *ConnectionManager) run() {
 
 func (c *Connection) readPump() {
 	defer func() {
+		matchmakingQueue.RemovePlayer(c.username, c)
+		stopSpectating(c)
+		close(c.done)
 		c.conn.Close()
 	}()
 
+	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -121,13 +176,13 @@ func (c *Connection) readPump() {
 
 		c.updateActivity()
 
-		var msg Message
-		if err := json.Unmarshal(messageBytes, &msg); err != nil {
-			log.Printf("error unmarshaling message: %v", err)
+		payload, perr := c.encoding.decode(c.version, messageBytes)
+		if perr != nil {
+			sendError(c, perr.Code, perr.Message)
 			continue
 		}
 
-		handleMessage(c, &msg)
+		handleMessage(c, payload)
 	}
 }
 
@@ -138,6 +193,47 @@ func (c *Connection) updateActivity() {
 	c.mu.Unlock()
 }
 
+// startReplay stops any replay streaming to the connection and returns
+// the stop channel for a new one
+func (c *Connection) startReplay() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replayStop != nil {
+		close(c.replayStop)
+	}
+	c.replayStop = make(chan struct{})
+	return c.replayStop
+}
+
+// GameID returns the ID of the game the connection is playing
+func (c *Connection) GameID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.gameID
+}
+
+// SetGameID records the game the connection is playing. Matchmaking and
+// rematches set it from outside the connection's own goroutine.
+func (c *Connection) SetGameID(gameID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gameID = gameID
+}
+
+// Spectating returns the ID of the game the connection is watching, if any
+func (c *Connection) Spectating() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.spectating
+}
+
+// SetSpectating records the game the connection is watching, or "" for none
+func (c *Connection) SetSpectating(gameID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spectating = gameID
+}
+
 // GetLastActivity returns the last activity time
 func (c *Connection) GetLastActivity() time.Time {
 	c.mu.RLock()
@@ -161,19 +257,8 @@ func (c *Connection) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			// One message per frame, so a client can decode each frame on its own
+			if err := c.conn.WriteMessage(c.encoding.frameType(), message); err != nil {
 				return
 			}
 
@@ -188,6 +273,18 @@ func (c *Connection) writePump() {
 
 func serveWS(manager *ConnectionManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		version, encoding, ok := negotiateProtocol(r)
+		if !ok {
+			http.Error(w, "unsupported protocol version; offer one of "+strings.Join(protocolNames(), ", "), http.StatusBadRequest)
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("error upgrading connection: %v", err)
@@ -196,8 +293,13 @@ func serveWS(manager *ConnectionManager) http.HandlerFunc {
 
 		connection := &Connection{
 			conn:         conn,
+			username:     identity.Username,
+			guest:        identity.Guest,
+			version:      version,
+			encoding:     encoding,
 			send:         make(chan []byte, 256),
 			lastActivity: time.Now(),
+			done:         make(chan struct{}),
 		}
 
 		manager.register <- connection
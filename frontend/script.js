@@ -1,15 +1,60 @@
+// PROTOCOL_VERSION is the version of the server's WebSocket protocol this client speaks
+const PROTOCOL_VERSION = 1;
 let ws = null;
 let currentGame = null;
 let username = '';
+// authToken is the bearer token from logging in, registering or starting as a guest
+let authToken = '';
 let gameId = '';
+// sessionToken lets this client take its seat back after losing the connection
+let sessionToken = '';
+// lastSeq is the sequence number of the latest game event received, and
+// resumeFrom the one to ask the server to resend events after once reconnected
+let lastSeq = 0;
+let resumeFrom = 0;
 let socketReady = false;
+let boardWidth = 7;
+let boardHeight = 6;
+let popMode = false;
+let clockReceivedAt = 0;
+// joinMode is how sendJoin enters a game: 'match', 'createRoom', 'joinRoom' or 'watch'
+let joinMode = 'match';
+let spectating = false;
+let opponentMuted = false;
 
 // DOM elements
 const loginSection = document.getElementById('loginSection');
 const gameSection = document.getElementById('gameSection');
 const leaderboardSection = document.getElementById('leaderboardSection');
+const liveGamesSection = document.getElementById('liveGamesSection');
+const liveGamesContent = document.getElementById('liveGamesContent');
+const watchButton = document.getElementById('watchButton');
+const refreshLiveGamesButton = document.getElementById('refreshLiveGamesButton');
+const spectatorInfo = document.getElementById('spectatorInfo');
 const usernameInput = document.getElementById('usernameInput');
+const passwordInput = document.getElementById('passwordInput');
+const authControls = document.getElementById('authControls');
+const identityInfo = document.getElementById('identityInfo');
+const loginButton = document.getElementById('loginButton');
+const registerButton = document.getElementById('registerButton');
+const guestButton = document.getElementById('guestButton');
+const boardSelect = document.getElementById('boardSelect');
+const variantSelect = document.getElementById('variantSelect');
+const difficultySelect = document.getElementById('difficultySelect');
+const timeControlSelect = document.getElementById('timeControlSelect');
+const popModeButton = document.getElementById('popModeButton');
+const casualCheckbox = document.getElementById('casualCheckbox');
+const positionInput = document.getElementById('positionInput');
+const takebackButton = document.getElementById('takebackButton');
+const replayButton = document.getElementById('replayButton');
+const rematchButton = document.getElementById('rematchButton');
+const seriesInfo = document.getElementById('seriesInfo');
+const offerDrawButton = document.getElementById('offerDrawButton');
+const resignButton = document.getElementById('resignButton');
 const joinButton = document.getElementById('joinButton');
+const createRoomButton = document.getElementById('createRoomButton');
+const joinRoomButton = document.getElementById('joinRoomButton');
+const roomCodeInput = document.getElementById('roomCodeInput');
 const newGameButton = document.getElementById('newGameButton');
 const leaderboardButton = document.getElementById('leaderboardButton');
 const closeLeaderboardButton = document.getElementById('closeLeaderboardButton');
@@ -19,13 +64,25 @@ const player1Name = document.getElementById('player1Name');
 const player2Name = document.getElementById('player2Name');
 const player1Indicator = document.getElementById('player1Indicator');
 const player2Indicator = document.getElementById('player2Indicator');
+const player1Clock = document.getElementById('player1Clock');
+const player2Clock = document.getElementById('player2Clock');
 const messageDiv = document.getElementById('message');
+const chatLog = document.getElementById('chatLog');
+const chatInput = document.getElementById('chatInput');
+const chatSendButton = document.getElementById('chatSendButton');
+const muteButton = document.getElementById('muteButton');
 
 /* ---------------- BOARD ---------------- */
-function initializeBoard() {
+function initializeBoard(width = boardWidth, height = boardHeight) {
+    boardWidth = width;
+    boardHeight = height;
+    board.style.gridTemplateColumns = `repeat(${width}, 1fr)`;
+    board.style.gridTemplateRows = `repeat(${height}, 1fr)`;
+    board.style.aspectRatio = `${width}/${height}`;
+
     board.innerHTML = '';
-    for (let r = 0; r < 6; r++) {
-        for (let c = 0; c < 7; c++) {
+    for (let r = 0; r < height; r++) {
+        for (let c = 0; c < width; c++) {
             const cell = document.createElement('div');
             cell.className = 'cell';
             cell.addEventListener('click', () => handleCellClick(c));
@@ -39,87 +96,361 @@ function connectWebSocket() {
     if (ws && socketReady) return;
 
     const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-    ws = new WebSocket(`${protocol}//${location.host}/ws`);
+    ws = new WebSocket(
+        `${protocol}//${location.host}/ws?token=${encodeURIComponent(authToken)}`,
+        [`connect-four.v${PROTOCOL_VERSION}`]
+    );
 
     ws.onopen = () => {
         socketReady = true;
-        sendMessage({ type: 'JOIN', username });
+        // After losing the connection, pick up the game in progress instead of starting another
+        if (currentGame && currentGame.state === 'inProgress' && !spectating && sessionToken) {
+            sendMessage('RECONNECT', { gameId, token: sessionToken });
+        } else {
+            sendJoin();
+        }
     };
 
     ws.onmessage = (e) => handleMessage(JSON.parse(e.data));
 
     ws.onclose = () => {
         socketReady = false;
+        resumeFrom = lastSeq;
         setTimeout(connectWebSocket, 2000);
     };
 }
 
 /* ---------------- MESSAGES ---------------- */
 function handleMessage(message) {
+    const payload = message.payload;
+    // A GAME_STATE snapshot includes every game event up to its number. Events
+    // resent by RESUME that the snapshot already includes are skipped, apart
+    // from chat lines, which no snapshot carries.
+    if (message.type === 'GAME_STATE') {
+        lastSeq = message.seq || 0;
+    } else if (message.seq) {
+        if (message.seq <= lastSeq && message.type !== 'CHAT') return;
+        lastSeq = Math.max(lastSeq, message.seq);
+    }
+
     switch (message.type) {
         case 'JOINED':
-            gameId = message.gameId;
+            gameId = payload.gameId;
+            sessionToken = payload.token;
             showMessage('Waiting for opponent...');
             break;
 
+        case 'ROOM_CREATED':
+            gameId = payload.gameId;
+            sessionToken = payload.token;
+            gameStatus.textContent = `Room code: ${payload.code} (share it with a friend)`;
+            break;
+
+        case 'ROOM_EXPIRED':
+            gameStatus.textContent = 'Your room expired before anyone joined';
+            newGameButton.classList.remove('hidden');
+            break;
+
+        case 'RECONNECTED':
+            sessionToken = payload.token;
+            showMessage('Reconnected');
+            // Catch up on the chat, offers and moves sent while the connection was down
+            sendMessage('RESUME', { gameId, lastSeq: resumeFrom });
+            break;
+
+        case 'SESSION_SUPERSEDED':
+            // Another window reconnected with this session, so leave the seat to it
+            sessionToken = '';
+            gameStatus.textContent = 'This game was picked up by another connection';
+            newGameButton.classList.remove('hidden');
+            break;
+
+        case 'GAMES':
+            displayLiveGames(payload);
+            break;
+
+        case 'SPECTATING':
+            gameId = payload.gameId;
+            spectating = true;
+            liveGamesSection.classList.add('hidden');
+            gameSection.classList.remove('hidden');
+            break;
+
         case 'GAME_STATE':
-            gameId = message.gameId || gameId;
-            updateGameState(message.data);
+            gameId = payload.gameId || gameId;
+            updateGameState(payload);
+            break;
+
+        case 'MOVE_APPLIED':
+        case 'MOVES_UNDONE':
+        case 'GAME_UPDATED':
+            applyUpdate(message.type, payload);
+            break;
+
+        case 'TAKEBACK_REQUEST':
+            if (confirm(`${payload.username} asks to take back their last move. Accept?`)) {
+                sendMessage('TAKEBACK_ACCEPT', { gameId });
+            }
+            break;
+
+        case 'REMATCH_REQUEST':
+            if (confirm(`${payload.username} wants a rematch. Accept?`)) {
+                sendMessage('REMATCH_ACCEPT', { gameId });
+            }
+            break;
+
+        case 'DRAW_OFFERED':
+            sendMessage(confirm(`${payload.username} offers a draw. Accept?`) ? 'ACCEPT_DRAW' : 'DECLINE_DRAW', { gameId });
+            break;
+
+        case 'DRAW_DECLINED':
+            showMessage(`${payload.username} declined the draw`);
+            break;
+
+        case 'REPLAY_FRAME':
+            renderBoard(payload.board);
+            gameStatus.textContent = `Replay: move ${payload.ply} of ${payload.total}`;
+            break;
+
+        case 'REPLAY_END':
+            gameStatus.textContent = 'Replay finished';
+            break;
+
+        case 'CHAT':
+            appendChat(payload);
+            break;
+
+        case 'MUTED':
+        case 'UNMUTED':
+            opponentMuted = message.type === 'MUTED';
+            muteButton.textContent = opponentMuted ? 'Unmute Opponent' : 'Mute Opponent';
+            showMessage(opponentMuted ? `${payload.username} is muted` : `${payload.username} is unmuted`);
             break;
 
         case 'ERROR':
-            showMessage(message.error, 'error');
+            showMessage(payload.message, 'error');
             break;
 
         case 'LEADERBOARD':
-            displayLeaderboard(message.data);
+            displayLeaderboard(payload);
             break;
     }
 }
 
 /* ---------------- GAME STATE ---------------- */
+// applyUpdate applies a move, takeback or status change to the local copy of
+// the game, asking for a fresh snapshot if the board no longer matches the server's
+function applyUpdate(type, update) {
+    if (!currentGame || currentGame.gameId !== update.gameId) return;
+
+    const { move, moves, ply, boardHash: hash, ...status } = update;
+    if (type === 'MOVE_APPLIED') {
+        applyMove(currentGame.board, move);
+        currentGame.moves.push(move);
+    } else if (type === 'MOVES_UNDONE') {
+        moves.forEach(m => undoMove(currentGame.board, m));
+        currentGame.moves.length = ply;
+    }
+    Object.assign(currentGame, status);
+
+    if (hash && hash !== boardHash(currentGame.board)) {
+        sendMessage('GET_STATE', { gameId });
+        return;
+    }
+    updateGameState(currentGame);
+}
+
+function applyMove(cells, move) {
+    if (move.kind === 'pop') {
+        // Everything above the popped disc falls one row
+        for (let r = cells.length - 1; r > 0; r--) cells[r][move.column] = cells[r - 1][move.column];
+        cells[0][move.column] = 0;
+    } else {
+        cells[move.row][move.column] = move.player;
+    }
+}
+
+function undoMove(cells, move) {
+    if (move.kind === 'pop') {
+        for (let r = 0; r < cells.length - 1; r++) cells[r][move.column] = cells[r + 1][move.column];
+        cells[cells.length - 1][move.column] = move.player;
+    } else {
+        cells[move.row][move.column] = 0;
+    }
+}
+
+// boardHash is the server's board hash: 32-bit FNV-1a over the cells row by
+// row from the top, each as the digit of its player, in 8 hex digits. The
+// backend tests fix its value for a few boards (TestBoardHashVectors).
+function boardHash(cells) {
+    let h = 0x811c9dc5;
+    cells.forEach(row => row.forEach(cell => {
+        h = Math.imul(h ^ (48 + cell), 0x01000193);
+    }));
+    return (h >>> 0).toString(16).padStart(8, '0');
+}
+
 function updateGameState(game) {
     currentGame = game;
+    clockReceivedAt = Date.now();
+    updateClocks();
 
     player1Name.textContent = game.player1;
     player2Name.textContent = game.player2 || 'Waiting';
 
-    for (let r = 0; r < 6; r++) {
-        for (let c = 0; c < 7; c++) {
-            const cell = board.children[r * 7 + c];
-            cell.className = 'cell';
-            if (game.board[r][c] === 1) cell.classList.add('player1');
-            if (game.board[r][c] === 2) cell.classList.add('player2');
-        }
+    const playing = game.state === 'inProgress' && !spectating;
+    popModeButton.classList.toggle('hidden', game.variant !== 'popout' || spectating);
+    takebackButton.classList.toggle('hidden', game.rated || !playing);
+    replayButton.classList.toggle('hidden', game.state !== 'finished');
+    rematchButton.classList.toggle('hidden', game.state !== 'finished' || !!game.rematchGameId || spectating);
+    offerDrawButton.classList.toggle('hidden', !playing);
+    resignButton.classList.toggle('hidden', !playing);
+    muteButton.classList.toggle('hidden', spectating || !game.player2 || game.isBotGame);
+
+    spectatorInfo.classList.toggle('hidden', !game.spectators);
+    spectatorInfo.textContent = `${game.spectators} watching`;
+
+    if (game.width !== boardWidth || game.height !== boardHeight) {
+        initializeBoard(game.width, game.height);
     }
 
-    if (game.state === 'inProgress') {
+    renderBoard(game.board);
+    updateSeries(game.series);
+
+    if (game.state === 'inProgress' && game.paused) {
+        gameStatus.textContent = 'Paused: waiting for both players to reconnect';
+    } else if (game.state === 'inProgress' && spectating) {
+        const mover = game.currentTurn === 1 ? game.player1 : game.player2;
+        gameStatus.textContent = `Watching: ${mover} to move`;
+    } else if (game.state === 'inProgress') {
         const myTurn =
             (game.currentTurn === 1 && username === game.player1) ||
             (game.currentTurn === 2 && username === game.player2);
         gameStatus.textContent = myTurn ? 'Your turn!' : 'Opponent turn';
+    } else if (game.state === 'finished') {
+        gameStatus.textContent = resultText(game);
+    }
+}
+
+function resultText(game) {
+    const reasons = {
+        connect: 'connecting',
+        boardFull: 'a full board',
+        repetition: 'repetition',
+        resignation: 'resignation',
+        agreedDraw: 'agreement',
+        timeout: 'timeout',
+        time: 'time'
+    };
+    if (game.endReason === 'abandoned') return 'Game abandoned';
+    const how = reasons[game.endReason] || game.endReason;
+    if (game.isDraw) return `Draw by ${how}`;
+    const winner = game.winner === 1 ? game.player1 : game.player2;
+    return winner === username ? `You won by ${how}!` : `${winner} won by ${how}`;
+}
+
+function updateSeries(series) {
+    const played = series ? series.wins[0] + series.wins[1] + series.draws : 0;
+    seriesInfo.classList.toggle('hidden', played === 0);
+    if (played === 0) return;
+
+    const [p1, p2] = series.players;
+    const draws = series.draws ? `, ${series.draws} drawn` : '';
+    seriesInfo.textContent = `Series: ${p1} ${series.wins[0]} – ${series.wins[1]} ${p2}${draws}`;
+}
+
+/* ---------------- CLOCKS ---------------- */
+function updateClocks() {
+    const timed = currentGame && currentGame.timeControl;
+    player1Clock.classList.toggle('hidden', !timed);
+    player2Clock.classList.toggle('hidden', !timed);
+    if (!timed) return;
+
+    // Only the player to move has a running clock
+    const running = currentGame.state === 'inProgress' ? currentGame.currentTurn : 0;
+    const elapsed = Date.now() - clockReceivedAt;
+    const p1 = currentGame.player1TimeMs - (running === 1 ? elapsed : 0);
+    const p2 = currentGame.player2TimeMs - (running === 2 ? elapsed : 0);
+
+    player1Clock.textContent = formatClock(p1);
+    player2Clock.textContent = formatClock(p2);
+    player1Clock.classList.toggle('running', running === 1);
+    player2Clock.classList.toggle('running', running === 2);
+}
+
+function formatClock(ms) {
+    const total = Math.max(0, Math.ceil(ms / 1000));
+    const seconds = String(total % 60).padStart(2, '0');
+    return `${Math.floor(total / 60)}:${seconds}`;
+}
+
+function renderBoard(cells) {
+    for (let r = 0; r < boardHeight; r++) {
+        for (let c = 0; c < boardWidth; c++) {
+            const cell = board.children[r * boardWidth + c];
+            cell.className = 'cell';
+            if (cells[r][c] === 1) cell.classList.add('player1');
+            if (cells[r][c] === 2) cell.classList.add('player2');
+        }
     }
 }
 
 /* ---------------- MOVE ---------------- */
 function handleCellClick(col) {
-    if (!currentGame || currentGame.state !== 'inProgress') return;
+    if (!currentGame || currentGame.state !== 'inProgress' || spectating) return;
 
-    sendMessage({
-        type: 'MOVE',
-        gameId,
-        column: col
-    });
+    sendMessage(popMode ? 'POP' : 'MOVE', { gameId, column: col });
+    setPopMode(false);
 }
 
 /* ---------------- SEND ---------------- */
-function sendMessage(msg) {
+function sendJoin() {
+    chatLog.innerHTML = '';
+    opponentMuted = false;
+    muteButton.textContent = 'Mute Opponent';
+
+    if (joinMode === 'watch') {
+        sendMessage('LIST_GAMES');
+        return;
+    }
+
+    if (joinMode === 'joinRoom') {
+        // A room can only be joined once, so a new game goes back to matchmaking
+        joinMode = 'match';
+        sendMessage('JOIN_ROOM', { code: roomCodeInput.value.trim() });
+        return;
+    }
+
+    const [width, height, winLength] = boardSelect.value.split('x').map(Number);
+    const rules = {
+        variant: variantSelect.value,
+        casual: casualCheckbox.checked,
+        timeControl: timeControlSelect.value,
+        position: positionInput.value.trim(),
+        width,
+        height,
+        winLength
+    };
+    if (joinMode === 'createRoom') {
+        sendMessage('CREATE_ROOM', rules);
+    } else {
+        sendMessage('JOIN', { ...rules, difficulty: difficultySelect.value });
+    }
+}
+
+// sendMessage wraps a payload in the protocol's envelope and sends it
+function sendMessage(type, payload = {}) {
     if (socketReady) {
-        ws.send(JSON.stringify(msg));
+        ws.send(JSON.stringify({ v: PROTOCOL_VERSION, type, payload }));
     }
 }
 
 /* ---------------- UI ---------------- */
+function setPopMode(on) {
+    popMode = on;
+    popModeButton.textContent = on ? 'Pop Out: On' : 'Pop Out: Off';
+}
+
 function showMessage(text, type = '') {
     messageDiv.textContent = text;
     messageDiv.className = `message ${type}`;
@@ -127,28 +458,146 @@ function showMessage(text, type = '') {
     setTimeout(() => messageDiv.classList.add('hidden'), 3000);
 }
 
-function displayLeaderboard(data) {
-    document.getElementById('leaderboardContent').innerHTML =
-        Object.entries(data || {}).map(
-            ([n, w]) => `<div>${n}: ${w}</div>`
-        ).join('');
+function appendChat(line) {
+    const item = document.createElement('div');
+    item.className = line.spectator ? 'chat-line spectator' : 'chat-line';
+    const from = document.createElement('span');
+    from.className = 'from';
+    from.textContent = `${line.from}: `;
+    item.append(from, line.text);
+    chatLog.appendChild(item);
+    chatLog.scrollTop = chatLog.scrollHeight;
+}
+
+function sendChat() {
+    const text = chatInput.value.trim();
+    if (!text) return;
+    sendMessage('CHAT', { gameId, text });
+    chatInput.value = '';
+}
+
+function displayLiveGames(games) {
+    liveGamesContent.innerHTML = '';
+    if (!games || games.length === 0) {
+        liveGamesContent.textContent = 'No games in progress';
+    }
+
+    (games || []).forEach(g => {
+        const item = document.createElement('div');
+        item.className = 'leaderboard-item';
+        const name = document.createElement('span');
+        name.className = 'name';
+        name.textContent = `${g.player1} vs ${g.player2} (${g.width}x${g.height}, ${g.moveCount} moves, ${g.spectators} watching)`;
+        const watch = document.createElement('button');
+        watch.textContent = 'Watch';
+        watch.onclick = () => sendMessage('SPECTATE', { gameId: g.gameId });
+        item.append(name, watch);
+        liveGamesContent.appendChild(item);
+    });
+    liveGamesSection.classList.remove('hidden');
+}
+
+function displayLeaderboard(entries) {
+    const content = document.getElementById('leaderboardContent');
+    content.innerHTML = '';
+    if (!entries || entries.length === 0) {
+        content.textContent = 'No rated games yet';
+    }
+
+    (entries || []).forEach(e => {
+        const item = document.createElement('div');
+        item.className = 'leaderboard-item';
+        [
+            ['rank', `#${e.rank}`],
+            ['name', `${e.username} (${e.wins}/${e.losses}/${e.draws} in ${e.gamesPlayed})`],
+            ['wins', `${e.rating} ±${e.deviation}`]
+        ].forEach(([cls, text]) => {
+            const span = document.createElement('span');
+            span.className = cls;
+            span.textContent = text;
+            item.appendChild(span);
+        });
+        content.appendChild(item);
+    });
     leaderboardSection.classList.remove('hidden');
 }
 
+/* ---------------- ACCOUNTS ---------------- */
+// authenticate logs in, registers or starts a guest session, keeping the token
+// the server hands back for opening the WebSocket
+async function authenticate(path, credentials) {
+    const res = await fetch(path, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(credentials || {})
+    });
+    if (!res.ok) {
+        showMessage((await res.text()).trim(), 'error');
+        return;
+    }
+
+    const auth = await res.json();
+    authToken = auth.token;
+    username = auth.username;
+    passwordInput.value = '';
+    authControls.classList.add('hidden');
+    identityInfo.textContent = auth.guest
+        ? `Playing as guest ${auth.username} (casual games only)`
+        : `Logged in as ${auth.username}`;
+    identityInfo.classList.remove('hidden');
+    if (auth.guest) {
+        casualCheckbox.checked = true;
+        casualCheckbox.disabled = true;
+    }
+}
+
+function credentials() {
+    return { username: usernameInput.value.trim(), password: passwordInput.value };
+}
+
 /* ---------------- EVENTS ---------------- */
-joinButton.onclick = () => {
-    username = usernameInput.value.trim();
-    if (!username) return;
+function enterGame(mode) {
+    if (!authToken) {
+        showMessage('Log in or play as a guest first', 'error');
+        return;
+    }
+    if (mode === 'joinRoom' && !roomCodeInput.value.trim()) return;
+    joinMode = mode;
 
     loginSection.classList.add('hidden');
-    gameSection.classList.remove('hidden');
+    if (mode !== 'watch') gameSection.classList.remove('hidden');
 
     initializeBoard();
     connectWebSocket();
-};
+}
 
-newGameButton.onclick = () => sendMessage({ type: 'JOIN', username });
-leaderboardButton.onclick = () => sendMessage({ type: 'GET_LEADERBOARD' });
+loginButton.onclick = () => authenticate('/login', credentials());
+registerButton.onclick = () => authenticate('/register', credentials());
+guestButton.onclick = () => authenticate('/guest');
+joinButton.onclick = () => enterGame('match');
+createRoomButton.onclick = () => enterGame('createRoom');
+joinRoomButton.onclick = () => enterGame('joinRoom');
+watchButton.onclick = () => enterGame('watch');
+refreshLiveGamesButton.onclick = () => sendMessage('LIST_GAMES');
+newGameButton.onclick = () => sendJoin();
+popModeButton.onclick = () => setPopMode(!popMode);
+takebackButton.onclick = () => sendMessage('TAKEBACK_REQUEST', { gameId });
+offerDrawButton.onclick = () => sendMessage('OFFER_DRAW', { gameId });
+resignButton.onclick = () => {
+    if (confirm('Resign this game?')) sendMessage('RESIGN', { gameId });
+};
+replayButton.onclick = () => sendMessage('REPLAY', { gameId, speed: 2 });
+rematchButton.onclick = () => {
+    sendMessage('REMATCH_REQUEST', { gameId });
+    showMessage('Rematch requested');
+};
+chatSendButton.onclick = sendChat;
+chatInput.onkeydown = (e) => {
+    if (e.key === 'Enter') sendChat();
+};
+muteButton.onclick = () => sendMessage(opponentMuted ? 'UNMUTE' : 'MUTE', { gameId });
+leaderboardButton.onclick = () => sendMessage('GET_LEADERBOARD');
 closeLeaderboardButton.onclick = () => leaderboardSection.classList.add('hidden');
 
+setInterval(updateClocks, 200);
 initializeBoard();